@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+)
+
+// ipAddressPoolIndex indexes IPAddresses by the IPPool they were allocated
+// from and their address, so that an address held twice in a pool is found
+// without listing the namespace.
+const ipAddressPoolIndex = "spec.poolRef.name/spec.address"
+
+// indexIPAddressPool returns the IPPool and address of an IPAddress, if it
+// was allocated from one of our pools.
+func indexIPAddressPool(obj client.Object) []string {
+	ip, ok := obj.(*ipamv1.IPAddress)
+	if !ok || !isIPPoolRef(ip.Spec.PoolRef) {
+		return nil
+	}
+	return []string{poolAddressKey(ip.Spec.PoolRef.Name, ip.Spec.Address)}
+}
+
+// poolAddressKey returns the ipAddressPoolIndex key of an address of a pool.
+func poolAddressKey(pool, address string) string {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		address = addr.String()
+	}
+	return pool + "/" + address
+}
+
+// heldAddressTTL is how long an IPAddress found holding its address is
+// trusted to still hold it.  The allocator is asked again once it expires,
+// so that addresses the allocator lost are reported as drift.
+const heldAddressTTL = 10 * time.Minute
+
+// heldAddresses remembers the IPAddresses found holding their addresses, so
+// that unchanged IPAddresses are not checked again on every reconcile of
+// their claim, which would cost remote calls with external backends.  The
+// entries of a pool are dropped when the pool is loaded into the allocator
+// again, and every entry expires after heldAddressTTL.
+type heldAddresses struct {
+	// now returns the current time, replaced by tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[types.NamespacedName]heldAddress
+}
+
+// heldAddress is the IPAddress state an address was found held with.
+type heldAddress struct {
+	resourceVersion string
+	pool            string
+	checked         time.Time
+}
+
+func newHeldAddresses() *heldAddresses {
+	return &heldAddresses{
+		now:     time.Now,
+		entries: map[types.NamespacedName]heldAddress{},
+	}
+}
+
+// verified reports whether ip was found holding its address since it last
+// changed, less than heldAddressTTL ago.
+func (h *heldAddresses) verified(ip *ipamv1.IPAddress) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.entries[types.NamespacedName{Namespace: ip.Namespace, Name: ip.Name}]
+	return ok && entry.resourceVersion == ip.ResourceVersion && h.now().Sub(entry.checked) < heldAddressTTL
+}
+
+func (h *heldAddresses) record(ip *ipamv1.IPAddress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[types.NamespacedName{Namespace: ip.Namespace, Name: ip.Name}] = heldAddress{
+		resourceVersion: ip.ResourceVersion,
+		pool:            ip.Spec.PoolRef.Name,
+		checked:         h.now(),
+	}
+}
+
+func (h *heldAddresses) forget(name types.NamespacedName) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.entries, name)
+}
+
+// forgetPool forgets the IPAddresses of a pool, whose addresses have to be
+// checked against the allocator again.
+func (h *heldAddresses) forgetPool(namespace, pool string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, entry := range h.entries {
+		if name.Namespace == namespace && entry.pool == pool {
+			delete(h.entries, name)
+		}
+	}
+}
+
+// boundAddress is an IPAddress bound to a claim and the address it was bound
+// with.
+type boundAddress struct {
+	name    string
+	address string
+}
+
+// parseBoundAddresses parses the BoundAddressesAnnotation of a claim.
+func parseBoundAddresses(value string) ([]boundAddress, error) {
+	var bound []boundAddress
+	for _, entry := range strings.Split(value, ",") {
+		name, address, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		if _, err := netip.ParseAddr(address); err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %w", entry, err)
+		}
+		bound = append(bound, boundAddress{name: name, address: address})
+	}
+	return bound, nil
+}
+
+// recordBoundAddresses records the addresses of the IPAddresses bound to a
+// claim in its BoundAddressesAnnotation.
+func (a *IPPoolClaimProcessor) recordBoundAddresses(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, ips []*ipamv1.IPAddress) error {
+	entries := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		entries = append(entries, fmt.Sprintf("%v=%v", ip.Name, ip.Spec.Address))
+	}
+	value := strings.Join(entries, ",")
+	if ipAddressClaim.Annotations[ipamcontrollerv1.BoundAddressesAnnotation] == value {
+		return nil
+	}
+	if ipAddressClaim.Annotations == nil {
+		ipAddressClaim.Annotations = map[string]string{}
+	}
+	ipAddressClaim.Annotations[ipamcontrollerv1.BoundAddressesAnnotation] = value
+	return a.Update(ctx, ipAddressClaim)
+}
+
+// addressDrift is a disagreement between the IPAddresses bound to a claim,
+// the addresses they were bound with and the allocator, which the controller
+// could not repair.
+type addressDrift struct {
+	reason string
+	err    error
+}
+
+func (d *addressDrift) Error() string {
+	return d.err.Error()
+}
+
+func (d *addressDrift) Unwrap() error {
+	return d.err
+}
+
+// syncIPAddresses checks that the IPAddresses bound to a claim still exist,
+// hold the addresses recorded when the claim was bound and are held in the
+// allocator.  Deleted IPAddresses are recreated and edited ones are put back.
+// The outcome is recorded in the claim's AddressesInSync condition.
+func (a *IPPoolClaimProcessor) syncIPAddresses(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim) error {
+	value, ok := ipAddressClaim.Annotations[ipamcontrollerv1.BoundAddressesAnnotation]
+	bound, err := parseBoundAddresses(value)
+	if !ok || err != nil {
+		if ok {
+			log.Warnf("Ignoring bound addresses of claim %v: %v", ipAddressClaim.Name, err)
+		}
+		// Claims bound by earlier versions have no recorded addresses yet
+		ips, err := a.claimIPAddresses(ctx, ipAddressClaim)
+		if apierrors.IsNotFound(err) {
+			return a.addressesSynced(ctx, ipAddressClaim, &addressDrift{
+				reason: ipamcontrollerv1.IPAddressClaimReasonAddressNotRecorded,
+				err:    fmt.Errorf("an IPAddress bound to the claim is gone and its address was not recorded: %w", err),
+			})
+		}
+		if err != nil {
+			return err
+		}
+		return a.recordBoundAddresses(ctx, ipAddressClaim, ips)
+	}
+
+	pool, err := a.boundPool(ctx, ipAddressClaim.Namespace, ipAddressClaim.Spec.PoolRef.Name)
+	if err != nil {
+		return a.addressesSynced(ctx, ipAddressClaim, err)
+	}
+	for _, address := range bound {
+		ipPool := pool
+		if address.name != ipAddressClaim.Status.AddressRef.Name {
+			// Every other IPAddress was allocated from the paired pool
+			if pool.Spec.PairedPool == "" {
+				return a.addressesSynced(ctx, ipAddressClaim, &addressDrift{
+					reason: ipamcontrollerv1.IPAddressClaimReasonPoolNotFound,
+					err:    fmt.Errorf("IPAddress %v was allocated from a pool paired with %v, which is no longer paired", address.name, pool.Name),
+				})
+			}
+			if ipPool, err = a.boundPool(ctx, pool.Namespace, pool.Spec.PairedPool); err != nil {
+				return a.addressesSynced(ctx, ipAddressClaim, err)
+			}
+		}
+		if err := a.restoreIPAddress(ctx, ipAddressClaim, ipPool, address, bound); err != nil {
+			return a.addressesSynced(ctx, ipAddressClaim, err)
+		}
+	}
+	return a.addressesSynced(ctx, ipAddressClaim, nil)
+}
+
+// boundPool returns a pool the addresses of a claim were allocated from.
+func (a *IPPoolClaimProcessor) boundPool(ctx context.Context, namespace, name string) (*ipamcontrollerv1.IPPool, error) {
+	pool := &ipamcontrollerv1.IPPool{}
+	if err := a.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, pool); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, &addressDrift{
+				reason: ipamcontrollerv1.IPAddressClaimReasonPoolNotFound,
+				err:    fmt.Errorf("IPPool %v does not exist", name),
+			}
+		}
+		return nil, err
+	}
+	return pool, nil
+}
+
+// addressesSynced records the outcome of syncIPAddresses in the claim's
+// AddressesInSync condition, and returns err.  Errors other than drift
+// leave the condition alone.
+func (a *IPPoolClaimProcessor) addressesSynced(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, err error) error {
+	var drift *addressDrift
+	if err != nil && !errors.As(err, &drift) {
+		return err
+	}
+
+	condition := clusterv1.Condition{
+		Type:   ipamcontrollerv1.IPAddressClaimConditionAddressesInSync,
+		Status: corev1.ConditionTrue,
+	}
+	if drift != nil {
+		a.recorder.Event(ipAddressClaim, corev1.EventTypeWarning, "AddressDrift", drift.Error())
+		condition.Status = corev1.ConditionFalse
+		condition.Severity = clusterv1.ConditionSeverityWarning
+		condition.Reason = drift.reason
+		condition.Message = drift.Error()
+	}
+	status := ipAddressClaim.Status.DeepCopy()
+	setClaimCondition(ipAddressClaim, condition)
+	if !equality.Semantic.DeepEqual(status, &ipAddressClaim.Status) {
+		if err := a.Client.Status().Update(ctx, ipAddressClaim); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// restoreIPAddress recreates a deleted IPAddress bound to a claim, or puts
+// back the address, gateway and prefix of an edited one.  IPAddresses whose
+// spec can't be updated are replaced when their address was changed, while
+// a changed gateway or prefix is left to the pool controller, which marks
+// them stale.  IPAddresses which didn't change since their address was last
+// found held are left alone.
+func (a *IPPoolClaimProcessor) restoreIPAddress(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, pool *ipamcontrollerv1.IPPool, address boundAddress, bound []boundAddress) error {
+	ip := &ipamv1.IPAddress{}
+	namespacedName := types.NamespacedName{Namespace: ipAddressClaim.Namespace, Name: address.name}
+	if err := a.Get(ctx, namespacedName, ip); err != nil {
+		if apierrors.IsNotFound(err) {
+			a.held.forget(namespacedName)
+			return a.recreateIPAddress(ctx, ipAddressClaim, pool, address, bound)
+		}
+		return err
+	}
+	if err := a.verifyOwnership(ipAddressClaim, ip); err != nil {
+		return &addressDrift{reason: ipamcontrollerv1.IPAddressClaimReasonAddressConflict, err: err}
+	}
+
+	_, stale := ip.Annotations[ipamcontrollerv1.StaleAddressAnnotation]
+	addressEdited := ip.Spec.Address != address.address
+	configEdited := !stale && (ip.Spec.Gateway != pool.Spec.Gateway || ip.Spec.Prefix != pool.Spec.Prefix)
+	if !addressEdited && !configEdited {
+		if a.held.verified(ip) {
+			return nil
+		}
+		if err := a.holdAddress(ctx, pool, ip); err != nil {
+			return err
+		}
+		a.held.record(ip)
+		return nil
+	}
+
+	updated := ip.DeepCopy()
+	updated.Spec.Address = address.address
+	updated.Spec.Gateway = pool.Spec.Gateway
+	updated.Spec.Prefix = pool.Spec.Prefix
+	if err := a.holdAddress(ctx, pool, updated); err != nil {
+		return err
+	}
+	err := a.Update(ctx, updated)
+	switch {
+	case err == nil:
+		a.held.record(updated)
+		log.Infof("Restored IPAddress %v of claim %v", ip.Name, ipAddressClaim.Name)
+		a.recorder.Eventf(ipAddressClaim, corev1.EventTypeNormal, "AddressRestored", "Restored IPAddress %v to %v", ip.Name, address.address)
+		return nil
+	case !apierrors.IsForbidden(err) && !apierrors.IsInvalid(err):
+		return err
+	case !addressEdited:
+		return nil
+	}
+
+	log.Warnf("Unable to update IPAddress %v, replacing it: %v", ip.Name, err)
+	if err := a.Delete(ctx, ip); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return a.recreateIPAddress(ctx, ipAddressClaim, pool, address, bound)
+}
+
+// recreateIPAddress creates a deleted IPAddress bound to a claim again, with
+// the address it was bound with.
+func (a *IPPoolClaimProcessor) recreateIPAddress(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, pool *ipamcontrollerv1.IPPool, address boundAddress, bound []boundAddress) error {
+	if !pool.DeletionTimestamp.IsZero() {
+		return &addressDrift{
+			reason: ipamcontrollerv1.IPAddressClaimReasonPoolNotReady,
+			err:    fmt.Errorf("IPAddress %v is gone and pool %v is being deleted", address.name, pool.Name),
+		}
+	}
+
+	ip := mgmt.NewIPAddress(ipAddressClaim, pool, address.name, address.address)
+	if address.name == ipAddressClaim.Status.AddressRef.Name {
+		for _, other := range bound {
+			if other.name != address.name {
+				ip.Annotations = map[string]string{
+					ipamcontrollerv1.PairedAddressAnnotation: other.name,
+				}
+			}
+		}
+	}
+	if err := controllerutil.SetControllerReference(ipAddressClaim, ip, a.Scheme()); err != nil {
+		return err
+	}
+	if err := a.holdAddress(ctx, pool, ip); err != nil {
+		return err
+	}
+	if err := a.Create(ctx, ip); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			// The IPAddress was created since it was read from the cache,
+			// its creation brings the claim back
+			return nil
+		}
+		return err
+	}
+	a.held.record(ip)
+	log.Infof("Recreated IPAddress %v (%v) of claim %v", ip.Name, ip.Spec.Address, ipAddressClaim.Name)
+	a.recorder.Eventf(ipAddressClaim, corev1.EventTypeNormal, "AddressRecreated", "Recreated deleted IPAddress %v (%v)", ip.Name, ip.Spec.Address)
+
+	// The DNS name of the deleted IPAddress is lost, so the records are
+	// registered again
+	removeClaimCondition(ipAddressClaim, ipamcontrollerv1.IPAddressClaimConditionDNSRecordsReady)
+	return nil
+}
+
+// holdAddress checks that no other IPAddress of the pool holds the address
+// of ip, and makes sure the allocator holds it for ip.
+func (a *IPPoolClaimProcessor) holdAddress(ctx context.Context, pool *ipamcontrollerv1.IPPool, ip *ipamv1.IPAddress) error {
+	ips := &ipamv1.IPAddressList{}
+	if err := a.List(ctx, ips, client.InNamespace(ip.Namespace), client.MatchingFields{ipAddressPoolIndex: poolAddressKey(pool.Name, ip.Spec.Address)}); err != nil {
+		return err
+	}
+	for _, other := range ips.Items {
+		if other.Name != ip.Name {
+			return &addressDrift{
+				reason: ipamcontrollerv1.IPAddressClaimReasonAddressConflict,
+				err:    fmt.Errorf("%v of IPAddress %v is held by IPAddress %v", ip.Spec.Address, ip.Name, other.Name),
+			}
+		}
+	}
+
+	if err := a.allocator.ClaimIPAddress(ctx, pool, *ip); err != nil {
+		if errors.Is(err, mgmt.ErrPoolNotInitialized) {
+			return err
+		}
+		return &addressDrift{
+			reason: ipamcontrollerv1.IPAddressClaimReasonAddressConflict,
+			err:    fmt.Errorf("pool %v does not hold %v of IPAddress %v: %w", pool.Name, ip.Spec.Address, ip.Name, err),
+		}
+	}
+	return nil
+}
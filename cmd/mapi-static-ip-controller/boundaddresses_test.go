@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	goipam "github.com/metal-stack/go-ipam"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+)
+
+// countingAllocator counts the addresses claimed one at a time.
+type countingAllocator struct {
+	mgmt.Allocator
+	claims int
+}
+
+func (c *countingAllocator) ClaimIPAddress(ctx context.Context, pool *ipamcontrollerv1.IPPool, address ipamv1.IPAddress) error {
+	c.claims++
+	return c.Allocator.ClaimIPAddress(ctx, pool, address)
+}
+
+func TestRestoreIPAddressHoldsOnce(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, ipamv1.AddToScheme, ipamcontrollerv1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool := &ipamcontrollerv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec:       ipamcontrollerv1.IPPoolSpec{AddressCidr: "192.168.1.0/29", Prefix: 24},
+	}
+	allocator := &countingAllocator{Allocator: mgmt.NewGoIPAMAllocator(goipam.NewMemory())}
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+	apiGroup := ipamcontrollerv1.APIGroupName
+	claim := &ipamv1.IPAddressClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "claim", UID: "claim"},
+		Spec: ipamv1.IPAddressClaimSpec{
+			PoolRef: corev1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: ipamcontrollerv1.IPPoolKind, Name: "pool"},
+		},
+	}
+	claim.Status.AddressRef.Name = "claim"
+	ip, err := allocator.GetIPAddress(ctx, claim)
+	if err != nil {
+		t.Fatalf("unable to get address: %v", err)
+	}
+
+	now := time.Now()
+	held := newHeldAddresses()
+	held.now = func() time.Time { return now }
+	processor := &IPPoolClaimProcessor{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool, claim, ip).
+			WithIndex(&ipamv1.IPAddress{}, ipAddressPoolIndex, indexIPAddressPool).Build(),
+		allocator: allocator,
+		held:      held,
+		recorder:  record.NewFakeRecorder(10),
+	}
+	bound := []boundAddress{{name: ip.Name, address: ip.Spec.Address}}
+	restore := func() error {
+		return processor.restoreIPAddress(ctx, claim, pool, bound[0], bound)
+	}
+	expectConflict := func(what string) {
+		t.Helper()
+		err := restore()
+		var drift *addressDrift
+		if !errors.As(err, &drift) || drift.reason != ipamcontrollerv1.IPAddressClaimReasonAddressConflict {
+			t.Errorf("%v: expected an address conflict, got %v", what, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := restore(); err != nil {
+			t.Fatalf("unable to restore IPAddress: %v", err)
+		}
+	}
+	if allocator.claims != 1 {
+		t.Errorf("got %v claims of the unchanged IPAddress, want 1", allocator.claims)
+	}
+
+	// Another IPAddress of the pool taking the address is found through the
+	// index once the IPAddress is due to be checked again.
+	duplicate := mgmt.NewIPAddress(claim, pool, "duplicate", ip.Spec.Address)
+	if err := processor.Create(ctx, duplicate); err != nil {
+		t.Fatalf("unable to create IPAddress: %v", err)
+	}
+	now = now.Add(heldAddressTTL)
+	expectConflict("duplicate IPAddress")
+	if err := processor.Delete(ctx, duplicate); err != nil {
+		t.Fatalf("unable to delete IPAddress: %v", err)
+	}
+	if err := restore(); err != nil {
+		t.Fatalf("unable to restore IPAddress: %v", err)
+	}
+
+	// Loading the pool again has its IPAddresses checked again.
+	poolController := &IPPoolController{
+		Client:    processor.Client,
+		allocator: allocator,
+		apiReader: processor.Client,
+		held:      held,
+		recorder:  record.NewFakeRecorder(10),
+	}
+	pool = pool.DeepCopy()
+	pool.Spec.Excludes = []string{"192.168.1.6"}
+	if _, err := poolController.LoadPool(ctx, pool); err != nil {
+		t.Fatalf("unable to load pool: %v", err)
+	}
+	claims := allocator.claims
+	if err := restore(); err != nil || allocator.claims != claims+1 {
+		t.Errorf("expected the IPAddress to be checked after the pool was rebuilt, got %v claims, %v", allocator.claims-claims, err)
+	}
+
+	// An address the allocator lost to another IPAddress is reported once
+	// the IPAddress is due to be checked again.
+	if err := allocator.ReleaseIPConfiguration(ctx, ip); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	if err := allocator.ClaimIPAddress(ctx, pool, *mgmt.NewIPAddress(claim, pool, "thief", ip.Spec.Address)); err != nil {
+		t.Fatalf("unable to claim address: %v", err)
+	}
+	if err := restore(); err != nil {
+		t.Errorf("expected the IPAddress not to be checked before its entry expires, got %v", err)
+	}
+	now = now.Add(heldAddressTTL)
+	expectConflict("address lost by the allocator")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+)
+
+// setClaimCondition sets a condition on a claim.  The last transition time is
+// only updated when the status of the condition changes.
+func setClaimCondition(ipAddressClaim *ipamv1.IPAddressClaim, condition clusterv1.Condition) {
+	for i, current := range ipAddressClaim.Status.Conditions {
+		if current.Type != condition.Type {
+			continue
+		}
+		condition.LastTransitionTime = current.LastTransitionTime
+		if current.Status != condition.Status {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		ipAddressClaim.Status.Conditions[i] = condition
+		return
+	}
+	condition.LastTransitionTime = metav1.Now()
+	ipAddressClaim.Status.Conditions = append(ipAddressClaim.Status.Conditions, condition)
+}
+
+// claimConditionIsTrue reports whether a claim has a condition with a true
+// status.
+func claimConditionIsTrue(ipAddressClaim *ipamv1.IPAddressClaim, conditionType clusterv1.ConditionType) bool {
+	for _, condition := range ipAddressClaim.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// removeClaimCondition removes a condition from a claim.
+func removeClaimCondition(ipAddressClaim *ipamv1.IPAddressClaim, conditionType clusterv1.ConditionType) {
+	conditions := ipAddressClaim.Status.Conditions[:0]
+	for _, condition := range ipAddressClaim.Status.Conditions {
+		if condition.Type != conditionType {
+			conditions = append(conditions, condition)
+		}
+	}
+	ipAddressClaim.Status.Conditions = conditions
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	goipam "github.com/metal-stack/go-ipam"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+)
+
+func TestClaimConditions(t *testing.T) {
+	ipAddressClaim := &ipamv1.IPAddressClaim{}
+	ready := clusterv1.ConditionType(ipamcontrollerv1.IPAddressClaimConditionReady)
+	dnsReady := clusterv1.ConditionType(ipamcontrollerv1.IPAddressClaimConditionDNSRecordsReady)
+
+	setClaimCondition(ipAddressClaim, clusterv1.Condition{Type: ready, Status: corev1.ConditionFalse, Reason: "PoolExhausted"})
+	if claimConditionIsTrue(ipAddressClaim, ready) || claimConditionIsTrue(ipAddressClaim, dnsReady) {
+		t.Errorf("expected no condition to be true, got %+v", ipAddressClaim.Status.Conditions)
+	}
+	transition := metav1.NewTime(time.Now().Add(-time.Hour))
+	ipAddressClaim.Status.Conditions[0].LastTransitionTime = transition
+
+	// The transition time is kept while the status stays the same.
+	setClaimCondition(ipAddressClaim, clusterv1.Condition{Type: ready, Status: corev1.ConditionFalse, Reason: "PoolNotReady"})
+	if len(ipAddressClaim.Status.Conditions) != 1 {
+		t.Fatalf("got conditions %+v, want one", ipAddressClaim.Status.Conditions)
+	}
+	condition := ipAddressClaim.Status.Conditions[0]
+	if condition.Reason != "PoolNotReady" || !condition.LastTransitionTime.Equal(&transition) {
+		t.Errorf("got %+v, want reason PoolNotReady since %v", condition, transition)
+	}
+
+	setClaimCondition(ipAddressClaim, clusterv1.Condition{Type: ready, Status: corev1.ConditionTrue})
+	condition = ipAddressClaim.Status.Conditions[0]
+	if !claimConditionIsTrue(ipAddressClaim, ready) || condition.LastTransitionTime.Equal(&transition) {
+		t.Errorf("got %+v, want a true condition with a new transition time", condition)
+	}
+
+	setClaimCondition(ipAddressClaim, clusterv1.Condition{Type: dnsReady, Status: corev1.ConditionTrue})
+	if !claimConditionIsTrue(ipAddressClaim, dnsReady) || len(ipAddressClaim.Status.Conditions) != 2 {
+		t.Errorf("got conditions %+v, want Ready and DNSRecordsReady", ipAddressClaim.Status.Conditions)
+	}
+	removeClaimCondition(ipAddressClaim, dnsReady)
+	if claimConditionIsTrue(ipAddressClaim, dnsReady) || !claimConditionIsTrue(ipAddressClaim, ready) {
+		t.Errorf("got conditions %+v, want only Ready", ipAddressClaim.Status.Conditions)
+	}
+}
+
+// TestReconcileSetsReady checks the Ready condition of claims bound to an
+// address and of claims left without one.
+func TestReconcileSetsReady(t *testing.T) {
+	ctx := context.Background()
+	pool := &ipamcontrollerv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec:       ipamcontrollerv1.IPPoolSpec{AddressCidr: "192.168.1.0/30", Prefix: 24},
+	}
+	allocator := mgmt.NewDispatcher(mgmt.NewGoIPAMAllocator(goipam.NewMemory()), nil)
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+
+	// The pool has two addresses to hand out.
+	created := time.Now().Add(-time.Hour)
+	claims := []*ipamv1.IPAddressClaim{
+		testClaim("ns", "first", pool.Name, created),
+		testClaim("ns", "second", pool.Name, created),
+		testClaim("ns", "third", pool.Name, created),
+	}
+	startup := &startupSync{done: make(chan struct{})}
+	close(startup.done)
+	processor := &IPPoolClaimProcessor{
+		Client: fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(pool, claims[0], claims[1], claims[2]).
+			WithIndex(&ipamv1.IPAddress{}, ipAddressPoolIndex, indexIPAddressPool).Build(),
+		startup:   startup,
+		allocator: allocator,
+		held:      newHeldAddresses(),
+		recorder:  record.NewFakeRecorder(10),
+	}
+	reconcileClaim := func(name string) *ipamv1.IPAddressClaim {
+		t.Helper()
+		req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: name}}
+		_, _ = processor.Reconcile(ctx, req)
+		ipAddressClaim := &ipamv1.IPAddressClaim{}
+		if err := processor.Get(ctx, req.NamespacedName, ipAddressClaim); err != nil {
+			t.Fatalf("unable to get claim: %v", err)
+		}
+		return ipAddressClaim
+	}
+
+	for _, name := range []string{"first", "second"} {
+		if ipAddressClaim := reconcileClaim(name); !claimConditionIsTrue(ipAddressClaim, ipamcontrollerv1.IPAddressClaimConditionReady) {
+			t.Errorf("got conditions %+v of bound claim %v, want Ready", ipAddressClaim.Status.Conditions, name)
+		}
+	}
+
+	ipAddressClaim := reconcileClaim("third")
+	if len(ipAddressClaim.Status.Conditions) != 1 {
+		t.Fatalf("got conditions %+v, want Ready", ipAddressClaim.Status.Conditions)
+	}
+	condition := ipAddressClaim.Status.Conditions[0]
+	if condition.Status != corev1.ConditionFalse || condition.Reason != ipamcontrollerv1.IPAddressClaimReasonPoolExhausted {
+		t.Errorf("got %+v, want Ready false because the pool is exhausted", condition)
+	}
+
+	// Binding the claim once an address is released makes it Ready.
+	if err := processor.Delete(ctx, claims[0]); err != nil {
+		t.Fatalf("unable to delete claim: %v", err)
+	}
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "first"}}
+	if _, err := processor.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unable to release claim: %v", err)
+	}
+	if ipAddressClaim = reconcileClaim("third"); !claimConditionIsTrue(ipAddressClaim, ipamcontrollerv1.IPAddressClaimConditionReady) {
+		t.Errorf("got conditions %+v once an address was released, want Ready", ipAddressClaim.Status.Conditions)
+	}
+}
@@ -2,38 +2,110 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
+	"net"
+	"net/netip"
 	"os"
 	"strings"
-	"sync"
+	"time"
 
 	osclientset "github.com/openshift/client-go/config/clientset/versioned"
 	mapiclientset "github.com/openshift/client-go/machine/clientset/versioned"
 	log "github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/ddns"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/dhcp"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/metrics"
 	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/webhook"
 )
 
 var (
 	mgr              manager.Manager
-	mu               sync.Mutex
+	locks            = newPoolLocks()
 	reservedMachines = map[string]struct{}{}
 )
 
 func main() {
+	enableWebhook := flag.Bool("enable-webhook", false, "Serve the IPPool validating webhook")
+	webhookPort := flag.Int("webhook-port", 9443, "Port the webhook server listens on")
+	webhookCertDir := flag.String("webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "Directory containing tls.crt and tls.key for the webhook server")
+	metricsAddr := flag.String("metrics-bind-address", ":8080", "Address the metrics endpoint is served on")
+	healthProbeAddr := flag.String("health-probe-bind-address", ":8081", "Address the readiness and liveness probes are served on")
+	leaderElect := flag.Bool("leader-elect", false, "Elect a leader among the replicas, only the leader binds claims")
+	leaderElectionNamespace := flag.String("leader-election-namespace", "openshift-machine-api", "Namespace of the leader election lease")
+	leaderElectionID := flag.String("leader-election-id", "machine-ipam-controller-leader", "Name of the leader election lease")
+	maxConcurrentReconciles := flag.Int("max-concurrent-reconciles", 10, "Number of claims and pools reconciled in parallel, claims against the same pool are always bound one at a time")
 
-	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{})
+	storageConfig := mgmt.StorageConfig{}
+	flag.StringVar(&storageConfig.Type, "ipam-storage", mgmt.StorageMemory, "Storage backend of the allocator: memory, kubernetes, etcd, redis, postgres or mongodb")
+	flag.StringVar(&storageConfig.Namespace, "ipam-storage-namespace", "openshift-machine-api", "Namespace of the ConfigMaps holding the allocator state with the kubernetes storage backend")
+	flag.StringVar(&storageConfig.Host, "ipam-storage-host", "localhost", "Host of the storage backend")
+	flag.StringVar(&storageConfig.Port, "ipam-storage-port", "", "Port of the storage backend")
+	flag.StringVar(&storageConfig.Username, "ipam-storage-username", "", "User to connect to the postgres or mongodb storage backend as")
+	flag.StringVar(&storageConfig.Database, "ipam-storage-database", "machine-ipam-controller", "Postgres or mongodb database holding the allocator state")
+	flag.StringVar(&storageConfig.SSLMode, "ipam-storage-sslmode", "require", "Postgres sslmode")
+	flag.BoolVar(&storageConfig.InsecureSkipVerify, "ipam-storage-insecure-skip-verify", false, "Skip verification of the etcd server certificate")
+	storageSecretDir := flag.String("ipam-storage-secret-dir", "", "Directory where a secret with the storage backend's connection settings and credentials is mounted")
+	flag.Parse()
+
+	if *storageSecretDir != "" {
+		if err := storageConfig.LoadSecret(*storageSecretDir); err != nil {
+			log.Errorf("could not load storage secret: %v", err)
+			os.Exit(1)
+		}
+	}
+	if storageConfig.Type == mgmt.StorageKubernetes {
+		// The allocator must always see the latest state, so don't read
+		// through the manager's cache
+		storageClient, err := client.New(config.GetConfigOrDie(), client.Options{})
+		if err != nil {
+			log.Errorf("could not create client for storage: %v", err)
+			os.Exit(1)
+		}
+		storageConfig.Client = storageClient
+	}
+	storage, err := mgmt.NewStorage(context.Background(), storageConfig)
+	if err != nil {
+		log.Errorf("could not connect to %v storage: %v", storageConfig.Type, err)
+		os.Exit(1)
+	}
+
+	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{
+		Port:                    *webhookPort,
+		CertDir:                 *webhookCertDir,
+		MetricsBindAddress:      *metricsAddr,
+		HealthProbeBindAddress:  *healthProbeAddr,
+		LeaderElection:          *leaderElect,
+		LeaderElectionNamespace: *leaderElectionNamespace,
+		LeaderElectionID:        *leaderElectionID,
+		// Hand the lease over right away when shutting down
+		LeaderElectionReleaseOnCancel: true,
+	})
 	if err != nil {
 		log.Errorf("could not create manager")
 		os.Exit(1)
@@ -46,10 +118,52 @@ func main() {
 	ipamv1.AddToScheme(mgr.GetScheme())
 	ipamcontrollerv1.AddToScheme(mgr.GetScheme())
 
+	// Credentials of external backends are read from the API server, so
+	// that secrets don't have to be cached
+	allocator := mgmt.NewDispatcher(mgmt.NewGoIPAMAllocator(storage), map[string]mgmt.Allocator{
+		mgmt.BackendInfoblox: mgmt.NewInfobloxAllocator(mgr.GetAPIReader()),
+		mgmt.BackendNetBox:   mgmt.NewNetBoxAllocator(mgr.GetAPIReader()),
+		mgmt.BackendHTTP:     mgmt.NewHTTPAllocator(mgr.GetAPIReader()),
+	})
+	recorder := mgr.GetEventRecorderFor("machine-ipam-controller")
+	held := newHeldAddresses()
+	poolController := &IPPoolController{allocator: allocator, apiReader: mgr.GetAPIReader(), held: held, recorder: recorder}
+	var lease *coordinationv1.Lease
+	if *leaderElect {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: *leaderElectionNamespace,
+				Name:      *leaderElectionID,
+			},
+		}
+	}
+	startup := newStartupSync(mgr, poolController, lease)
+
+	// Claims are looked up by pool to requeue the claims waiting for a pool
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &ipamv1.IPAddressClaim{}, claimPoolIndex, indexClaimPool); err != nil {
+		log.Error(err, "could not index claims")
+		os.Exit(1)
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &ipamv1.IPAddress{}, ipAddressPoolIndex, indexIPAddressPool); err != nil {
+		log.Error(err, "could not index IPAddresses")
+		os.Exit(1)
+	}
+
+	claimProcessor := &IPPoolClaimProcessor{
+		startup:   startup,
+		allocator: allocator,
+		dns:       ddns.NewUpdater(mgr.GetAPIReader()),
+		held:      held,
+		recorder:  recorder,
+	}
 	err = builder.
 		ControllerManagedBy(mgr). // Create the ControllerManagedBy
 		For(&ipamv1.IPAddressClaim{}).
-		Complete(&IPPoolClaimProcessor{})
+		Owns(&ipamv1.IPAddress{}).
+		Watches(&source.Kind{Type: &ipamcontrollerv1.IPPool{}}, handler.EnqueueRequestsFromMapFunc(claimProcessor.poolToPendingClaims), builder.WithPredicates(poolMayBindClaims)).
+		Watches(&source.Kind{Type: &ipamv1.IPAddress{}}, handler.EnqueueRequestsFromMapFunc(claimProcessor.ipAddressToPendingClaims), builder.WithPredicates(ipAddressReleased)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: *maxConcurrentReconciles}).
+		Complete(claimProcessor)
 	if err != nil {
 		log.Error(err, "could not create claim processor")
 		os.Exit(1)
@@ -58,12 +172,40 @@ func main() {
 	err = builder.
 		ControllerManagedBy(mgr). // Create the ControllerManagedBy
 		For(&ipamcontrollerv1.IPPool{}).
-		Complete(&IPPoolController{})
+		Watches(&source.Kind{Type: &ipamv1.IPAddress{}}, handler.EnqueueRequestsFromMapFunc(ipAddressToPool)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: *maxConcurrentReconciles}).
+		Complete(poolController)
 	if err != nil {
 		log.Error(err, "could not create controller")
 		os.Exit(1)
 	}
 
+	// Load the allocator before claims are bound
+	if err := mgr.Add(startup); err != nil {
+		log.Error(err, "could not add startup sync")
+		os.Exit(1)
+	}
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		log.Error(err, "could not add health check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("startup-sync", startup.Check); err != nil {
+		log.Error(err, "could not add readiness check")
+		os.Exit(1)
+	}
+
+	if *enableWebhook {
+		err = builder.
+			WebhookManagedBy(mgr).
+			For(&ipamcontrollerv1.IPPool{}).
+			WithValidator(&webhook.IPPoolValidator{Client: mgr.GetAPIReader()}).
+			Complete()
+		if err != nil {
+			log.Error(err, "could not create webhook")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
 		log.Error(err, "could not start manager")
 		os.Exit(1)
@@ -72,191 +214,1132 @@ func main() {
 
 type IPPoolClaimProcessor struct {
 	client.Client
+
+	// startup holds off binding claims until the allocator is loaded.
+	startup *startupSync
+
+	allocator mgmt.Allocator
+
+	// dns registers the addresses of pools with DNS settings.
+	dns *ddns.Updater
+
+	// held remembers the bound IPAddresses found holding their addresses.
+	held *heldAddresses
+
+	recorder record.EventRecorder
 }
 
 type IPPoolController struct {
 	client.Client
+
+	allocator mgmt.Allocator
+
+	// apiReader reads the ConfigMaps DHCP reservations are exported to, so
+	// that ConfigMaps don't have to be cached, and the IPAddresses replayed
+	// into a rebuilt pool, so that none created since the cache was last
+	// updated is missed.
+	apiReader client.Reader
+
+	// held is shared with the claim processor, whose IPAddresses are
+	// checked again once their pool is loaded again.
+	held *heldAddresses
+
+	recorder record.EventRecorder
 }
 
+// BindClaim binds a claim to an IPAddress.  Binding is idempotent: an
+// IPAddress left behind by an earlier attempt is adopted instead of
+// allocating a new address.
 func (a *IPPoolClaimProcessor) BindClaim(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim) error {
 	log.Info("Received BindClaim")
-	ip, err := mgmt.GetIPAddress(ctx, ipAddressClaim)
+	start := time.Now()
+
+	pool := &ipamcontrollerv1.IPPool{}
+	if err := a.Get(ctx, types.NamespacedName{Namespace: ipAddressClaim.Namespace, Name: ipAddressClaim.Spec.PoolRef.Name}, pool); err != nil {
+		log.Errorf("Unable to get IPPool: %v", err)
+		if apierrors.IsNotFound(err) {
+			return a.bindFailed(ctx, ipAddressClaim, ipamcontrollerv1.IPAddressClaimReasonPoolNotFound,
+				fmt.Errorf("IPPool %v does not exist", ipAddressClaim.Spec.PoolRef.Name))
+		}
+		return err
+	}
+
+	ips, err := a.adoptIPAddress(ctx, pool, ipAddressClaim)
 	if err != nil {
-		log.Errorf("Unable to get IPAddress: %v", err)
+		log.Errorf("Unable to adopt IPAddress: %v", err)
+		return a.bindFailed(ctx, ipAddressClaim, ipamcontrollerv1.IPAddressClaimReasonResyncConflict,
+			fmt.Errorf("unable to adopt the IPAddress of the claim: %w", err))
+	}
+	if ips == nil {
+		// Pools being deleted don't hand out new addresses
+		if !pool.DeletionTimestamp.IsZero() {
+			return a.bindFailed(ctx, ipAddressClaim, ipamcontrollerv1.IPAddressClaimReasonPoolNotReady,
+				fmt.Errorf("pool %v is being deleted", pool.Name))
+		}
+		if ips, err = a.allocateIPAddresses(ctx, ipAddressClaim); err != nil {
+			reason := bindFailureReason(err)
+			if reason == ipamcontrollerv1.IPAddressClaimReasonPoolExhausted {
+				a.recorder.Eventf(pool, corev1.EventTypeWarning, reason, "No free address left for claim %v", ipAddressClaim.Name)
+			}
+			return a.bindFailed(ctx, ipAddressClaim, reason,
+				fmt.Errorf("unable to allocate an address from pool %v: %w", pool.Name, err))
+		}
+	}
+
+	if err := a.recordBoundAddresses(ctx, ipAddressClaim, ips); err != nil {
+		log.Errorf("Unable to record addresses of claim: %v", err)
+		return err
+	}
+
+	ipAddressClaim.Status.AddressRef = corev1.LocalObjectReference{
+		Name: ips[0].ObjectMeta.Name,
+	}
+	setClaimCondition(ipAddressClaim, clusterv1.Condition{
+		Type:   ipamcontrollerv1.IPAddressClaimConditionReady,
+		Status: corev1.ConditionTrue,
+	})
+	if err = a.Client.Status().Update(ctx, ipAddressClaim); err != nil {
+		log.Errorf("Unable to update claim: %v", err)
 		return err
 	}
+	metrics.BindSeconds.WithLabelValues(pool.Namespace, pool.Name).Observe(time.Since(start).Seconds())
+
+	log.Debugf("Bound claim %v/%v to IPAddress %v", ipAddressClaim.Namespace, ipAddressClaim.Name, ipAddressClaim.Status.AddressRef.Name)
+	return nil
+}
+
+// allocateIPAddresses allocates the claim's addresses and creates their
+// IPAddresses, the IPAddress referenced by the claim first.  Nothing is left
+// allocated when it fails.
+func (a *IPPoolClaimProcessor) allocateIPAddresses(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim) ([]*ipamv1.IPAddress, error) {
+	ip, err := a.allocator.GetIPAddress(ctx, ipAddressClaim)
+	if err != nil {
+		log.Errorf("Unable to get IPAddress: %v", err)
+		if errors.Is(err, mgmt.ErrPoolExhausted) {
+			metrics.PoolExhausted.WithLabelValues(ipAddressClaim.Namespace, ipAddressClaim.Spec.PoolRef.Name).Inc()
+		}
+		return nil, err
+	}
 	log.Infof("Got IPAddress %v", ip)
 
+	// Claims against a dual-stack pool get an address from the paired pool too
+	paired, err := a.allocator.GetPairedIPAddress(ctx, ipAddressClaim)
+	if err != nil {
+		log.Errorf("Unable to get paired IPAddress: %v", err)
+		a.releaseIPAddresses(ctx, ip)
+		return nil, err
+	}
+	if paired != nil {
+		log.Infof("Got paired IPAddress %v", paired)
+		ip.Annotations = map[string]string{
+			ipamcontrollerv1.PairedAddressAnnotation: paired.Name,
+		}
+	}
+
+	// The IPAddresses belong to the claim
+	for _, obj := range []*ipamv1.IPAddress{ip, paired} {
+		if obj == nil {
+			continue
+		}
+		if err := controllerutil.SetControllerReference(ipAddressClaim, obj, a.Scheme()); err != nil {
+			log.Errorf("Unable to set owner of IPAddress: %v", err)
+			a.releaseIPAddresses(ctx, ip, paired)
+			return nil, err
+		}
+	}
+
 	// create ipaddress object
 	if err = a.Client.Create(ctx, ip); err != nil {
 		log.Errorf("Unable to create IPAddress: %v", err)
-		err2 := mgmt.ReleaseIPConfiguration(ctx, ip)
-		if err2 != nil {
-			log.Errorf("Unable to release IPAddress: %v", err2)
-			return errors.Wrap(err, "Unable to release IPAddress")
+		a.releaseIPAddresses(ctx, ip, paired)
+		return nil, err
+	}
+	if paired != nil {
+		if err = a.Client.Create(ctx, paired); err != nil {
+			log.Errorf("Unable to create paired IPAddress: %v", err)
+			if err2 := a.Client.Delete(ctx, ip); err2 != nil {
+				log.Errorf("Unable to delete IPAddress: %v", err2)
+				return nil, errors.Wrap(err, "Unable to delete IPAddress")
+			}
+			a.releaseIPAddresses(ctx, ip, paired)
+			return nil, err
 		}
-		return err
 	}
-	ipAddressClaim.Status = ipamv1.IPAddressClaimStatus{
-		AddressRef: corev1.LocalObjectReference{
-			Name: ip.ObjectMeta.Name,
-		},
+	ips := []*ipamv1.IPAddress{ip}
+	if paired != nil {
+		ips = append(ips, paired)
 	}
-	if err = a.Client.Status().Update(ctx, ipAddressClaim); err != nil {
-		log.Errorf("Unable to update claim: %v", err)
-		return err
+	for _, obj := range ips {
+		metrics.Allocations.WithLabelValues(obj.Namespace, obj.Spec.PoolRef.Name).Inc()
+		a.recorder.Eventf(ipAddressClaim, corev1.EventTypeNormal, "AddressAllocated", "Allocated %v from pool %v", obj.Spec.Address, obj.Spec.PoolRef.Name)
+	}
+	return ips, nil
+}
+
+// bindFailureReason returns the reason a claim could not be bound to an
+// address from its pool.
+func bindFailureReason(err error) string {
+	switch {
+	case errors.Is(err, mgmt.ErrPoolExhausted):
+		return ipamcontrollerv1.IPAddressClaimReasonPoolExhausted
+	case errors.Is(err, mgmt.ErrPoolNotInitialized):
+		return ipamcontrollerv1.IPAddressClaimReasonPoolNotReady
+	default:
+		return ipamcontrollerv1.IPAddressClaimReasonAllocationFailed
+	}
+}
+
+// bindFailed records why a claim could not be bound in an event and in the
+// claim's Ready condition, and returns err.
+func (a *IPPoolClaimProcessor) bindFailed(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, reason string, err error) error {
+	a.recorder.Event(ipAddressClaim, corev1.EventTypeWarning, reason, err.Error())
+
+	status := ipAddressClaim.Status.DeepCopy()
+	setClaimCondition(ipAddressClaim, clusterv1.Condition{
+		Type:     ipamcontrollerv1.IPAddressClaimConditionReady,
+		Status:   corev1.ConditionFalse,
+		Severity: clusterv1.ConditionSeverityWarning,
+		Reason:   reason,
+		Message:  err.Error(),
+	})
+	if !equality.Semantic.DeepEqual(status, &ipAddressClaim.Status) {
+		if err := a.Client.Status().Update(ctx, ipAddressClaim); err != nil {
+			log.Errorf("Unable to update claim: %v", err)
+		}
+	}
+	return err
+}
+
+// adoptIPAddress looks for an IPAddress created for the claim by an earlier
+// binding attempt.  Its address is marked as used in the allocator again and a
+// missing paired IPAddress is allocated.  The adopted IPAddresses are
+// returned the same way allocateIPAddresses returns them, or nil when there
+// is no IPAddress to adopt.
+func (a *IPPoolClaimProcessor) adoptIPAddress(ctx context.Context, pool *ipamcontrollerv1.IPPool, ipAddressClaim *ipamv1.IPAddressClaim) ([]*ipamv1.IPAddress, error) {
+	ip := &ipamv1.IPAddress{}
+	if err := a.Get(ctx, types.NamespacedName{Namespace: ipAddressClaim.Namespace, Name: ipAddressClaim.Name}, ip); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := a.verifyOwnership(ipAddressClaim, ip); err != nil {
+		return nil, err
+	}
+	if ip.Spec.PoolRef.Name != pool.Name {
+		return nil, fmt.Errorf("IPAddress %v was allocated from pool %v, not %v", ip.Name, ip.Spec.PoolRef.Name, pool.Name)
+	}
+
+	log.Infof("Adopting IPAddress %v (%v) for claim %v", ip.Name, ip.Spec.Address, ipAddressClaim.Name)
+	if err := a.allocator.ClaimIPAddress(ctx, pool, *ip); err != nil {
+		return nil, err
+	}
+	paired, err := a.adoptPairedIPAddress(ctx, ipAddressClaim, ip)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.setOwner(ctx, ipAddressClaim, ip); err != nil {
+		return nil, err
+	}
+	a.recorder.Eventf(ipAddressClaim, corev1.EventTypeNormal, "AddressAdopted", "Adopted IPAddress %v (%v) left by an earlier binding attempt", ip.Name, ip.Spec.Address)
+	ips := []*ipamv1.IPAddress{ip}
+	if paired != nil {
+		ips = append(ips, paired)
+	}
+	return ips, nil
+}
+
+// adoptPairedIPAddress adopts the paired IPAddress of an adopted IPAddress,
+// allocating it if it was never created.  Nil is returned when the claim's
+// pool is not paired.
+func (a *IPPoolClaimProcessor) adoptPairedIPAddress(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, ip *ipamv1.IPAddress) (*ipamv1.IPAddress, error) {
+	if pairedName, ok := ip.Annotations[ipamcontrollerv1.PairedAddressAnnotation]; ok {
+		paired := &ipamv1.IPAddress{}
+		err := a.Get(ctx, types.NamespacedName{Namespace: ip.Namespace, Name: pairedName}, paired)
+		if err == nil {
+			if err := a.verifyOwnership(ipAddressClaim, paired); err != nil {
+				return nil, err
+			}
+			pairedPool := &ipamcontrollerv1.IPPool{}
+			if err := a.Get(ctx, types.NamespacedName{Namespace: paired.Namespace, Name: paired.Spec.PoolRef.Name}, pairedPool); err != nil {
+				return nil, err
+			}
+			log.Infof("Adopting paired IPAddress %v (%v) for claim %v", paired.Name, paired.Spec.Address, ipAddressClaim.Name)
+			if err := a.allocator.ClaimIPAddress(ctx, pairedPool, *paired); err != nil {
+				return nil, err
+			}
+			return paired, a.setOwner(ctx, ipAddressClaim, paired)
+		}
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	// The paired IPAddress was never created
+	paired, err := a.allocator.GetPairedIPAddress(ctx, ipAddressClaim)
+	if err != nil || paired == nil {
+		return nil, err
+	}
+	log.Infof("Got paired IPAddress %v", paired)
+	if err := controllerutil.SetControllerReference(ipAddressClaim, paired, a.Scheme()); err != nil {
+		a.releaseIPAddresses(ctx, paired)
+		return nil, err
+	}
+	if err := a.Client.Create(ctx, paired); err != nil {
+		log.Errorf("Unable to create paired IPAddress: %v", err)
+		a.releaseIPAddresses(ctx, paired)
+		return nil, err
+	}
+	if ip.Annotations[ipamcontrollerv1.PairedAddressAnnotation] != paired.Name {
+		if ip.Annotations == nil {
+			ip.Annotations = map[string]string{}
+		}
+		ip.Annotations[ipamcontrollerv1.PairedAddressAnnotation] = paired.Name
+		return paired, a.Update(ctx, ip)
 	}
+	return paired, nil
+}
 
-	log.Infof("IAC: %v", ipAddressClaim)
+// verifyOwnership checks that an IPAddress was created for the claim and not
+// for an earlier claim of the same name.
+func (a *IPPoolClaimProcessor) verifyOwnership(ipAddressClaim *ipamv1.IPAddressClaim, ip *ipamv1.IPAddress) error {
+	if ip.Spec.ClaimRef.Name != ipAddressClaim.Name {
+		return fmt.Errorf("IPAddress %v is bound to claim %v", ip.Name, ip.Spec.ClaimRef.Name)
+	}
+	if owner := metav1.GetControllerOf(ip); owner != nil && owner.UID != ipAddressClaim.UID {
+		return fmt.Errorf("IPAddress %v belongs to a previous claim %v", ip.Name, ipAddressClaim.Name)
+	}
 	return nil
 }
 
-func (a *IPPoolClaimProcessor) ReleaseClaim(ctx context.Context, namespacedName types.NamespacedName) error {
+// setOwner makes the claim the owner of an IPAddress created before owner
+// references were set.
+func (a *IPPoolClaimProcessor) setOwner(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, ip *ipamv1.IPAddress) error {
+	if metav1.GetControllerOf(ip) != nil {
+		return nil
+	}
+	if err := controllerutil.SetControllerReference(ipAddressClaim, ip, a.Scheme()); err != nil {
+		return err
+	}
+	return a.Update(ctx, ip)
+}
+
+// releaseIPAddresses hands the addresses of IPAddresses which were never
+// bound back to the allocator.
+func (a *IPPoolClaimProcessor) releaseIPAddresses(ctx context.Context, ips ...*ipamv1.IPAddress) {
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		if err := a.allocator.ReleaseIPConfiguration(ctx, ip); err != nil {
+			log.Errorf("Unable to release IPAddress %v: %v", ip.Spec.Address, err)
+		}
+	}
+}
+
+// ReleaseClaim releases the addresses bound to a claim and deletes their
+// IPAddresses.  IPAddresses which are already gone are skipped.
+func (a *IPPoolClaimProcessor) ReleaseClaim(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim) error {
 	log.Info("Received ReleaseClaim")
+	name := ipAddressClaim.Status.AddressRef.Name
+	if name == "" {
+		name = ipAddressClaim.Name
+	}
+	namespacedName := types.NamespacedName{Namespace: ipAddressClaim.Namespace, Name: name}
+
+	ipAddress := &ipamv1.IPAddress{}
+	if err := a.Get(ctx, namespacedName, ipAddress); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Infof("IPAddress %v is already gone", namespacedName)
+			return nil
+		}
+		return err
+	}
+
+	if pairedName, ok := ipAddress.Annotations[ipamcontrollerv1.PairedAddressAnnotation]; ok {
+		if err := a.releaseIPAddress(ctx, ipAddressClaim, types.NamespacedName{Namespace: namespacedName.Namespace, Name: pairedName}); err != nil {
+			return err
+		}
+	}
+	return a.releaseIPAddress(ctx, ipAddressClaim, namespacedName)
+}
+
+// releaseIPAddress removes the DNS records of an IPAddress, releases its
+// address and deletes it.  If the IPAddress's pool is already gone, there is
+// nothing left to release.
+func (a *IPPoolClaimProcessor) releaseIPAddress(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, namespacedName types.NamespacedName) error {
 	ipAddress := &ipamv1.IPAddress{}
 	if err := a.Get(ctx, namespacedName, ipAddress); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
 		return err
 	}
 	log.Infof("Got IPAddress %v (%v)", ipAddress.Name, ipAddress.Spec.Address)
-	if err := mgmt.ReleaseIPConfiguration(ctx, ipAddress); err != nil {
-		log.Warnf("Unable to release IP: %v", err)
+	if err := a.unregisterDNS(ctx, ipAddressClaim, ipAddress); err != nil {
+		log.Warnf("Unable to remove DNS records of IPAddress %v: %v", ipAddress.Name, err)
 		return err
 	}
+	if err := a.allocator.ReleaseIPConfiguration(ctx, ipAddress); err != nil {
+		switch {
+		case errors.Is(err, mgmt.ErrPoolNotInitialized):
+			log.Infof("Pool of IPAddress %v is gone, nothing to release", ipAddress.Name)
+		case errors.Is(err, mgmt.ErrAddressInUse):
+			log.Warnf("Not releasing %v of IPAddress %v: %v", ipAddress.Spec.Address, ipAddress.Name, err)
+		default:
+			log.Warnf("Unable to release IP: %v", err)
+			return err
+		}
+	} else {
+		metrics.Releases.WithLabelValues(ipAddress.Namespace, ipAddress.Spec.PoolRef.Name).Inc()
+	}
 	log.Infof("Deleting ipaddress CR %v", ipAddress.Name)
-	err := a.Delete(ctx, ipAddress)
-	return err
+	if err := a.Delete(ctx, ipAddress); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	a.held.forget(namespacedName)
+	a.recorder.Eventf(ipAddressClaim, corev1.EventTypeNormal, "AddressReleased", "Released %v to pool %v", ipAddress.Spec.Address, ipAddress.Spec.PoolRef.Name)
+	return nil
 }
 
 func (a *IPPoolClaimProcessor) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
-	mu.Lock()
-	defer mu.Unlock()
-
 	log.Infof("Received request %v", req)
 
 	ipAddressClaim := &ipamv1.IPAddressClaim{}
 	if err := a.Get(ctx, req.NamespacedName, ipAddressClaim); err != nil {
-		log.Warnf("Got error: %v", err)
-		if strings.Contains(fmt.Sprintf("%v%", err), "not found") {
-			log.Info("Handling remove of claim")
-			a.ReleaseClaim(ctx, req.NamespacedName)
+		if apierrors.IsNotFound(err) {
+			// Claims we bound carry a finalizer, so the addresses have
+			// already been released.
+			log.Infof("Claim %v is gone", req)
+			metrics.SetClaimPending(req.String(), "", "", false)
 			return reconcile.Result{}, nil
 		}
+		log.Warnf("Got error: %v", err)
 		return reconcile.Result{}, err
 	}
 	log.Infof("Got IPAddressClaim %v", ipAddressClaim.Name)
 
 	// Check claim to see if it needs IP from a pool that we own.
 	poolRef := ipAddressClaim.Spec.PoolRef
-	log.Debugf("Kind(%v) Group(%v) Name(%v)", poolRef.Kind, *poolRef.APIGroup, poolRef.Name)
-	if poolRef.Kind == ipamcontrollerv1.IPPoolKind && *poolRef.APIGroup == ipamcontrollerv1.APIGroupName {
-		log.Debugf("Found a claim for an IP from this provider.  Status: %v", ipAddressClaim.Status)
-		if ipAddressClaim.Status.AddressRef.Name == "" {
-			err := a.BindClaim(ctx, ipAddressClaim)
-			if err != nil {
-				return reconcile.Result{}, err
-			}
-		} else {
-			// Status was set.  Verify address still exists?
-			log.Info("Ignoring claim due to address already in status")
+	if !isIPPoolRef(poolRef) {
+		return reconcile.Result{}, nil
+	}
+	log.Debugf("Found a claim for an IP from this provider.  Status: %v", ipAddressClaim.Status)
+
+	// Claims waiting for an address are reported as pending, including
+	// while the allocator is loading
+	bound := ipAddressClaim.Status.AddressRef.Name != ""
+	metrics.SetClaimPending(req.String(), ipAddressClaim.Namespace, poolRef.Name, !bound && ipAddressClaim.DeletionTimestamp.IsZero())
+
+	if !a.startup.Synced() {
+		log.Infof("Allocator not loaded yet, requeueing claim %v", ipAddressClaim.Name)
+		return reconcile.Result{RequeueAfter: time.Second}, nil
+	}
+
+	defer locks.lock(a.claimPoolKeys(ctx, ipAddressClaim)...)()
+
+	if !ipAddressClaim.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(ipAddressClaim, ipamcontrollerv1.IPAddressClaimFinalizer) {
+			return reconcile.Result{}, nil
+		}
+		log.Info("Handling remove of claim")
+		if err := a.ReleaseClaim(ctx, ipAddressClaim); err != nil {
+			log.Errorf("Unable to release claim: %v", err)
+			return reconcile.Result{}, err
 		}
+		controllerutil.RemoveFinalizer(ipAddressClaim, ipamcontrollerv1.IPAddressClaimFinalizer)
+		return reconcile.Result{}, a.Update(ctx, ipAddressClaim)
 	}
 
+	if !controllerutil.ContainsFinalizer(ipAddressClaim, ipamcontrollerv1.IPAddressClaimFinalizer) {
+		controllerutil.AddFinalizer(ipAddressClaim, ipamcontrollerv1.IPAddressClaimFinalizer)
+		if err := a.Update(ctx, ipAddressClaim); err != nil {
+			log.Errorf("Unable to add finalizer to claim: %v", err)
+			return reconcile.Result{}, err
+		}
+	}
+
+	if !bound {
+		err := a.BindClaim(ctx, ipAddressClaim)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		metrics.SetClaimPending(req.String(), "", "", false)
+		// Updating the claim's status brings the claim back to register
+		// its addresses in DNS
+		return reconcile.Result{}, nil
+	}
+
+	// Claims bound by earlier versions have no Ready condition yet
+	if !claimConditionIsTrue(ipAddressClaim, ipamcontrollerv1.IPAddressClaimConditionReady) {
+		setClaimCondition(ipAddressClaim, clusterv1.Condition{
+			Type:   ipamcontrollerv1.IPAddressClaimConditionReady,
+			Status: corev1.ConditionTrue,
+		})
+		if err := a.Client.Status().Update(ctx, ipAddressClaim); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	if err := a.syncIPAddresses(ctx, ipAddressClaim); err != nil {
+		log.Errorf("Unable to sync IPAddresses of claim %v: %v", ipAddressClaim.Name, err)
+		return reconcile.Result{}, err
+	}
+	if err := a.registerDNS(ctx, ipAddressClaim); err != nil {
+		log.Errorf("Unable to register claim %v in DNS: %v", ipAddressClaim.Name, err)
+		return reconcile.Result{}, err
+	}
 	return reconcile.Result{}, nil
 }
 
+// claimIPAddresses returns the IPAddresses bound to a claim.
+func (a *IPPoolClaimProcessor) claimIPAddresses(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim) ([]*ipamv1.IPAddress, error) {
+	ip := &ipamv1.IPAddress{}
+	if err := a.Get(ctx, types.NamespacedName{Namespace: ipAddressClaim.Namespace, Name: ipAddressClaim.Status.AddressRef.Name}, ip); err != nil {
+		return nil, err
+	}
+	ips := []*ipamv1.IPAddress{ip}
+	if pairedName, ok := ip.Annotations[ipamcontrollerv1.PairedAddressAnnotation]; ok {
+		paired := &ipamv1.IPAddress{}
+		if err := a.Get(ctx, types.NamespacedName{Namespace: ip.Namespace, Name: pairedName}, paired); err != nil {
+			return nil, err
+		}
+		ips = append(ips, paired)
+	}
+	return ips, nil
+}
+
+// registerDNS registers the addresses bound to a claim against pools with
+// DNS settings, and records the outcome in the claim's DNSRecordsReady
+// condition.  Addresses are only registered once.
+func (a *IPPoolClaimProcessor) registerDNS(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim) error {
+	if claimConditionIsTrue(ipAddressClaim, ipamcontrollerv1.IPAddressClaimConditionDNSRecordsReady) {
+		return nil
+	}
+	ips, err := a.claimIPAddresses(ctx, ipAddressClaim)
+	if err != nil {
+		return err
+	}
+
+	registered := false
+	var dnsErr error
+	for _, ip := range ips {
+		pool := &ipamcontrollerv1.IPPool{}
+		if err := a.Get(ctx, types.NamespacedName{Namespace: ip.Namespace, Name: ip.Spec.PoolRef.Name}, pool); err != nil {
+			return err
+		}
+		if pool.Spec.DNS == nil {
+			continue
+		}
+		registered = true
+		if dnsErr = a.registerIPAddress(ctx, pool, ipAddressClaim, ip); dnsErr != nil {
+			break
+		}
+	}
+	if !registered {
+		return nil
+	}
+
+	condition := clusterv1.Condition{
+		Type:   ipamcontrollerv1.IPAddressClaimConditionDNSRecordsReady,
+		Status: corev1.ConditionTrue,
+	}
+	if dnsErr != nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Severity = clusterv1.ConditionSeverityWarning
+		condition.Reason = "UpdateFailed"
+		condition.Message = dnsErr.Error()
+	}
+	setClaimCondition(ipAddressClaim, condition)
+	if err := a.Status().Update(ctx, ipAddressClaim); err != nil {
+		return err
+	}
+	return dnsErr
+}
+
+// registerIPAddress registers the address of an IPAddress in DNS.  The name
+// of the records is recorded on the IPAddress first, so that they are removed
+// on release even if registering only partly succeeded.
+func (a *IPPoolClaimProcessor) registerIPAddress(ctx context.Context, pool *ipamcontrollerv1.IPPool, ipAddressClaim *ipamv1.IPAddressClaim, ip *ipamv1.IPAddress) error {
+	address, err := netip.ParseAddr(ip.Spec.Address)
+	if err != nil {
+		return err
+	}
+	hostname, err := ddns.Hostname(pool, ipAddressClaim, address)
+	if err != nil {
+		return err
+	}
+
+	if current, ok := ip.Annotations[ipamcontrollerv1.DNSNameAnnotation]; ok && current != hostname {
+		// The hostname template changed since the last attempt
+		if err := a.dns.Unregister(ctx, pool, current, address); err != nil {
+			return err
+		}
+	}
+	if ip.Annotations[ipamcontrollerv1.DNSNameAnnotation] != hostname {
+		if ip.Annotations == nil {
+			ip.Annotations = map[string]string{}
+		}
+		ip.Annotations[ipamcontrollerv1.DNSNameAnnotation] = hostname
+		if err := a.Update(ctx, ip); err != nil {
+			return err
+		}
+	}
+
+	if err := a.dns.Register(ctx, pool, hostname, address); err != nil {
+		return err
+	}
+	log.Infof("Registered %v as %v in DNS", address, hostname)
+	return nil
+}
+
+// unregisterDNS removes the DNS records of an IPAddress.  A failure is
+// recorded in the claim's DNSRecordsReady condition.
+func (a *IPPoolClaimProcessor) unregisterDNS(ctx context.Context, ipAddressClaim *ipamv1.IPAddressClaim, ip *ipamv1.IPAddress) error {
+	hostname, ok := ip.Annotations[ipamcontrollerv1.DNSNameAnnotation]
+	if !ok {
+		return nil
+	}
+	pool := &ipamcontrollerv1.IPPool{}
+	if err := a.Get(ctx, types.NamespacedName{Namespace: ip.Namespace, Name: ip.Spec.PoolRef.Name}, pool); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Warnf("Pool of IPAddress %v is gone, leaving DNS records of %v", ip.Name, hostname)
+			return nil
+		}
+		return err
+	}
+	if pool.Spec.DNS == nil {
+		log.Warnf("Pool %v has no DNS settings anymore, leaving DNS records of %v", pool.Name, hostname)
+		return nil
+	}
+	address, err := netip.ParseAddr(ip.Spec.Address)
+	if err != nil {
+		return err
+	}
+
+	if err := a.dns.Unregister(ctx, pool, hostname, address); err != nil {
+		setClaimCondition(ipAddressClaim, clusterv1.Condition{
+			Type:     ipamcontrollerv1.IPAddressClaimConditionDNSRecordsReady,
+			Status:   corev1.ConditionFalse,
+			Severity: clusterv1.ConditionSeverityWarning,
+			Reason:   "RemovalFailed",
+			Message:  err.Error(),
+		})
+		if err := a.Status().Update(ctx, ipAddressClaim); err != nil {
+			log.Errorf("Unable to update claim: %v", err)
+		}
+		return err
+	}
+	log.Infof("Removed DNS records of %v (%v)", hostname, address)
+	return nil
+}
+
+// claimPoolKeys returns the keys of the pools a claim allocates from, its
+// pool and the pool paired with it.
+func (a *IPPoolClaimProcessor) claimPoolKeys(ctx context.Context, claim *ipamv1.IPAddressClaim) []string {
+	keys := []string{fmt.Sprintf("%v/%v", claim.Namespace, claim.Spec.PoolRef.Name)}
+	pool := &ipamcontrollerv1.IPPool{}
+	if err := a.Get(ctx, types.NamespacedName{Namespace: claim.Namespace, Name: claim.Spec.PoolRef.Name}, pool); err == nil && pool.Spec.PairedPool != "" {
+		keys = append(keys, fmt.Sprintf("%v/%v", claim.Namespace, pool.Spec.PairedPool))
+	}
+	return keys
+}
+
 func (a *IPPoolClaimProcessor) InjectClient(c client.Client) error {
 	a.Client = c
 	log.Info("Set client for claim processor")
 	return nil
 }
 
-func (a *IPPoolController) LoadPool(ctx context.Context, pool *ipamcontrollerv1.IPPool) error {
+// ipAddressToPool maps an IPAddress to the IPPool it was allocated from so
+// that pool status follows allocations and releases.
+func ipAddressToPool(obj client.Object) []reconcile.Request {
+	ipAddress, ok := obj.(*ipamv1.IPAddress)
+	if !ok {
+		return nil
+	}
+	poolRef := ipAddress.Spec.PoolRef
+	if !isIPPoolRef(poolRef) {
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{
+			Namespace: ipAddress.Namespace,
+			Name:      poolRef.Name,
+		},
+	}}
+}
+
+// poolState is what the controller found while loading a pool.
+type poolState struct {
+	// addresses are the addresses of the IPAddresses allocated from the pool.
+	addresses []string
+
+	// conflicts are the reasons any address could not be claimed in the
+	// allocator.
+	conflicts []error
+
+	// stale are the IPAddresses whose gateway or prefix don't match the pool
+	// and could not be updated.
+	stale []string
+
+	// syncErr is the last error hit while updating IPAddresses.
+	syncErr error
+}
+
+// LoadPool initializes the pool and claims every IPAddress already allocated
+// from it.  IPAddresses are brought in line with the pool's gateway and
+// prefix, or marked stale when they can't be updated.
+func (a *IPPoolController) LoadPool(ctx context.Context, pool *ipamcontrollerv1.IPPool) (*poolState, error) {
+	state := &poolState{}
 	log.Infof("Loading pool: %v", pool.Name)
 
 	// Initialize pool
-	err := mgmt.InitializePool(ctx, pool)
+	rebuilt, err := a.allocator.InitializePool(ctx, pool)
+	if err != nil {
+		return state, err
+	}
+	if rebuilt {
+		a.held.forgetPool(pool.Namespace, pool.Name)
+	}
+
+	// Let's get all IPAddresses and see what has been already claimed to sync
+	// the pool.  A pool which was just built holds none of them, so they are
+	// read from the API server: an IPAddress missing from the cache would
+	// have its address handed out again.
+	var reader client.Reader = a.Client
+	if rebuilt {
+		reader = a.apiReader
+	}
+	options := client.ListOptions{
+		Namespace: pool.Namespace,
+	}
+	ipList := ipamv1.IPAddressList{}
+	if err := reader.List(ctx, &ipList, &options); err != nil {
+		return state, err
+	}
+
+	seen := map[string]string{}
+	var unique []ipamv1.IPAddress
+	for _, ip := range ipList.Items {
+		if ip.Spec.PoolRef.Name != pool.Name {
+			continue
+		}
+		log.Infof("Found IP: %v", ip.Spec.Address)
+		state.addresses = append(state.addresses, ip.Spec.Address)
+		if owner, ok := seen[ip.Spec.Address]; ok {
+			log.Warnf("IP %v is used by both %v and %v", ip.Spec.Address, owner, ip.Name)
+			conflict := fmt.Errorf("%v is used by both %v and %v", ip.Spec.Address, owner, ip.Name)
+			a.recorder.Event(pool, corev1.EventTypeWarning, "ResyncConflict", conflict.Error())
+			state.conflicts = append(state.conflicts, conflict)
+			continue
+		}
+		seen[ip.Spec.Address] = ip.Name
+		unique = append(unique, ip)
+	}
+
+	failures, err := a.allocator.ClaimIPAddresses(ctx, pool, unique)
+	if err != nil {
+		return state, err
+	}
+	for i := range unique {
+		ip := &unique[i]
+		if err, ok := failures[ip.Name]; ok {
+			log.Warnf("An error occurred when trying to claim IP %v: %v", ip.Spec.Address, err)
+			a.recorder.Eventf(pool, corev1.EventTypeWarning, "ResyncConflict", "Unable to claim %v of IPAddress %v: %v", ip.Spec.Address, ip.Name, err)
+			state.conflicts = append(state.conflicts, fmt.Errorf("%v: %w", ip.Name, err))
+			continue
+		}
+		stale, err := a.syncIPAddress(ctx, pool, ip)
+		if err != nil {
+			log.Warnf("Unable to sync IPAddress %v: %v", ip.Name, err)
+			state.syncErr = err
+			stale = true
+		}
+		if stale {
+			state.stale = append(state.stale, ip.Name)
+		}
+	}
+
+	// Pools adopted from persistent storage may hold addresses of
+	// IPAddresses deleted while the controller was down
+	released, err := a.allocator.ReleaseUnclaimedAddresses(ctx, pool, state.addresses)
+	if err != nil {
+		return state, err
+	}
+	if len(released) > 0 {
+		log.Infof("Released %v addresses no longer held by IPAddresses", len(released))
+		metrics.Releases.WithLabelValues(pool.Namespace, pool.Name).Add(float64(len(released)))
+	}
+	return state, nil
+}
+
+// syncIPAddress applies the pool's gateway and prefix to an IPAddress.  The
+// spec of an IPAddress may be immutable, in which case the IPAddress is
+// annotated as stale instead.  It returns whether the IPAddress is stale.
+func (a *IPPoolController) syncIPAddress(ctx context.Context, pool *ipamcontrollerv1.IPPool, ip *ipamv1.IPAddress) (bool, error) {
+	if ip.Spec.Gateway == pool.Spec.Gateway && ip.Spec.Prefix == pool.Spec.Prefix {
+		if _, ok := ip.Annotations[ipamcontrollerv1.StaleAddressAnnotation]; !ok {
+			return false, nil
+		}
+		delete(ip.Annotations, ipamcontrollerv1.StaleAddressAnnotation)
+		return false, a.Update(ctx, ip)
+	}
+
+	updated := ip.DeepCopy()
+	updated.Spec.Gateway = pool.Spec.Gateway
+	updated.Spec.Prefix = pool.Spec.Prefix
+	delete(updated.Annotations, ipamcontrollerv1.StaleAddressAnnotation)
+	err := a.Update(ctx, updated)
 	if err == nil {
-		// Let's get all IPAddresses and see what has been already claimed to sync
-		// the pool
-		options := client.ListOptions{
-			Namespace: pool.Namespace,
-		}
-		ipList := ipamv1.IPAddressList{}
-		err = a.List(ctx, &ipList, &options)
-		for _, ip := range ipList.Items {
-			if ip.Spec.PoolRef.Name == pool.Name {
-				log.Infof("Found IP: %v", ip.Spec.Address)
-				err = mgmt.ClaimIPAddress(ctx, pool, ip)
-				if err != nil {
-					log.Warnf("An error occurred when trying to claim IP %v: %v", ip.Spec.Address, err)
-				} else {
-					log.Debugf("IP %v is not part of pool %v", ip.Spec.Address, pool.Name)
-				}
+		log.Infof("Updated gateway and prefix of IPAddress %v", ip.Name)
+		return false, nil
+	}
+	if !apierrors.IsForbidden(err) && !apierrors.IsInvalid(err) {
+		return false, err
+	}
+
+	log.Warnf("Unable to update IPAddress %v, marking it stale: %v", ip.Name, err)
+	message := fmt.Sprintf("pool gateway is %q and prefix is %v", pool.Spec.Gateway, pool.Spec.Prefix)
+	if ip.Annotations[ipamcontrollerv1.StaleAddressAnnotation] == message {
+		return true, nil
+	}
+	if ip.Annotations == nil {
+		ip.Annotations = map[string]string{}
+	}
+	ip.Annotations[ipamcontrollerv1.StaleAddressAnnotation] = message
+	return true, a.Update(ctx, ip)
+}
+
+// updatePoolStatus records the allocator's view of the pool in the IPPool status.
+func (a *IPPoolController) updatePoolStatus(ctx context.Context, pool *ipamcontrollerv1.IPPool, state *poolState, loadErr error) error {
+	status := pool.Status.DeepCopy()
+	status.ObservedGeneration = pool.Generation
+	status.AllocatedAddresses = mgmt.SummarizeAddresses(state.addresses)
+
+	err := loadErr
+	var usage *mgmt.PoolUsage
+	if err == nil {
+		usage, err = a.allocator.GetPoolUsage(ctx, pool)
+	}
+	if err != nil {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               ipamcontrollerv1.IPPoolConditionReady,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: pool.Generation,
+			Reason:             "InitializationFailed",
+			Message:            err.Error(),
+		})
+	} else {
+		status.Total = usage.Total
+		status.Reserved = usage.Reserved
+		status.Allocated = usage.Allocated
+		status.Free = usage.Free()
+		metrics.SetPoolUsage(pool.Namespace, pool.Name, status.Total, status.Allocated, status.Free)
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               ipamcontrollerv1.IPPoolConditionReady,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: pool.Generation,
+			Reason:             "PoolLoaded",
+			Message:            "Pool is loaded in the allocator",
+		})
+		exhausted := metav1.Condition{
+			Type:               ipamcontrollerv1.IPPoolConditionExhausted,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: pool.Generation,
+			Reason:             "AddressesAvailable",
+			Message:            fmt.Sprintf("%v of %v addresses are free", status.Free, status.Total),
+		}
+		if status.Free == 0 {
+			exhausted.Status = metav1.ConditionTrue
+			exhausted.Reason = "NoAddressesAvailable"
+		}
+		meta.SetStatusCondition(&status.Conditions, exhausted)
+	}
+
+	degraded := metav1.Condition{
+		Type:               ipamcontrollerv1.IPPoolConditionDegraded,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: pool.Generation,
+		Reason:             "AsExpected",
+		Message:            "All IPAddresses are in sync with the allocator",
+	}
+	if len(state.conflicts) > 0 {
+		var messages []string
+		degraded.Status = metav1.ConditionTrue
+		degraded.Reason = "ResyncConflict"
+		for _, conflict := range state.conflicts {
+			switch {
+			case errors.Is(conflict, mgmt.ErrAddressExcluded):
+				degraded.Reason = "ExcludedAddressAllocated"
+			case errors.Is(conflict, mgmt.ErrAddressOutOfRange):
+				degraded.Reason = "AddressOutOfRange"
+			case errors.Is(conflict, mgmt.ErrAddressInUse):
+				degraded.Reason = "AddressInUse"
 			}
+			messages = append(messages, conflict.Error())
 		}
+		degraded.Message = strings.Join(messages, "; ")
 	}
-	return err
+	meta.SetStatusCondition(&status.Conditions, degraded)
+
+	upToDate := metav1.Condition{
+		Type:               ipamcontrollerv1.IPPoolConditionAddressesUpToDate,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: pool.Generation,
+		Reason:             "AsExpected",
+		Message:            "All IPAddresses match the pool's gateway and prefix",
+	}
+	if len(state.stale) > 0 {
+		upToDate.Status = metav1.ConditionFalse
+		upToDate.Reason = "AddressesStale"
+		upToDate.Message = fmt.Sprintf("IPAddresses could not be updated to the pool's gateway and prefix: %v", strings.Join(state.stale, ", "))
+	}
+	meta.SetStatusCondition(&status.Conditions, upToDate)
+
+	if equality.Semantic.DeepEqual(&pool.Status, status) {
+		return nil
+	}
+	pool.Status = *status
+	return a.Client.Status().Update(ctx, pool)
+}
+
+// poolAddresses returns the IPAddresses allocated from the pool.
+func (a *IPPoolController) poolAddresses(ctx context.Context, pool *ipamcontrollerv1.IPPool) ([]ipamv1.IPAddress, error) {
+	ipList := ipamv1.IPAddressList{}
+	if err := a.List(ctx, &ipList, client.InNamespace(pool.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var addresses []ipamv1.IPAddress
+	for _, ip := range ipList.Items {
+		if ip.Spec.PoolRef.Name == pool.Name {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses, nil
+}
+
+// setDeletingCondition records the progress of a pool's deletion in its status.
+func (a *IPPoolController) setDeletingCondition(ctx context.Context, pool *ipamcontrollerv1.IPPool, reason, message string) error {
+	status := pool.Status.DeepCopy()
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               ipamcontrollerv1.IPPoolConditionDeleting,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: pool.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	if equality.Semantic.DeepEqual(&pool.Status, status) {
+		return nil
+	}
+	pool.Status = *status
+	return a.Client.Status().Update(ctx, pool)
 }
 
-func (a *IPPoolController) RemovePool(ctx context.Context, pool string) error {
-	log.Infof("Removing pool %v", pool)
-	ipAddresses := &ipamv1.IPAddressList{}
-	err := a.Client.List(ctx, ipAddresses)
+// RemovePool handles the deletion of a pool.  Deletion is blocked while
+// addresses are allocated from the pool, unless the force delete annotation is
+// set.  The pool's IPAddresses are released and deleted first, then the pool
+// is removed from the allocator and finally the finalizer is dropped.
+func (a *IPPoolController) RemovePool(ctx context.Context, pool *ipamcontrollerv1.IPPool) error {
+	log.Infof("Removing pool %v", pool.Name)
+	ipAddresses, err := a.poolAddresses(ctx, pool)
 	if err != nil {
 		log.Warnf("Unable to get IPAddresses: %v", err)
 		return err
 	}
 
-	log.Info("Searching for linked IPAddresses...")
-	for _, ip := range ipAddresses.Items {
-		log.Debugf("Checking IPAddress: %v", ip.Name)
-		if fmt.Sprintf("%v/%v", ip.Namespace, ip.Spec.PoolRef.Name) == pool {
+	if len(ipAddresses) > 0 && pool.Annotations[ipamcontrollerv1.ForceDeleteAnnotation] != "true" {
+		// Keep serving releases until the pool is empty
+		if _, err := a.LoadPool(ctx, pool); err != nil {
+			log.Warnf("Unable to load pool: %v", err)
+		}
+
+		var names []string
+		for _, ip := range ipAddresses {
+			names = append(names, ip.Name)
+		}
+		log.Infof("Pool %v still has %v allocated addresses, blocking deletion", pool.Name, len(names))
+		return a.setDeletingCondition(ctx, pool, "AddressesAllocated",
+			fmt.Sprintf("Deletion is blocked until these IPAddresses are released, or the %v annotation is set to \"true\": %v",
+				ipamcontrollerv1.ForceDeleteAnnotation, strings.Join(names, ", ")))
+	}
+
+	if len(ipAddresses) > 0 {
+		if err := a.setDeletingCondition(ctx, pool, "ReleasingAddresses",
+			fmt.Sprintf("Releasing %v IPAddresses", len(ipAddresses))); err != nil {
+			return err
+		}
+		for i := range ipAddresses {
+			ip := &ipAddresses[i]
 			log.Infof("Deleting ipaddress CR %v", ip.Name)
-			mgmt.ReleaseIPConfiguration(ctx, &ip)
-			err = a.Delete(ctx, &ip)
-			if err != nil {
+			if err := a.allocator.ReleaseIPConfiguration(ctx, ip); err == nil {
+				metrics.Releases.WithLabelValues(ip.Namespace, pool.Name).Inc()
+			} else if !errors.Is(err, mgmt.ErrPoolNotInitialized) {
+				log.Warnf("Unable to release IP %v: %v", ip.Spec.Address, err)
+			}
+			if err := a.Delete(ctx, ip); err != nil && !apierrors.IsNotFound(err) {
 				log.Warnf("Error occurred while cleaning up IP: %v", err)
+				return err
 			}
 		}
+		a.recorder.Eventf(pool, corev1.EventTypeNormal, "AddressesReleased", "Released %v IPAddresses of the pool being force deleted", len(ipAddresses))
 	}
 
+	if err := a.setDeletingCondition(ctx, pool, "RemovingFromAllocator", "Removing the pool from the allocator"); err != nil {
+		return err
+	}
 	log.Info("Removing pool from mgmt...")
-	err = mgmt.RemovePool(ctx, pool)
-	if err != nil {
+	if err := a.allocator.RemovePool(ctx, fmt.Sprintf("%v/%v", pool.Namespace, pool.Name)); err != nil {
 		log.Warnf("Error removing pool from mgmt: %v", err)
+		return err
 	}
-	return err
+	a.held.forgetPool(pool.Namespace, pool.Name)
+	metrics.DeletePool(pool.Namespace, pool.Name)
+
+	controllerutil.RemoveFinalizer(pool, ipamcontrollerv1.IPPoolFinalizer)
+	return a.Update(ctx, pool)
 }
 
 func (a *IPPoolController) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
-	mu.Lock()
-	defer mu.Unlock()
+	defer locks.lock(req.String())()
 
 	log.Infof("Received request %v", req)
 
 	pool := &ipamcontrollerv1.IPPool{}
 	if err := a.Get(ctx, req.NamespacedName, pool); err != nil {
+		if apierrors.IsNotFound(err) {
+			// The finalizer was removed by someone else, so drop whatever
+			// is left of the pool in the allocator.
+			log.Infof("Pool %v is gone", req)
+			if err := a.allocator.RemovePool(ctx, req.String()); err != nil {
+				log.Warnf("Error removing pool from mgmt: %v", err)
+			}
+			a.held.forgetPool(req.Namespace, req.Name)
+			metrics.DeletePool(req.Namespace, req.Name)
+			return reconcile.Result{}, nil
+		}
 		log.Warnf("Got error: %v", err)
-		switch t := err.(type) {
-		default:
-			log.Infof("Type: %v", t)
+		return reconcile.Result{}, err
+	}
+	log.Infof("Got Pool %v", pool.Name)
 
-		}
-		if strings.Contains(fmt.Sprintf("%v", err), "not found") {
-			log.Info("Handling remove of claim")
-			a.RemovePool(ctx, fmt.Sprintf("%v", req))
+	if !pool.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(pool, ipamcontrollerv1.IPPoolFinalizer) {
 			return reconcile.Result{}, nil
-		} else {
+		}
+		return reconcile.Result{}, a.RemovePool(ctx, pool)
+	}
+
+	if !controllerutil.ContainsFinalizer(pool, ipamcontrollerv1.IPPoolFinalizer) {
+		controllerutil.AddFinalizer(pool, ipamcontrollerv1.IPPoolFinalizer)
+		if err := a.Update(ctx, pool); err != nil {
+			log.Errorf("Unable to add finalizer to pool: %v", err)
 			return reconcile.Result{}, err
 		}
 	}
-	log.Infof("Got Pool %v", pool.Name)
-	if err := a.LoadPool(ctx, pool); err != nil {
-		log.Errorf("Unable to load pool: %v", err)
+
+	state, loadErr := a.LoadPool(ctx, pool)
+	if loadErr != nil {
+		log.Errorf("Unable to load pool: %v", loadErr)
+		a.recorder.Eventf(pool, corev1.EventTypeWarning, "InvalidPool", "Unable to load the pool into the allocator: %v", loadErr)
+	}
+	if err := a.updatePoolStatus(ctx, pool, state, loadErr); err != nil {
+		log.Errorf("Unable to update pool status: %v", err)
 		return reconcile.Result{}, err
 	}
+	if loadErr != nil {
+		return reconcile.Result{}, loadErr
+	}
 
-	return reconcile.Result{}, nil
+	if err := a.exportDHCP(ctx, pool); err != nil {
+		log.Errorf("Unable to export DHCP reservations of pool %v: %v", pool.Name, err)
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, state.syncErr
+}
+
+// exportDHCP writes the pool's allocations as DHCP reservations to the
+// ConfigMap of its DHCP export settings.  The ConfigMap belongs to the pool.
+func (a *IPPoolController) exportDHCP(ctx context.Context, pool *ipamcontrollerv1.IPPool) error {
+	if pool.Spec.DHCPExport == nil {
+		return nil
+	}
+	ipAddresses, err := a.poolAddresses(ctx, pool)
+	if err != nil {
+		return err
+	}
+
+	var reservations []dhcp.Reservation
+	for _, ip := range ipAddresses {
+		address, err := netip.ParseAddr(ip.Spec.Address)
+		if err != nil {
+			log.Warnf("Skipping DHCP reservation of IPAddress %v: %v", ip.Name, err)
+			continue
+		}
+		reservation := dhcp.Reservation{
+			Address: address,
+		}
+
+		hostname := ip.Spec.ClaimRef.Name
+		ipAddressClaim := &ipamv1.IPAddressClaim{}
+		if err := a.Get(ctx, types.NamespacedName{Namespace: ip.Namespace, Name: ip.Spec.ClaimRef.Name}, ipAddressClaim); err == nil {
+			if machine := mgmt.ClaimMachine(ipAddressClaim); machine != "" {
+				hostname = machine
+			}
+			if mac, ok := ipAddressClaim.Annotations[ipamcontrollerv1.MACAddressAnnotation]; ok {
+				if reservation.MACAddress, err = net.ParseMAC(mac); err != nil {
+					log.Warnf("Ignoring MAC address of claim %v: %v", ipAddressClaim.Name, err)
+				}
+			}
+		} else if !apierrors.IsNotFound(err) {
+			return err
+		}
+		if dnsName, ok := ip.Annotations[ipamcontrollerv1.DNSNameAnnotation]; ok {
+			hostname = dnsName
+		}
+		reservation.Hostname = dhcp.Hostname(hostname)
+		reservations = append(reservations, reservation)
+	}
+
+	kea, err := dhcp.Kea(reservations)
+	if err != nil {
+		return err
+	}
+	data := map[string]string{
+		dhcp.KeaKey:     string(kea),
+		dhcp.DnsmasqKey: string(dhcp.Dnsmasq(reservations)),
+	}
+
+	name := pool.Spec.DHCPExport.ConfigMap
+	if name == "" {
+		name = pool.Name + "-dhcp"
+	}
+	configMap := &corev1.ConfigMap{}
+	err = a.apiReader.Get(ctx, types.NamespacedName{Namespace: pool.Namespace, Name: name}, configMap)
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: pool.Namespace, Name: name},
+			Data:       data,
+		}
+		if err := controllerutil.SetControllerReference(pool, configMap, a.Scheme()); err != nil {
+			return err
+		}
+		log.Infof("Exporting %v DHCP reservations of pool %v to ConfigMap %v", len(reservations), pool.Name, name)
+		return a.Create(ctx, configMap)
+	}
+	if err != nil {
+		return err
+	}
+	if owner := metav1.GetControllerOf(configMap); owner == nil || owner.UID != pool.UID {
+		return fmt.Errorf("ConfigMap %v does not belong to pool %v", name, pool.Name)
+	}
+	if equality.Semantic.DeepEqual(configMap.Data, data) {
+		return nil
+	}
+	configMap.Data = data
+	log.Infof("Exporting %v DHCP reservations of pool %v to ConfigMap %v", len(reservations), pool.Name, name)
+	return a.Update(ctx, configMap)
 }
 
 func (a *IPPoolController) InjectClient(c client.Client) error {
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+// claimPoolIndex indexes IPAddressClaims by the name of the IPPool they
+// claim from.
+const claimPoolIndex = "spec.poolRef.name"
+
+// isIPPoolRef reports whether a reference points at an IPPool of this
+// provider.
+func isIPPoolRef(poolRef corev1.TypedLocalObjectReference) bool {
+	return poolRef.Kind == ipamcontrollerv1.IPPoolKind && poolRef.APIGroup != nil && *poolRef.APIGroup == ipamcontrollerv1.APIGroupName
+}
+
+// indexClaimPool returns the IPPool a claim claims from, if it is one of
+// ours.
+func indexClaimPool(obj client.Object) []string {
+	ipAddressClaim, ok := obj.(*ipamv1.IPAddressClaim)
+	if !ok || !isIPPoolRef(ipAddressClaim.Spec.PoolRef) {
+		return nil
+	}
+	return []string{ipAddressClaim.Spec.PoolRef.Name}
+}
+
+// poolMayBindClaims passes the pool events which may let waiting claims bind:
+// new pools, spec changes, pools becoming ready and pools gaining free
+// addresses.
+var poolMayBindClaims = predicate.Funcs{
+	CreateFunc: func(event.CreateEvent) bool { return true },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldPool, ok := e.ObjectOld.(*ipamcontrollerv1.IPPool)
+		if !ok {
+			return true
+		}
+		newPool, ok := e.ObjectNew.(*ipamcontrollerv1.IPPool)
+		if !ok {
+			return true
+		}
+		becameReady := !meta.IsStatusConditionTrue(oldPool.Status.Conditions, ipamcontrollerv1.IPPoolConditionReady) &&
+			meta.IsStatusConditionTrue(newPool.Status.Conditions, ipamcontrollerv1.IPPoolConditionReady)
+		return oldPool.Generation != newPool.Generation || becameReady || newPool.Status.Free > oldPool.Status.Free
+	},
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// ipAddressReleased passes the deletion of IPAddresses, which frees their
+// address.
+var ipAddressReleased = predicate.Funcs{
+	CreateFunc:  func(event.CreateEvent) bool { return false },
+	UpdateFunc:  func(event.UpdateEvent) bool { return false },
+	DeleteFunc:  func(event.DeleteEvent) bool { return true },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// poolToPendingClaims maps an IPPool to the claims waiting for an address
+// from it.
+func (a *IPPoolClaimProcessor) poolToPendingClaims(obj client.Object) []reconcile.Request {
+	pool, ok := obj.(*ipamcontrollerv1.IPPool)
+	if !ok {
+		return nil
+	}
+	return a.pendingClaims(context.Background(), pool.Namespace, pool.Name)
+}
+
+// ipAddressToPendingClaims maps a released IPAddress to the claims waiting
+// for an address from its pool.
+func (a *IPPoolClaimProcessor) ipAddressToPendingClaims(obj client.Object) []reconcile.Request {
+	ipAddress, ok := obj.(*ipamv1.IPAddress)
+	if !ok || !isIPPoolRef(ipAddress.Spec.PoolRef) {
+		return nil
+	}
+	return a.pendingClaims(context.Background(), ipAddress.Namespace, ipAddress.Spec.PoolRef.Name)
+}
+
+// pendingClaims returns the claims waiting for an address from the pool, or
+// from a pool paired with it, oldest first so that claims are bound in the
+// order they were made.
+func (a *IPPoolClaimProcessor) pendingClaims(ctx context.Context, namespace, poolName string) []reconcile.Request {
+	poolNames := []string{poolName}
+	pools := &ipamcontrollerv1.IPPoolList{}
+	if err := a.List(ctx, pools, client.InNamespace(namespace)); err != nil {
+		log.Warnf("Unable to list pools paired with %v/%v: %v", namespace, poolName, err)
+	}
+	for _, pool := range pools.Items {
+		if pool.Spec.PairedPool == poolName && pool.Name != poolName {
+			poolNames = append(poolNames, pool.Name)
+		}
+	}
+
+	pending := []ipamv1.IPAddressClaim{}
+	for _, name := range poolNames {
+		claims := &ipamv1.IPAddressClaimList{}
+		if err := a.List(ctx, claims, client.InNamespace(namespace), client.MatchingFields{claimPoolIndex: name}); err != nil {
+			log.Warnf("Unable to list claims of pool %v/%v: %v", namespace, name, err)
+			continue
+		}
+		for _, ipAddressClaim := range claims.Items {
+			if ipAddressClaim.Status.AddressRef.Name == "" && ipAddressClaim.DeletionTimestamp.IsZero() {
+				pending = append(pending, ipAddressClaim)
+			}
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		created, otherCreated := pending[i].CreationTimestamp, pending[j].CreationTimestamp
+		if !created.Equal(&otherCreated) {
+			return created.Before(&otherCreated)
+		}
+		return pending[i].Name < pending[j].Name
+	})
+
+	requests := make([]reconcile.Request, 0, len(pending))
+	for _, ipAddressClaim := range pending {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: ipAddressClaim.Namespace, Name: ipAddressClaim.Name},
+		})
+	}
+	if len(requests) > 0 {
+		log.Debugf("Requeueing %d pending claims of pool %v/%v", len(requests), namespace, poolName)
+	}
+	return requests
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, ipamv1.AddToScheme, ipamcontrollerv1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scheme
+}
+
+// testClaim returns a claim made at created from the pool.
+func testClaim(namespace, name, poolName string, created time.Time) *ipamv1.IPAddressClaim {
+	apiGroup := ipamcontrollerv1.APIGroupName
+	return &ipamv1.IPAddressClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, CreationTimestamp: metav1.NewTime(created)},
+		Spec: ipamv1.IPAddressClaimSpec{
+			PoolRef: corev1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: ipamcontrollerv1.IPPoolKind, Name: poolName},
+		},
+	}
+}
+
+func TestPoolMayBindClaims(t *testing.T) {
+	ready := metav1.Condition{Type: ipamcontrollerv1.IPPoolConditionReady, Status: metav1.ConditionTrue}
+	notReady := metav1.Condition{Type: ipamcontrollerv1.IPPoolConditionReady, Status: metav1.ConditionFalse}
+	pool := func(generation, free int64, conditions ...metav1.Condition) *ipamcontrollerv1.IPPool {
+		return &ipamcontrollerv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool", Generation: generation},
+			Status:     ipamcontrollerv1.IPPoolStatus{Free: free, Conditions: conditions},
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		old, new client.Object
+		want     bool
+	}{
+		{name: "unchanged", old: pool(1, 5, ready), new: pool(1, 5, ready), want: false},
+		{name: "spec changed", old: pool(1, 5, ready), new: pool(2, 5, ready), want: true},
+		{name: "addresses freed", old: pool(1, 0, ready), new: pool(1, 1, ready), want: true},
+		{name: "addresses allocated", old: pool(1, 5, ready), new: pool(1, 4, ready), want: false},
+		{name: "became ready", old: pool(1, 5, notReady), new: pool(1, 5, ready), want: true},
+		{name: "first condition", old: pool(1, 5), new: pool(1, 5, ready), want: true},
+		{name: "became unready", old: pool(1, 5, ready), new: pool(1, 5, notReady), want: false},
+		{name: "not a pool", old: &ipamv1.IPAddress{}, new: &ipamv1.IPAddress{}, want: true},
+	} {
+		if got := poolMayBindClaims.Update(event.UpdateEvent{ObjectOld: tc.old, ObjectNew: tc.new}); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if !poolMayBindClaims.Create(event.CreateEvent{Object: pool(1, 5)}) {
+		t.Errorf("expected a new pool to requeue pending claims")
+	}
+	if poolMayBindClaims.Delete(event.DeleteEvent{Object: pool(1, 5)}) || poolMayBindClaims.Generic(event.GenericEvent{Object: pool(1, 5)}) {
+		t.Errorf("expected deleted pools and generic events to be filtered")
+	}
+}
+
+func TestIPAddressReleased(t *testing.T) {
+	ip := &ipamv1.IPAddress{}
+	if !ipAddressReleased.Delete(event.DeleteEvent{Object: ip}) {
+		t.Errorf("expected a deleted IPAddress to requeue pending claims")
+	}
+	if ipAddressReleased.Create(event.CreateEvent{Object: ip}) ||
+		ipAddressReleased.Update(event.UpdateEvent{ObjectOld: ip, ObjectNew: ip}) ||
+		ipAddressReleased.Generic(event.GenericEvent{Object: ip}) {
+		t.Errorf("expected only deleted IPAddresses to pass")
+	}
+}
+
+func TestPendingClaims(t *testing.T) {
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	pools := []client.Object{
+		&ipamcontrollerv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "v4"},
+			Spec:       ipamcontrollerv1.IPPoolSpec{AddressCidr: "192.168.1.0/24", Prefix: 24, PairedPool: "v6"},
+		},
+		&ipamcontrollerv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "v6"},
+			Spec:       ipamcontrollerv1.IPPoolSpec{AddressCidr: "fd00::/120", Prefix: 64},
+		},
+	}
+
+	bound := testClaim("ns", "bound", "v6", created)
+	bound.Status.AddressRef.Name = "bound"
+	deleting := testClaim("ns", "deleting", "v6", created)
+	deleting.Finalizers = []string{ipamcontrollerv1.IPAddressClaimFinalizer}
+	deleting.DeletionTimestamp = &metav1.Time{Time: created}
+	foreign := testClaim("ns", "foreign", "v6", created)
+	foreign.Spec.PoolRef.Kind = "InClusterIPPool"
+
+	objects := append(pools,
+		testClaim("ns", "newest", "v6", created.Add(2*time.Minute)),
+		testClaim("ns", "oldest", "v6", created),
+		// Claims made at the same time are ordered by name.
+		testClaim("ns", "same-b", "v6", created.Add(time.Minute)),
+		testClaim("ns", "same-a", "v4", created.Add(time.Minute)),
+		testClaim("ns", "other-pool", "other", created),
+		testClaim("other", "other-namespace", "v6", created),
+		bound, deleting, foreign,
+	)
+	processor := &IPPoolClaimProcessor{
+		Client: fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(objects...).
+			WithIndex(&ipamv1.IPAddressClaim{}, claimPoolIndex, indexClaimPool).Build(),
+	}
+
+	// Claims of the pool paired with v6 wait for it as well.
+	var got []string
+	for _, req := range processor.pendingClaims(context.Background(), "ns", "v6") {
+		got = append(got, req.Name)
+	}
+	want := []string{"oldest", "same-a", "same-b", "newest"}
+	if len(got) != len(want) {
+		t.Fatalf("got pending claims %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got pending claims %v, want %v", got, want)
+		}
+	}
+
+	// The v4 pool isn't paired with v6, so only its own claim is pending.
+	if requests := processor.pendingClaims(context.Background(), "ns", "v4"); len(requests) != 1 || requests[0].Name != "same-a" {
+		t.Errorf("got pending claims %v of v4, want same-a", requests)
+	}
+
+	ip := &ipamv1.IPAddress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "released"},
+		Spec:       ipamv1.IPAddressSpec{PoolRef: foreign.Spec.PoolRef},
+	}
+	if requests := processor.ipAddressToPendingClaims(ip); len(requests) != 0 {
+		t.Errorf("got %v for an IPAddress of another provider, want none", requests)
+	}
+	ip.Spec.PoolRef = bound.Spec.PoolRef
+	if requests := processor.ipAddressToPendingClaims(ip); len(requests) != len(want) {
+		t.Errorf("got %v for a released IPAddress of v6, want %v", requests, want)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// poolLocks serializes the work on each pool, so that the allocator never
+// sees two operations on the same pool at once, while pools are worked on in
+// parallel.  A pool's lock is dropped once nobody holds or waits for it, so
+// deleted pools don't leave their locks behind.
+type poolLocks struct {
+	mu    sync.Mutex
+	locks map[string]*poolLock
+}
+
+// poolLock is the lock of a single pool.
+type poolLock struct {
+	sync.Mutex
+
+	// refs counts the callers holding or waiting for the lock, guarded by
+	// poolLocks.mu.
+	refs int
+}
+
+func newPoolLocks() *poolLocks {
+	return &poolLocks{
+		locks: map[string]*poolLock{},
+	}
+}
+
+// lock locks the pools with the given keys and returns a function unlocking
+// them.  The pools are locked in a fixed order, so that callers locking the
+// same pools can't deadlock.
+func (l *poolLocks) lock(keys ...string) func() {
+	sorted := make([]string, 0, len(keys))
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		l.acquire(key).Lock()
+	}
+	return func() {
+		for i := len(sorted) - 1; i >= 0; i-- {
+			l.release(sorted[i])
+		}
+	}
+}
+
+// acquire returns the lock of a pool, creating it if needed, and records the
+// caller as one of its users.
+func (l *poolLocks) acquire(key string) *poolLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m, ok := l.locks[key]
+	if !ok {
+		m = &poolLock{}
+		l.locks[key] = m
+	}
+	m.refs++
+	return m
+}
+
+// release unlocks the lock of a pool and drops it when it has no users left.
+func (l *poolLocks) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m := l.locks[key]
+	m.Unlock()
+	m.refs--
+	if m.refs == 0 {
+		delete(l.locks, key)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	goipam "github.com/metal-stack/go-ipam"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+)
+
+func TestPoolLocksSerialize(t *testing.T) {
+	l := newPoolLocks()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	holders := map[string]int{}
+	for i := 0; i < 200; i++ {
+		keys := []string{"ns/a", "ns/b"}
+		if i%2 == 0 {
+			keys = []string{"ns/b", "ns/a"}
+		}
+		if i%3 == 0 {
+			keys = keys[:1]
+		}
+		wg.Add(1)
+		go func(keys []string) {
+			defer wg.Done()
+			unlock := l.lock(keys...)
+			defer unlock()
+
+			mu.Lock()
+			for _, key := range keys {
+				holders[key]++
+				if holders[key] > 1 {
+					t.Errorf("pool %v is locked twice", key)
+				}
+			}
+			mu.Unlock()
+			time.Sleep(time.Microsecond)
+			mu.Lock()
+			for _, key := range keys {
+				holders[key]--
+			}
+			mu.Unlock()
+		}(keys)
+	}
+	wg.Wait()
+
+	if len(l.locks) != 0 {
+		t.Errorf("got %v locks left behind, want none", len(l.locks))
+	}
+}
+
+// TestBindClaimsConcurrently binds many claims against a shared dual-stack
+// pool at once and checks that no address is handed out twice.
+func TestBindClaimsConcurrently(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, ipamv1.AddToScheme, ipamcontrollerv1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pools := []*ipamcontrollerv1.IPPool{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "v4"},
+			Spec:       ipamcontrollerv1.IPPoolSpec{AddressCidr: "192.168.1.0/27", Prefix: 24, PairedPool: "v6"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "v6"},
+			Spec:       ipamcontrollerv1.IPPoolSpec{AddressCidr: "fd00::/120", Prefix: 64},
+		},
+	}
+	allocator := mgmt.NewDispatcher(mgmt.NewGoIPAMAllocator(goipam.NewMemory()), nil)
+	objects := []client.Object{}
+	for _, pool := range pools {
+		if _, err := allocator.InitializePool(ctx, pool); err != nil {
+			t.Fatalf("unable to initialize pool %v: %v", pool.Name, err)
+		}
+		objects = append(objects, pool)
+	}
+
+	// The IPv4 pool has 30 addresses to hand out, ten claims go without.
+	const claims = 40
+	apiGroup := ipamcontrollerv1.APIGroupName
+	for i := 0; i < claims; i++ {
+		objects = append(objects, &ipamv1.IPAddressClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: fmt.Sprintf("claim-%d", i)},
+			Spec: ipamv1.IPAddressClaimSpec{
+				PoolRef: corev1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: ipamcontrollerv1.IPPoolKind, Name: "v4"},
+			},
+		})
+	}
+
+	startup := &startupSync{done: make(chan struct{})}
+	close(startup.done)
+	processor := &IPPoolClaimProcessor{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).
+			WithIndex(&ipamv1.IPAddress{}, ipAddressPoolIndex, indexIPAddressPool).Build(),
+		startup:   startup,
+		allocator: allocator,
+		held:      newHeldAddresses(),
+		recorder:  record.NewFakeRecorder(10 * claims),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < claims; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: name}}
+			_, _ = processor.Reconcile(ctx, req)
+		}(fmt.Sprintf("claim-%d", i))
+	}
+	wg.Wait()
+
+	addresses := &ipamv1.IPAddressList{}
+	if err := processor.List(ctx, addresses, client.InNamespace("ns")); err != nil {
+		t.Fatalf("unable to list IPAddresses: %v", err)
+	}
+	owners := map[string]string{}
+	perPool := map[string]int{}
+	for _, ip := range addresses.Items {
+		if _, err := netip.ParseAddr(ip.Spec.Address); err != nil {
+			t.Errorf("IPAddress %v has an invalid address %q", ip.Name, ip.Spec.Address)
+		}
+		if owner, ok := owners[ip.Spec.Address]; ok {
+			t.Errorf("%v is held by both %v and %v", ip.Spec.Address, owner, ip.Name)
+		}
+		owners[ip.Spec.Address] = ip.Name
+		perPool[ip.Spec.PoolRef.Name]++
+	}
+	if perPool["v4"] != 30 || perPool["v6"] != 30 {
+		t.Errorf("got %v IPAddresses per pool, want 30 from each", perPool)
+	}
+
+	bound := 0
+	for i := 0; i < claims; i++ {
+		claim := &ipamv1.IPAddressClaim{}
+		if err := processor.Get(ctx, types.NamespacedName{Namespace: "ns", Name: fmt.Sprintf("claim-%d", i)}, claim); err != nil {
+			t.Fatalf("unable to get claim: %v", err)
+		}
+		if claim.Status.AddressRef.Name != "" {
+			bound++
+		}
+	}
+	if bound != 30 {
+		t.Errorf("got %v bound claims, want 30", bound)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("got %v pool locks left behind, want none", len(locks.locks))
+	}
+
+	usage, err := allocator.GetPoolUsage(ctx, pools[0])
+	if err != nil {
+		t.Fatalf("unable to get usage: %v", err)
+	}
+	if usage.Allocated != 30 || usage.Free() != 0 {
+		t.Errorf("got usage %+v, want 30 allocated and none free", usage)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/metrics"
+)
+
+// startupSync loads every IPPool and the IPAddresses allocated from them into
+// the allocator once the replica becomes the leader.  Claims are not bound
+// until it has finished, so that no address in use can be handed out again.
+type startupSync struct {
+	cache cache.Cache
+	pools *IPPoolController
+	done  chan struct{}
+
+	// lease is the leader election lease, nil when leader election is
+	// disabled.  Loading the allocator is recorded as an event on it.
+	lease    *coordinationv1.Lease
+	recorder record.EventRecorder
+
+	// elected is closed when the replica becomes the leader.
+	elected <-chan struct{}
+}
+
+func newStartupSync(mgr manager.Manager, pools *IPPoolController, lease *coordinationv1.Lease) *startupSync {
+	return &startupSync{
+		cache:    mgr.GetCache(),
+		pools:    pools,
+		done:     make(chan struct{}),
+		lease:    lease,
+		recorder: mgr.GetEventRecorderFor("machine-ipam-controller"),
+		elected:  mgr.Elected(),
+	}
+}
+
+// Start implements manager.Runnable.
+func (s *startupSync) Start(ctx context.Context) error {
+	start := time.Now()
+	if s.lease != nil {
+		log.Infof("Became the leader, loading the allocator")
+		metrics.LeaderElections.Inc()
+	}
+	if !s.cache.WaitForCacheSync(ctx) {
+		return errors.New("unable to sync cache")
+	}
+
+	pools := &ipamcontrollerv1.IPPoolList{}
+	if err := s.pools.List(ctx, pools); err != nil {
+		return err
+	}
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		// A pool which can't be loaded doesn't hand out addresses, so it
+		// doesn't need to hold up the others.
+		unlock := locks.lock(fmt.Sprintf("%v/%v", pool.Namespace, pool.Name))
+		if _, err := s.pools.LoadPool(ctx, pool); err != nil {
+			log.Warnf("Unable to load pool %v at startup: %v", pool.Name, err)
+		}
+		unlock()
+	}
+
+	log.Infof("Loaded %v pools, binding claims", len(pools.Items))
+	metrics.StartupSyncSeconds.Set(time.Since(start).Seconds())
+	if s.lease != nil {
+		s.recorder.Eventf(s.lease, corev1.EventTypeNormal, "AllocatorLoaded",
+			"Leader loaded %v pools into the allocator in %v", len(pools.Items), time.Since(start).Round(time.Millisecond))
+	}
+	close(s.done)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.  The
+// allocator is only loaded by the leader, after it was elected, so that it
+// reflects every allocation made by the previous leader.
+func (s *startupSync) NeedLeaderElection() bool {
+	return true
+}
+
+func (s *startupSync) isLeader() bool {
+	select {
+	case <-s.elected:
+		return true
+	default:
+		return false
+	}
+}
+
+// Synced reports whether the startup sync has finished.
+func (s *startupSync) Synced() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Check implements healthz.Checker.  Replicas waiting for the lease are
+// ready, as they only serve the webhook.
+func (s *startupSync) Check(_ *http.Request) error {
+	if s.lease != nil && !s.isLeader() {
+		return nil
+	}
+	if !s.Synced() {
+		return errors.New("allocator has not been loaded yet")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	goipam "github.com/metal-stack/go-ipam"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ipamcontrollerv1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+)
+
+// syncedCache is a cache which has always synced.
+type syncedCache struct {
+	cache.Cache
+}
+
+func (syncedCache) WaitForCacheSync(context.Context) bool {
+	return true
+}
+
+func TestStartupCheck(t *testing.T) {
+	elected := make(chan struct{})
+	startup := &startupSync{done: make(chan struct{}), elected: elected}
+	if err := startup.Check(nil); err == nil {
+		t.Errorf("expected a replica without leader election to be unready until the allocator is loaded")
+	}
+
+	// Replicas waiting for the lease only serve the webhook.
+	startup.lease = &coordinationv1.Lease{}
+	if err := startup.Check(nil); err != nil {
+		t.Errorf("expected a replica waiting for the lease to be ready, got %v", err)
+	}
+	close(elected)
+	if err := startup.Check(nil); err == nil {
+		t.Errorf("expected the leader to be unready until the allocator is loaded")
+	}
+
+	close(startup.done)
+	if err := startup.Check(nil); err != nil {
+		t.Errorf("expected the leader to be ready once the allocator is loaded, got %v", err)
+	}
+}
+
+// TestReconcileWaitsForStartup checks that claims aren't bound before the
+// startup sync has loaded the addresses in use.
+func TestReconcileWaitsForStartup(t *testing.T) {
+	ctx := context.Background()
+	pool := &ipamcontrollerv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec:       ipamcontrollerv1.IPPoolSpec{AddressCidr: "192.168.1.0/30", Prefix: 24},
+	}
+	created := time.Now().Add(-time.Hour)
+	claim := testClaim("ns", "claim", pool.Name, created)
+
+	// The first address of the pool is in use by an IPAddress made before the
+	// restart.
+	held := testClaim("ns", "held", pool.Name, created)
+	held.Status.AddressRef.Name = held.Name
+	ip := mgmt.NewIPAddress(held, pool, held.Name, "192.168.1.1")
+
+	scheme := testScheme(t)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool, claim, held, ip).
+		WithIndex(&ipamv1.IPAddress{}, ipAddressPoolIndex, indexIPAddressPool).Build()
+	allocator := mgmt.NewDispatcher(mgmt.NewGoIPAMAllocator(goipam.NewMemory()), nil)
+	addresses := newHeldAddresses()
+	pools := &IPPoolController{
+		Client:    c,
+		allocator: allocator,
+		apiReader: c,
+		held:      addresses,
+		recorder:  record.NewFakeRecorder(10),
+	}
+	startup := &startupSync{cache: syncedCache{}, pools: pools, done: make(chan struct{})}
+	processor := &IPPoolClaimProcessor{
+		Client:    c,
+		startup:   startup,
+		allocator: allocator,
+		held:      addresses,
+		recorder:  record.NewFakeRecorder(10),
+	}
+
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: claim.Name}}
+	result, err := processor.Reconcile(ctx, req)
+	if err != nil || result.RequeueAfter == 0 {
+		t.Errorf("got %+v, %v before the allocator was loaded, want a requeue", result, err)
+	}
+	if err := processor.Get(ctx, req.NamespacedName, claim); err != nil {
+		t.Fatalf("unable to get claim: %v", err)
+	}
+	if claim.Status.AddressRef.Name != "" || len(claim.Finalizers) != 0 {
+		t.Errorf("claim %+v was handled before the allocator was loaded", claim)
+	}
+
+	if err := startup.Start(ctx); err != nil {
+		t.Fatalf("unable to load the allocator: %v", err)
+	}
+	if !startup.Synced() {
+		t.Fatalf("expected the startup sync to have finished")
+	}
+	if _, err := processor.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unable to reconcile claim: %v", err)
+	}
+	bound := &ipamv1.IPAddress{}
+	if err := processor.Get(ctx, req.NamespacedName, bound); err != nil {
+		t.Fatalf("unable to get the IPAddress of the claim: %v", err)
+	}
+	if bound.Spec.Address == ip.Spec.Address {
+		t.Errorf("%v was handed out again after a restart", ip.Spec.Address)
+	}
+}
@@ -7,6 +7,114 @@ import (
 const (
 	IPPoolKind   = "IPPool"
 	APIGroupName = "ipamcontroller.openshift.io"
+
+	// PairedAddressAnnotation is set on the IPAddress referenced by a claim
+	// against a dual-stack pool.  It names the IPAddress allocated from the
+	// paired pool.
+	PairedAddressAnnotation = "ipamcontroller.openshift.io/paired-address"
+
+	// StaleAddressAnnotation is set on an IPAddress whose gateway or prefix
+	// no longer matches its pool and could not be updated.  It describes the
+	// pool's current configuration.
+	StaleAddressAnnotation = "ipamcontroller.openshift.io/stale"
+
+	// ForceDeleteAnnotation allows an IPPool to be deleted while addresses
+	// are still allocated from it when set to "true".  The pool's IPAddresses
+	// are deleted along with it.
+	ForceDeleteAnnotation = "ipamcontroller.openshift.io/force-delete"
+
+	// IPPoolFinalizer is set on IPPools so that the controller can release
+	// the pool's addresses before the pool is removed.
+	IPPoolFinalizer = "ipamcontroller.openshift.io/ippool"
+
+	// IPAddressClaimFinalizer is set on IPAddressClaims against an IPPool so
+	// that the controller can release the claim's addresses before the claim
+	// is removed.
+	IPAddressClaimFinalizer = "ipamcontroller.openshift.io/ipaddressclaim"
+
+	// DNSNameAnnotation is set on an IPAddress whose address was registered
+	// in DNS.  It holds the fully qualified name of the records, so that
+	// they can be removed when the address is released.
+	DNSNameAnnotation = "ipamcontroller.openshift.io/dns-name"
+
+	// MACAddressAnnotation may be set on an IPAddressClaim to the MAC address
+	// of the interface its address is configured on.  DHCP reservations
+	// exported for the claim's addresses are keyed by it.
+	MACAddressAnnotation = "ipamcontroller.openshift.io/mac-address"
+
+	// BoundAddressesAnnotation is set on an IPAddressClaim once it is bound.
+	// It records the address of every IPAddress bound to the claim as
+	// comma-separated name=address pairs, so that deleted or edited
+	// IPAddresses can be restored.
+	BoundAddressesAnnotation = "ipamcontroller.openshift.io/bound-addresses"
+)
+
+const (
+	// IPPoolConditionReady is true when the pool has been loaded into the
+	// allocator and can serve claims.
+	IPPoolConditionReady = "Ready"
+
+	// IPPoolConditionExhausted is true when there are no free addresses left
+	// in the pool.
+	IPPoolConditionExhausted = "Exhausted"
+
+	// IPPoolConditionDegraded is true when the pool is serving claims, but
+	// the controller found addresses it could not reconcile with the allocator.
+	IPPoolConditionDegraded = "Degraded"
+
+	// IPPoolConditionAddressesUpToDate is true when every IPAddress allocated
+	// from the pool carries the pool's current gateway and prefix.
+	IPPoolConditionAddressesUpToDate = "AddressesUpToDate"
+
+	// IPPoolConditionDeleting is true while the controller is processing the
+	// deletion of the pool.
+	IPPoolConditionDeleting = "Deleting"
+)
+
+const (
+	// IPAddressClaimConditionReady is true when the claim is bound to an
+	// IPAddress.  While the claim is pending, its reason tells why.
+	IPAddressClaimConditionReady = "Ready"
+
+	// IPAddressClaimConditionDNSRecordsReady is true when the addresses of a
+	// claim against a pool with DNS settings are registered in DNS.
+	IPAddressClaimConditionDNSRecordsReady = "DNSRecordsReady"
+
+	// IPAddressClaimConditionAddressesInSync is true when the IPAddresses
+	// bound to a claim exist, hold the addresses they were bound with and
+	// are held in the allocator.
+	IPAddressClaimConditionAddressesInSync = "AddressesInSync"
+)
+
+const (
+	// IPAddressClaimReasonPoolNotFound means the claim's pool does not exist.
+	IPAddressClaimReasonPoolNotFound = "PoolNotFound"
+
+	// IPAddressClaimReasonPoolNotReady means the claim's pool is not loaded
+	// in the allocator, or is being deleted.
+	IPAddressClaimReasonPoolNotReady = "PoolNotReady"
+
+	// IPAddressClaimReasonPoolExhausted means the claim's pool has no free
+	// address left.
+	IPAddressClaimReasonPoolExhausted = "PoolExhausted"
+
+	// IPAddressClaimReasonAllocationFailed means allocating an address for
+	// the claim failed for another reason.
+	IPAddressClaimReasonAllocationFailed = "AllocationFailed"
+
+	// IPAddressClaimReasonResyncConflict means an IPAddress left behind by an
+	// earlier binding attempt could not be adopted.
+	IPAddressClaimReasonResyncConflict = "ResyncConflict"
+
+	// IPAddressClaimReasonAddressConflict means the address of an IPAddress
+	// bound to the claim is held by another IPAddress, or the allocator
+	// refused it.
+	IPAddressClaimReasonAddressConflict = "AddressConflict"
+
+	// IPAddressClaimReasonAddressNotRecorded means an IPAddress bound to the
+	// claim is gone and its address was never recorded, so it can't be
+	// restored.
+	IPAddressClaimReasonAddressNotRecorded = "AddressNotRecorded"
 )
 
 // +genclient
@@ -16,6 +124,10 @@ const (
 // +kubebuilder:printcolumn:name="CIDR",type=string,JSONPath=`.spec.address-cidr`
 // +kubebuilder:printcolumn:name="Prefix",type=integer,JSONPath=`.spec.prefix`
 // +kubebuilder:printcolumn:name="Gateway",type=string,JSONPath=`.spec.gateway`
+// +kubebuilder:printcolumn:name="Total",type=integer,JSONPath=`.status.total`
+// +kubebuilder:printcolumn:name="Allocated",type=integer,JSONPath=`.status.allocated`
+// +kubebuilder:printcolumn:name="Free",type=integer,JSONPath=`.status.free`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // IPPool represents the IPPool definition for static IPs used by the IPAM controller
@@ -35,21 +147,259 @@ type IPPool struct {
 
 // IPPoolSpec is the spec for an IPPool
 type IPPoolSpec struct {
-	// AddressCidr is a cidr for the IP IPv4range to manage.
-	AddressCidr string `json:"address-cidr"`
+	// AddressCidr is a cidr for the IPv4 or IPv6 range to manage.
+	// +optional
+	AddressCidr string `json:"address-cidr,omitempty"`
+
+	// Addresses is a list of additional address ranges managed by the pool.
+	// Each entry is a CIDR (192.168.1.0/28), a first-last range
+	// (192.168.1.20-192.168.1.45) or a single address.  The first and last
+	// addresses of a CIDR are never handed out.
+	// +optional
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Excludes is a list of addresses inside the pool which must never be
+	// handed out, such as gateways, VIPs or addresses held by appliances.
+	// Each entry is a single address, a first-last range or a CIDR.
+	// +optional
+	Excludes []string `json:"excludes,omitempty"`
 
 	// Prefix is the subnet prefix
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=128
 	Prefix int `json:"prefix"`
 
 	// +optional
 	Gateway string `json:"gateway"`
 
+	// RoutingDomain is the routing domain the pool's addresses belong to.
+	// Pools in the same routing domain must not overlap.  Pools which don't
+	// set a routing domain share the default routing domain.
+	// +optional
+	RoutingDomain string `json:"routing-domain,omitempty"`
+
+	// PairedPool is the name of a pool of the other IP family in the same
+	// namespace.  Claims against this pool receive an address from both
+	// pools, each with the gateway and prefix of its own pool.
+	// +optional
+	PairedPool string `json:"paired-pool,omitempty"`
+
 	// +optional
 	Nameserver []string `json:"nameserver"`
+
+	// Infoblox hands out the pool's addresses from an Infoblox network
+	// instead of the built-in allocator.  Address-cidr, addresses and
+	// excludes must not be set along with it.
+	// +optional
+	Infoblox *InfobloxConfig `json:"infoblox,omitempty"`
+
+	// NetBox hands out the pool's addresses from a NetBox prefix or IP range
+	// instead of the built-in allocator.  Address-cidr, addresses and
+	// excludes must not be set along with it.
+	// +optional
+	NetBox *NetBoxConfig `json:"netbox,omitempty"`
+
+	// HTTP hands out the pool's addresses from an external allocator
+	// implementing the controller's HTTP protocol instead of the built-in
+	// allocator.  Address-cidr, addresses and excludes must not be set along
+	// with it.
+	// +optional
+	HTTP *HTTPAllocatorConfig `json:"http,omitempty"`
+
+	// DNS registers the addresses handed out by the pool in DNS with
+	// RFC 2136 dynamic updates.
+	// +optional
+	DNS *DNSConfig `json:"dns,omitempty"`
+
+	// DHCPExport writes the pool's allocations as DHCP reservations to a
+	// ConfigMap, so that DHCP servers sharing the segment never hand out
+	// the pool's addresses.
+	// +optional
+	DHCPExport *DHCPExportConfig `json:"dhcp-export,omitempty"`
+}
+
+// DHCPExportConfig names the ConfigMap the reservations of a pool are
+// written to.  It holds the reservations as an ISC Kea reservations list
+// under kea-reservations.json and as dnsmasq dhcp-host lines under
+// dnsmasq.conf.
+type DHCPExportConfig struct {
+	// ConfigMap is the name of the ConfigMap in the pool's namespace, the
+	// pool's name followed by -dhcp by default.
+	// +optional
+	ConfigMap string `json:"config-map,omitempty"`
+}
+
+// DNSConfig locates the DNS server the addresses of a pool are registered
+// with.  An A or AAAA record is created in the zone for every address, and
+// a PTR record when a reverse zone is set.
+type DNSConfig struct {
+	// Zone is the forward zone the records are created in, such as
+	// cluster.example.com.
+	Zone string `json:"zone"`
+
+	// ReverseZone is the zone PTR records are created in, such as
+	// 0.168.192.in-addr.arpa.  No PTR records are created when it is not set.
+	// +optional
+	ReverseZone string `json:"reverse-zone,omitempty"`
+
+	// Server is the host and optional port of the DNS server accepting the
+	// updates.  The port is 53 by default.
+	Server string `json:"server"`
+
+	// HostnameTemplate is a Go template rendering the name of the records
+	// relative to the zone.  It may use .Machine, .Claim, .Namespace, .Pool
+	// and .Address, and is the name of the claim's machine by default, or
+	// the name of the claim when it has no machine.
+	// +optional
+	HostnameTemplate string `json:"hostname-template,omitempty"`
+
+	// TTL is the time to live of the records in seconds, 300 by default.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	TTL *int32 `json:"ttl,omitempty"`
+
+	// TSIGSecret is the name of a secret in the pool's namespace holding the
+	// name, algorithm and base64 secret of the TSIG key updates are signed
+	// with.  Updates are not signed when it is not set.
+	// +optional
+	TSIGSecret string `json:"tsig-secret,omitempty"`
+}
+
+// HTTPAllocatorConfig locates an external allocator implementing the
+// controller's HTTP protocol.
+type HTTPAllocatorConfig struct {
+	// URL is the base URL of the allocator's endpoints.
+	URL string `json:"url"`
+
+	// Network is the cidr or first-last range of the addresses the
+	// allocator hands out for the pool.
+	Network string `json:"network"`
+
+	// CredentialsSecret is the name of a secret in the pool's namespace
+	// holding the bearer token sent to the allocator, and optionally the
+	// ca.crt of the allocator and a tls.crt and tls.key to authenticate with.
+	// +optional
+	CredentialsSecret string `json:"credentials-secret,omitempty"`
+
+	// TimeoutSeconds bounds every request to the allocator, 30 by default.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	TimeoutSeconds int `json:"timeout-seconds,omitempty"`
+
+	// Retries is the number of times a request which failed with a
+	// connection error or a 5xx status is retried, 3 by default.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	Retries *int `json:"retries,omitempty"`
+
+	// InsecureSkipVerify disables verification of the allocator's
+	// certificate.
+	// +optional
+	InsecureSkipVerify bool `json:"insecure-skip-verify,omitempty"`
+}
+
+// NetBoxConfig locates the NetBox prefix or IP range a pool hands out
+// addresses from.  Exactly one of prefix and ip-range must be set.
+type NetBoxConfig struct {
+	// URL is the URL of NetBox, such as https://netbox.example.com.
+	URL string `json:"url"`
+
+	// Prefix is the cidr of a NetBox prefix.
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// IPRange is a NetBox IP range, given as first-last
+	// (192.168.1.20-192.168.1.45).
+	// +optional
+	IPRange string `json:"ip-range,omitempty"`
+
+	// VRF is the name of the NetBox VRF of the prefix or IP range.  When it
+	// is not set, the prefix or IP range must be unique across VRFs.
+	// +optional
+	VRF string `json:"vrf,omitempty"`
+
+	// CredentialsSecret is the name of a secret in the pool's namespace
+	// holding the API token of a NetBox user, and optionally the ca.crt of
+	// NetBox.
+	CredentialsSecret string `json:"credentials-secret"`
+
+	// InsecureSkipVerify disables verification of NetBox's certificate.
+	// +optional
+	InsecureSkipVerify bool `json:"insecure-skip-verify,omitempty"`
+}
+
+// InfobloxConfig locates the Infoblox network a pool hands out addresses
+// from.  Every address is held by a host record named after its IPAddress.
+type InfobloxConfig struct {
+	// Host is the host name or URL of the Infoblox grid master.
+	Host string `json:"host"`
+
+	// WAPIVersion is the version of the WAPI used, v2.12 by default.
+	// +optional
+	WAPIVersion string `json:"wapi-version,omitempty"`
+
+	// NetworkView is the network view of the network, default by default.
+	// +optional
+	NetworkView string `json:"network-view,omitempty"`
+
+	// Network is the cidr of the Infoblox network.
+	Network string `json:"network"`
+
+	// DNSView is the DNS view host records are created in.  Host records
+	// are not configured for DNS when it is not set.
+	// +optional
+	DNSView string `json:"dns-view,omitempty"`
+
+	// DomainName is appended to the names of host records.
+	// +optional
+	DomainName string `json:"domain-name,omitempty"`
+
+	// CredentialsSecret is the name of a secret in the pool's namespace
+	// holding the username and password of a WAPI user, and optionally the
+	// ca.crt of the grid master.
+	CredentialsSecret string `json:"credentials-secret"`
+
+	// InsecureSkipVerify disables verification of the grid master's
+	// certificate.
+	// +optional
+	InsecureSkipVerify bool `json:"insecure-skip-verify,omitempty"`
 }
 
 // IPPoolStatus is the current status of an IPPool.
 type IPPoolStatus struct {
+	// ObservedGeneration is the generation of the IPPool spec last processed
+	// by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Total is the number of addresses managed by the pool.  The count
+	// saturates at 2^63-1 for very large IPv6 pools.
+	// +optional
+	Total int64 `json:"total"`
+
+	// Allocated is the number of addresses handed out to IPAddresses.
+	// +optional
+	Allocated int64 `json:"allocated"`
+
+	// Free is the number of addresses still available for new claims.
+	// +optional
+	Free int64 `json:"free"`
+
+	// Reserved is the number of addresses in the pool which will never be
+	// handed out, such as network and broadcast addresses.
+	// +optional
+	Reserved int64 `json:"reserved"`
+
+	// AllocatedAddresses lists the allocated addresses. Consecutive addresses
+	// are collapsed into first-last ranges.
+	// +optional
+	AllocatedAddresses []string `json:"allocatedAddresses,omitempty"`
+
+	// Conditions describe the current state of the pool.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -0,0 +1,249 @@
+// Package ddns registers the addresses handed out by pools in DNS with
+// RFC 2136 dynamic updates.
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+)
+
+const (
+	// DefaultHostnameTemplate names records after the claim's machine, or
+	// after the claim when it has no machine.
+	DefaultHostnameTemplate = "{{ with .Machine }}{{ . }}{{ else }}{{ .Claim }}{{ end }}"
+
+	defaultTTL       = 300
+	defaultAlgorithm = dns.HmacSHA256
+
+	// updateTimeout bounds every update sent to a DNS server.
+	updateTimeout = 10 * time.Second
+)
+
+// HostnameData is what hostname templates are rendered with.
+type HostnameData struct {
+	Machine   string
+	Claim     string
+	Namespace string
+	Pool      string
+	Address   string
+}
+
+// ParseHostnameTemplate parses the hostname template of a pool's DNS
+// settings, or the default template when it is not set.
+func ParseHostnameTemplate(config *v1.DNSConfig) (*template.Template, error) {
+	text := config.HostnameTemplate
+	if text == "" {
+		text = DefaultHostnameTemplate
+	}
+	return template.New("hostname").Option("missingkey=error").Parse(text)
+}
+
+// Hostname renders the fully qualified name of the records of an address
+// bound to the claim.
+func Hostname(pool *v1.IPPool, ipClaim *ipamv1.IPAddressClaim, address netip.Addr) (string, error) {
+	config := pool.Spec.DNS
+	tmpl, err := ParseHostnameTemplate(config)
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname template: %w", err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, HostnameData{
+		Machine:   mgmt.ClaimMachine(ipClaim),
+		Claim:     ipClaim.Name,
+		Namespace: ipClaim.Namespace,
+		Pool:      pool.Name,
+		Address:   address.String(),
+	}); err != nil {
+		return "", fmt.Errorf("unable to render hostname template: %w", err)
+	}
+
+	hostname := strings.ToLower(strings.TrimSpace(out.String()))
+	if hostname == "" {
+		return "", fmt.Errorf("hostname template rendered an empty name")
+	}
+	zone := dns.Fqdn(strings.ToLower(config.Zone))
+	if !dns.IsFqdn(hostname) {
+		hostname = hostname + "." + zone
+	}
+	if _, ok := dns.IsDomainName(hostname); !ok {
+		return "", fmt.Errorf("%q is not a valid domain name", hostname)
+	}
+	if !dns.IsSubDomain(zone, hostname) {
+		return "", fmt.Errorf("%v is not in zone %v", hostname, zone)
+	}
+	return hostname, nil
+}
+
+// Updater sends the dynamic updates of pools.
+type Updater struct {
+	// secrets reads the TSIG keys of the pools.
+	secrets client.Reader
+}
+
+// NewUpdater returns an updater reading TSIG keys with secrets.
+func NewUpdater(secrets client.Reader) *Updater {
+	return &Updater{secrets: secrets}
+}
+
+// Register adds address to the addresses hostname points at, and points the
+// address back at hostname when the pool has a reverse zone.  The other
+// addresses of hostname are kept, as several claims of a machine share its
+// name; they are removed by unregistering the IPAddresses holding them.
+func (u *Updater) Register(ctx context.Context, pool *v1.IPPool, hostname string, address netip.Addr) error {
+	forward, reverse, err := records(pool.Spec.DNS, hostname, address)
+	if err != nil {
+		return err
+	}
+	for _, record := range []*record{forward, reverse} {
+		if record == nil {
+			continue
+		}
+		update := new(dns.Msg)
+		update.SetUpdate(record.zone)
+		// An address has a single name, so a PTR record left behind by an
+		// earlier holder of the address is replaced.
+		if record == reverse {
+			update.RemoveRRset([]dns.RR{record.rr})
+		}
+		update.Insert([]dns.RR{record.rr})
+		if err := u.send(ctx, pool, update); err != nil {
+			return fmt.Errorf("unable to register %v: %w", record.rr.Header().Name, err)
+		}
+	}
+	return nil
+}
+
+// Unregister removes the records created by Register.  Records pointing
+// elsewhere in the meantime are left alone.
+func (u *Updater) Unregister(ctx context.Context, pool *v1.IPPool, hostname string, address netip.Addr) error {
+	forward, reverse, err := records(pool.Spec.DNS, hostname, address)
+	if err != nil {
+		return err
+	}
+	for _, record := range []*record{forward, reverse} {
+		if record == nil {
+			continue
+		}
+		update := new(dns.Msg)
+		update.SetUpdate(record.zone)
+		update.Remove([]dns.RR{record.rr})
+		if err := u.send(ctx, pool, update); err != nil {
+			return fmt.Errorf("unable to remove %v: %w", record.rr.Header().Name, err)
+		}
+	}
+	return nil
+}
+
+// send sends an update to the pool's DNS server, signed with the pool's TSIG
+// key if it has one.
+func (u *Updater) send(ctx context.Context, pool *v1.IPPool, update *dns.Msg) error {
+	config := pool.Spec.DNS
+	dnsClient := &dns.Client{Timeout: updateTimeout}
+	if config.TSIGSecret != "" {
+		name, algorithm, secret, err := u.tsigKey(ctx, pool)
+		if err != nil {
+			return err
+		}
+		dnsClient.TsigSecret = map[string]string{name: secret}
+		update.SetTsig(name, algorithm, 300, time.Now().Unix())
+	}
+
+	response, _, err := dnsClient.ExchangeContext(ctx, update, serverAddress(config.Server))
+	if err != nil {
+		return err
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("server %v refused the update: %v", config.Server, dns.RcodeToString[response.Rcode])
+	}
+	log.Debugf("Sent update to %v: %v", config.Server, update.Ns)
+	return nil
+}
+
+// tsigKey reads the TSIG key of the pool.
+func (u *Updater) tsigKey(ctx context.Context, pool *v1.IPPool) (name, algorithm, secret string, err error) {
+	tsigSecret := &corev1.Secret{}
+	if err := u.secrets.Get(ctx, types.NamespacedName{Namespace: pool.Namespace, Name: pool.Spec.DNS.TSIGSecret}, tsigSecret); err != nil {
+		return "", "", "", fmt.Errorf("unable to read TSIG secret %v: %w", pool.Spec.DNS.TSIGSecret, err)
+	}
+	name = strings.TrimSpace(string(tsigSecret.Data["name"]))
+	secret = strings.TrimSpace(string(tsigSecret.Data["secret"]))
+	if name == "" || secret == "" {
+		return "", "", "", fmt.Errorf("TSIG secret %v must hold a name and a secret", pool.Spec.DNS.TSIGSecret)
+	}
+	algorithm = strings.TrimSpace(string(tsigSecret.Data["algorithm"]))
+	if algorithm == "" {
+		algorithm = defaultAlgorithm
+	}
+	return dns.Fqdn(name), dns.Fqdn(algorithm), secret, nil
+}
+
+// record is a resource record along with the zone it belongs to.
+type record struct {
+	zone string
+	rr   dns.RR
+}
+
+// records returns the A or AAAA record of the address, and its PTR record if
+// the pool has a reverse zone.
+func records(config *v1.DNSConfig, hostname string, address netip.Addr) (forward, reverse *record, err error) {
+	header := dns.RR_Header{Name: hostname, Class: dns.ClassINET, Ttl: ttl(config)}
+	forward = &record{zone: dns.Fqdn(config.Zone)}
+	if address.Is4() {
+		header.Rrtype = dns.TypeA
+		forward.rr = &dns.A{Hdr: header, A: net.IP(address.AsSlice())}
+	} else {
+		header.Rrtype = dns.TypeAAAA
+		forward.rr = &dns.AAAA{Hdr: header, AAAA: net.IP(address.AsSlice())}
+	}
+	if config.ReverseZone == "" {
+		return forward, nil, nil
+	}
+
+	name, err := dns.ReverseAddr(address.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	zone := dns.Fqdn(strings.ToLower(config.ReverseZone))
+	if !dns.IsSubDomain(zone, name) {
+		return nil, nil, fmt.Errorf("%v is not in reverse zone %v", name, zone)
+	}
+	reverse = &record{
+		zone: zone,
+		rr: &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl(config)},
+			Ptr: hostname,
+		},
+	}
+	return forward, reverse, nil
+}
+
+func ttl(config *v1.DNSConfig) uint32 {
+	if config.TTL == nil {
+		return defaultTTL
+	}
+	return uint32(*config.TTL)
+}
+
+// serverAddress returns the server's host and port, defaulting to port 53.
+func serverAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+}
@@ -0,0 +1,344 @@
+package ddns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+const (
+	testKeyName   = "ddns-key."
+	testKeySecret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZw=="
+)
+
+// testServer is a DNS server applying the dynamic updates it receives to an
+// in-memory zone.
+type testServer struct {
+	addr string
+
+	// requireTSIG refuses updates which are not signed with the test key.
+	requireTSIG bool
+
+	mu      sync.Mutex
+	records map[string]dns.RR
+}
+
+func newTestServer(t *testing.T, requireTSIG bool) *testServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	s := &testServer{
+		addr:        conn.LocalAddr().String(),
+		requireTSIG: requireTSIG,
+		records:     map[string]dns.RR{},
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		Handler:           s,
+		TsigSecret:        map[string]string{testKeyName: testKeySecret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default accepts queries only.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return s
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := new(dns.Msg)
+	response.SetReply(r)
+	tsig := r.IsTsig()
+	if tsig != nil && w.TsigStatus() != nil || s.requireTSIG && tsig == nil {
+		response.Rcode = dns.RcodeNotAuth
+		_ = w.WriteMsg(response)
+		return
+	}
+	if r.Opcode != dns.OpcodeUpdate {
+		response.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(response)
+		return
+	}
+
+	for _, rr := range r.Ns {
+		header := rr.Header()
+		switch header.Class {
+		case dns.ClassANY:
+			// Delete an RRset
+			for key, existing := range s.records {
+				if existing.Header().Name == header.Name && existing.Header().Rrtype == header.Rrtype {
+					delete(s.records, key)
+				}
+			}
+		case dns.ClassNONE:
+			// Delete an RR from an RRset
+			header.Class = dns.ClassINET
+			header.Ttl = 0
+			delete(s.records, recordKey(rr))
+		default:
+			s.records[recordKey(rr)] = rr
+		}
+	}
+	if tsig != nil {
+		response.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	_ = w.WriteMsg(response)
+}
+
+// recordKey identifies a record regardless of its TTL.
+func recordKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	return rr.String()
+}
+
+func (s *testServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+// lookup returns the data of the records of a name and type.
+func (s *testServer) lookup(name string, rrtype uint16) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data []string
+	for _, rr := range s.records {
+		if rr.Header().Name == name && rr.Header().Rrtype == rrtype {
+			data = append(data, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+	}
+	return data
+}
+
+func testPool(server string) *v1.IPPool {
+	return &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec: v1.IPPoolSpec{
+			DNS: &v1.DNSConfig{
+				Zone:        "example.com",
+				ReverseZone: "168.192.in-addr.arpa",
+				Server:      server,
+			},
+		},
+	}
+}
+
+func TestRegisterAndUnregister(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t, false)
+	pool := testPool(server.addr)
+	updater := NewUpdater(fake.NewClientBuilder().Build())
+
+	hostname := "worker-0.example.com."
+	address := netip.MustParseAddr("192.168.1.5")
+	// Registering is retried until it succeeds, so it must be idempotent.
+	for i := 0; i < 2; i++ {
+		if err := updater.Register(ctx, pool, hostname, address); err != nil {
+			t.Fatalf("unable to register: %v", err)
+		}
+	}
+	if got := server.lookup(hostname, dns.TypeA); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("got A records %v, want 192.168.1.5", got)
+	}
+	if got := server.lookup("5.1.168.192.in-addr.arpa.", dns.TypePTR); len(got) != 1 || got[0] != hostname {
+		t.Errorf("got PTR records %v, want %v", got, hostname)
+	}
+
+	// A PTR record left behind by an earlier holder of the address is
+	// replaced.
+	if err := updater.Register(ctx, pool, "worker-1.example.com.", address); err != nil {
+		t.Fatalf("unable to register: %v", err)
+	}
+	if got := server.lookup("5.1.168.192.in-addr.arpa.", dns.TypePTR); len(got) != 1 || got[0] != "worker-1.example.com." {
+		t.Errorf("got PTR records %v, want only worker-1.example.com.", got)
+	}
+
+	for _, name := range []string{hostname, "worker-1.example.com."} {
+		if err := updater.Unregister(ctx, pool, name, address); err != nil {
+			t.Fatalf("unable to unregister: %v", err)
+		}
+	}
+	if n := server.count(); n != 0 {
+		t.Errorf("got %v records left after unregistering, want none", n)
+	}
+}
+
+// TestRegisterTwoClaimsOneMachine registers the addresses of two claims of a
+// machine, which share the machine's name.
+func TestRegisterTwoClaimsOneMachine(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t, false)
+	pool := testPool(server.addr)
+	updater := NewUpdater(fake.NewClientBuilder().Build())
+
+	machine := []metav1.OwnerReference{{Kind: "Machine", Name: "worker-0"}}
+	claims := map[string]netip.Addr{
+		"worker-0-eth0": netip.MustParseAddr("192.168.1.5"),
+		"worker-0-eth1": netip.MustParseAddr("192.168.1.6"),
+	}
+	var hostname string
+	for name, address := range claims {
+		claim := &ipamv1.IPAddressClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, OwnerReferences: machine}}
+		var err error
+		if hostname, err = Hostname(pool, claim, address); err != nil {
+			t.Fatalf("unable to render hostname: %v", err)
+		}
+		if err := updater.Register(ctx, pool, hostname, address); err != nil {
+			t.Fatalf("unable to register: %v", err)
+		}
+	}
+	if hostname != "worker-0.example.com." {
+		t.Fatalf("got hostname %v, want worker-0.example.com.", hostname)
+	}
+	got := server.lookup(hostname, dns.TypeA)
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "192.168.1.5" || got[1] != "192.168.1.6" {
+		t.Errorf("got A records %v, want the addresses of both claims", got)
+	}
+	for _, ptr := range []string{"5.1.168.192.in-addr.arpa.", "6.1.168.192.in-addr.arpa."} {
+		if got := server.lookup(ptr, dns.TypePTR); len(got) != 1 || got[0] != hostname {
+			t.Errorf("got PTR records %v of %v, want %v", got, ptr, hostname)
+		}
+	}
+
+	// Releasing one claim leaves the records of the other.
+	if err := updater.Unregister(ctx, pool, hostname, claims["worker-0-eth0"]); err != nil {
+		t.Fatalf("unable to unregister: %v", err)
+	}
+	if got := server.lookup(hostname, dns.TypeA); len(got) != 1 || got[0] != "192.168.1.6" {
+		t.Errorf("got A records %v, want only 192.168.1.6", got)
+	}
+	if got := server.lookup("6.1.168.192.in-addr.arpa.", dns.TypePTR); len(got) != 1 {
+		t.Errorf("got PTR records %v, want the one of 192.168.1.6", got)
+	}
+	if n := server.count(); n != 2 {
+		t.Errorf("got %v records, want the A and PTR records of 192.168.1.6", n)
+	}
+}
+
+func TestRegisterIPv6WithoutReverseZone(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t, false)
+	pool := testPool(server.addr)
+	pool.Spec.DNS.ReverseZone = ""
+	updater := NewUpdater(fake.NewClientBuilder().Build())
+
+	hostname := "worker-0.example.com."
+	if err := updater.Register(ctx, pool, hostname, netip.MustParseAddr("fd00::5")); err != nil {
+		t.Fatalf("unable to register: %v", err)
+	}
+	if got := server.lookup(hostname, dns.TypeAAAA); len(got) != 1 || got[0] != "fd00::5" {
+		t.Errorf("got AAAA records %v, want fd00::5", got)
+	}
+	if n := server.count(); n != 1 {
+		t.Errorf("got %v records, want only the AAAA record", n)
+	}
+}
+
+func TestRegisterTSIG(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t, true)
+	pool := testPool(server.addr)
+	hostname := "worker-0.example.com."
+	address := netip.MustParseAddr("192.168.1.5")
+
+	if err := NewUpdater(fake.NewClientBuilder().Build()).Register(ctx, pool, hostname, address); err == nil {
+		t.Errorf("expected an unsigned update to be refused")
+	}
+
+	pool.Spec.DNS.TSIGSecret = "tsig"
+	for _, tc := range []struct {
+		name   string
+		secret string
+		ok     bool
+	}{
+		{name: "wrong key", secret: "d3Jvbmcta2V5", ok: false},
+		{name: "right key", secret: testKeySecret, ok: true},
+	} {
+		secrets := fake.NewClientBuilder().WithObjects(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tsig"},
+			Data: map[string][]byte{
+				"name":   []byte("ddns-key"),
+				"secret": []byte(tc.secret),
+			},
+		}).Build()
+		err := NewUpdater(secrets).Register(ctx, pool, hostname, address)
+		if tc.ok && err != nil {
+			t.Errorf("%v: unable to register: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%v: expected the update to be refused", tc.name)
+		}
+	}
+	if got := server.lookup(hostname, dns.TypeA); len(got) != 1 {
+		t.Errorf("got A records %v, want the signed update applied", got)
+	}
+
+	secrets := fake.NewClientBuilder().WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tsig"},
+		Data:       map[string][]byte{"name": []byte("ddns-key")},
+	}).Build()
+	if err := NewUpdater(secrets).Register(ctx, pool, hostname, address); err == nil {
+		t.Errorf("expected a TSIG secret without a secret to be rejected")
+	}
+}
+
+func TestHostname(t *testing.T) {
+	pool := testPool("127.0.0.1")
+	claim := &ipamv1.IPAddressClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "ns",
+			Name:            "claim",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Machine", Name: "Worker-0"}},
+		},
+	}
+	address := netip.MustParseAddr("192.168.1.5")
+	for _, tc := range []struct {
+		template string
+		want     string
+	}{
+		{template: "", want: "worker-0.example.com."},
+		{template: "{{ .Claim }}.{{ .Pool }}", want: "claim.pool.example.com."},
+		{template: "host.example.com.", want: "host.example.com."},
+		{template: "host.example.org.", want: ""},
+		{template: "{{ .Missing }}", want: ""},
+		{template: " ", want: ""},
+	} {
+		pool.Spec.DNS.HostnameTemplate = tc.template
+		got, err := Hostname(pool, claim, address)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tc.template, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %v, %v, want %v", tc.template, got, err, tc.want)
+		}
+	}
+}
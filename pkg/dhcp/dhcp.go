@@ -0,0 +1,124 @@
+// Package dhcp renders the addresses handed out by pools as static DHCP
+// reservations.
+package dhcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+const (
+	// KeaKey is the key of the ConfigMap data holding the Kea reservations.
+	KeaKey = "kea-reservations.json"
+
+	// DnsmasqKey is the key of the ConfigMap data holding the dnsmasq
+	// dhcp-host lines.
+	DnsmasqKey = "dnsmasq.conf"
+)
+
+// Reservation is an address held by a host.
+type Reservation struct {
+	// Address is the reserved address.
+	Address netip.Addr
+
+	// Hostname is the name of the host holding the address.
+	Hostname string
+
+	// MACAddress is the MAC address of the host's interface, if known.
+	MACAddress net.HardwareAddr
+}
+
+// keaReservation is a reservation in a Kea subnet4 or subnet6.
+type keaReservation struct {
+	HWAddress   string   `json:"hw-address,omitempty"`
+	IPAddress   string   `json:"ip-address,omitempty"`
+	IPAddresses []string `json:"ip-addresses,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+}
+
+// Kea renders the reservations as the reservations list of a Kea subnet.
+// Reservations without a MAC address are left out, Kea has nothing to key
+// them by.
+func Kea(reservations []Reservation) ([]byte, error) {
+	entries := []keaReservation{}
+	for _, reservation := range sorted(reservations) {
+		if len(reservation.MACAddress) == 0 {
+			continue
+		}
+		entry := keaReservation{
+			HWAddress: reservation.MACAddress.String(),
+			Hostname:  reservation.Hostname,
+		}
+		if reservation.Address.Is4() {
+			entry.IPAddress = reservation.Address.String()
+		} else {
+			entry.IPAddresses = []string{reservation.Address.String()}
+		}
+		entries = append(entries, entry)
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Dnsmasq renders the reservations as dnsmasq dhcp-host lines.  Reservations
+// without a MAC address are matched by hostname, and left out when they have
+// no hostname either.
+func Dnsmasq(reservations []Reservation) []byte {
+	var out bytes.Buffer
+	out.WriteString("# Generated by machine-ipam-controller, do not edit\n")
+	for _, reservation := range sorted(reservations) {
+		if len(reservation.MACAddress) == 0 && reservation.Hostname == "" {
+			continue
+		}
+		fields := []string{}
+		if len(reservation.MACAddress) > 0 {
+			fields = append(fields, reservation.MACAddress.String())
+		}
+		if reservation.Address.Is4() {
+			fields = append(fields, reservation.Address.String())
+		} else {
+			fields = append(fields, fmt.Sprintf("[%v]", reservation.Address))
+		}
+		if reservation.Hostname != "" {
+			fields = append(fields, reservation.Hostname)
+		}
+		fmt.Fprintf(&out, "dhcp-host=%v\n", strings.Join(fields, ","))
+	}
+	return out.Bytes()
+}
+
+// Hostname turns a name into a hostname DHCP servers accept, a single DNS
+// label.
+func Hostname(name string) string {
+	name = strings.ToLower(name)
+	if label, _, ok := strings.Cut(name, "."); ok {
+		name = label
+	}
+	hostname := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, name)
+	if len(hostname) > 63 {
+		hostname = hostname[:63]
+	}
+	return strings.Trim(hostname, "-")
+}
+
+func sorted(reservations []Reservation) []Reservation {
+	out := append([]Reservation(nil), reservations...)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Address.Less(out[j].Address)
+	})
+	return out
+}
@@ -0,0 +1,85 @@
+package dhcp
+
+import (
+	"bytes"
+	"flag"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func testReservations(t *testing.T) []Reservation {
+	t.Helper()
+	mac := func(s string) net.HardwareAddr {
+		hw, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hw
+	}
+	// Out of order, the renderings sort them by address.
+	return []Reservation{
+		{Address: netip.MustParseAddr("192.168.0.20"), Hostname: "worker-1", MACAddress: mac("52:54:00:aa:bb:02")},
+		{Address: netip.MustParseAddr("192.168.0.10"), Hostname: "worker-0", MACAddress: mac("52:54:00:aa:bb:01")},
+		{Address: netip.MustParseAddr("192.168.0.30"), Hostname: "no-mac"},
+		{Address: netip.MustParseAddr("192.168.0.40")},
+		{Address: netip.MustParseAddr("192.168.0.50"), MACAddress: mac("52:54:00:aa:bb:05")},
+		{Address: netip.MustParseAddr("fd00::10"), Hostname: "worker-0", MACAddress: mac("52:54:00:aa:bb:01")},
+		{Address: netip.MustParseAddr("fd00::30"), Hostname: "no-mac"},
+	}
+}
+
+// checkGolden compares got with the golden file name in testdata.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%v differs, got:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestKea(t *testing.T) {
+	got, err := Kea(testReservations(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "kea-reservations.json", got)
+
+	empty, err := Kea(nil)
+	if err != nil || string(empty) != "[]\n" {
+		t.Errorf("got %q, %v for no reservations, want an empty list", empty, err)
+	}
+}
+
+func TestDnsmasq(t *testing.T) {
+	checkGolden(t, "dnsmasq.conf", Dnsmasq(testReservations(t)))
+}
+
+func TestHostname(t *testing.T) {
+	for name, want := range map[string]string{
+		"worker-0":               "worker-0",
+		"Worker-0.example.com.":  "worker-0",
+		"cluster_worker 0":       "cluster-worker-0",
+		"-edge-":                 "edge",
+		string(make([]byte, 70)): "",
+		strings.Repeat("a", 70):  strings.Repeat("a", 63),
+	} {
+		if got := Hostname(name); got != want {
+			t.Errorf("Hostname(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// LeaderElections counts the times this replica became the leader and
+	// loaded the allocator.
+	LeaderElections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "machine_ipam_controller_leader_elections_total",
+		Help: "Number of times this replica became the leader and loaded the allocator.",
+	})
+
+	// StartupSyncSeconds is how long loading the allocator took after the
+	// replica became the leader.
+	StartupSyncSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "machine_ipam_controller_startup_sync_seconds",
+		Help: "Time taken to load every pool into the allocator after becoming the leader.",
+	})
+
+	// PoolTotalAddresses is the number of addresses managed by each pool.
+	PoolTotalAddresses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "machine_ipam_controller_pool_total_addresses",
+		Help: "Number of addresses managed by the pool.",
+	}, []string{"namespace", "pool"})
+
+	// PoolAllocatedAddresses is the number of addresses handed out by each
+	// pool.
+	PoolAllocatedAddresses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "machine_ipam_controller_pool_allocated_addresses",
+		Help: "Number of addresses of the pool handed out to IPAddresses.",
+	}, []string{"namespace", "pool"})
+
+	// PoolFreeAddresses is the number of addresses each pool can still hand
+	// out.
+	PoolFreeAddresses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "machine_ipam_controller_pool_free_addresses",
+		Help: "Number of addresses of the pool still available for new claims.",
+	}, []string{"namespace", "pool"})
+
+	// Allocations counts the addresses handed out by each pool.
+	Allocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "machine_ipam_controller_allocations_total",
+		Help: "Number of addresses handed out by the pool.",
+	}, []string{"namespace", "pool"})
+
+	// Releases counts the addresses released back to each pool.
+	Releases = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "machine_ipam_controller_releases_total",
+		Help: "Number of addresses released back to the pool.",
+	}, []string{"namespace", "pool"})
+
+	// PoolExhausted counts the claims which could not be bound because their
+	// pool had no free address left.
+	PoolExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "machine_ipam_controller_pool_exhausted_total",
+		Help: "Number of times a claim could not be bound because the pool had no free address left.",
+	}, []string{"namespace", "pool"})
+
+	// BindSeconds is how long binding a claim took.
+	BindSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "machine_ipam_controller_bind_duration_seconds",
+		Help:    "Time taken to bind a claim to an IPAddress.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"namespace", "pool"})
+
+	// PendingClaims is the number of claims against each pool which are
+	// not bound yet.
+	PendingClaims = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "machine_ipam_controller_pending_claims",
+		Help: "Number of claims against the pool which are not bound yet.",
+	}, []string{"namespace", "pool"})
+)
+
+// SetPoolUsage records the address usage of a pool.
+func SetPoolUsage(namespace, pool string, total, allocated, free int64) {
+	PoolTotalAddresses.WithLabelValues(namespace, pool).Set(float64(total))
+	PoolAllocatedAddresses.WithLabelValues(namespace, pool).Set(float64(allocated))
+	PoolFreeAddresses.WithLabelValues(namespace, pool).Set(float64(free))
+}
+
+// pendingClaim is the pool of a claim which is not bound yet.
+type pendingClaim struct {
+	namespace string
+	pool      string
+}
+
+var (
+	// pendingMu guards pending.
+	pendingMu sync.Mutex
+	pending   = map[string]pendingClaim{}
+)
+
+// SetClaimPending records whether the claim with the given key is waiting
+// for an address from pool.  Claims which are bound or gone are not pending.
+func SetClaimPending(key, namespace, pool string, isPending bool) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	if current, ok := pending[key]; ok {
+		if isPending && current.pool == pool {
+			return
+		}
+		PendingClaims.WithLabelValues(current.namespace, current.pool).Dec()
+		delete(pending, key)
+	}
+	if isPending {
+		pending[key] = pendingClaim{namespace: namespace, pool: pool}
+		PendingClaims.WithLabelValues(namespace, pool).Inc()
+	}
+}
+
+// DeletePool drops every metric of a removed pool, so that a pool created
+// again under the same name starts its counters over.  Claims still waiting
+// for it are reported again as they are reconciled.
+func DeletePool(namespace, pool string) {
+	PoolTotalAddresses.DeleteLabelValues(namespace, pool)
+	PoolAllocatedAddresses.DeleteLabelValues(namespace, pool)
+	PoolFreeAddresses.DeleteLabelValues(namespace, pool)
+	Allocations.DeleteLabelValues(namespace, pool)
+	Releases.DeleteLabelValues(namespace, pool)
+	PoolExhausted.DeleteLabelValues(namespace, pool)
+	BindSeconds.DeleteLabelValues(namespace, pool)
+
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	for key, claim := range pending {
+		if claim.namespace == namespace && claim.pool == pool {
+			delete(pending, key)
+		}
+	}
+	PendingClaims.DeleteLabelValues(namespace, pool)
+}
+
+func init() {
+	metrics.Registry.MustRegister(
+		LeaderElections,
+		StartupSyncSeconds,
+		PoolTotalAddresses,
+		PoolAllocatedAddresses,
+		PoolFreeAddresses,
+		Allocations,
+		Releases,
+		PoolExhausted,
+		BindSeconds,
+		PendingClaims,
+	)
+}
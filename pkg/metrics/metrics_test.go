@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPendingClaims(t *testing.T) {
+	SetClaimPending("ns/a", "ns", "pool", true)
+	SetClaimPending("ns/a", "ns", "pool", true)
+	SetClaimPending("ns/b", "ns", "pool", true)
+	SetClaimPending("ns/c", "ns", "other", true)
+	if got := testutil.ToFloat64(PendingClaims.WithLabelValues("ns", "pool")); got != 2 {
+		t.Errorf("got %v pending claims, want 2", got)
+	}
+
+	SetClaimPending("ns/a", "", "", false)
+	if got := testutil.ToFloat64(PendingClaims.WithLabelValues("ns", "pool")); got != 1 {
+		t.Errorf("got %v pending claims after binding one, want 1", got)
+	}
+
+	// Removing a pool drops its series and forgets its claims.
+	DeletePool("ns", "pool")
+	if got := testutil.CollectAndCount(PendingClaims); got != 1 {
+		t.Errorf("got %v pending claims series, want only the other pool's", got)
+	}
+	if _, ok := pending["ns/b"]; ok {
+		t.Errorf("expected the claims of the removed pool to be forgotten")
+	}
+	SetClaimPending("ns/b", "", "", false)
+	if got := testutil.CollectAndCount(PendingClaims); got != 1 {
+		t.Errorf("got %v pending claims series after releasing a forgotten claim, want 1", got)
+	}
+	if got := testutil.ToFloat64(PendingClaims.WithLabelValues("ns", "other")); got != 1 {
+		t.Errorf("got %v pending claims of the other pool, want 1", got)
+	}
+}
+
+func TestDeletePool(t *testing.T) {
+	for _, pool := range []string{"removed", "kept"} {
+		PoolTotalAddresses.WithLabelValues("ns", pool).Set(10)
+		Allocations.WithLabelValues("ns", pool).Inc()
+		Releases.WithLabelValues("ns", pool).Inc()
+		PoolExhausted.WithLabelValues("ns", pool).Inc()
+		BindSeconds.WithLabelValues("ns", pool).Observe(0.1)
+	}
+
+	DeletePool("ns", "removed")
+	for _, collector := range []prometheus.Collector{PoolTotalAddresses, Allocations, Releases, PoolExhausted, BindSeconds} {
+		if got := testutil.CollectAndCount(collector); got != 1 {
+			t.Errorf("got %v series, want only the kept pool's", got)
+		}
+	}
+	if got := testutil.ToFloat64(Allocations.WithLabelValues("ns", "removed")); got != 0 {
+		t.Errorf("got %v allocations of a pool created again, want 0", got)
+	}
+}
@@ -0,0 +1,49 @@
+package mgmt
+
+import (
+	"context"
+
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+// Allocator hands out the addresses of IPPools.  Pools are identified by
+// their namespace/name key.  Callers serialize the operations on a single
+// pool, while operations on different pools may run in parallel.
+type Allocator interface {
+	// InitializePool loads the pool, or applies changes to a pool which is
+	// already loaded.  It reports whether the pool was loaded from scratch or
+	// rebuilt, in which case the addresses of the pool's IPAddresses have to
+	// be claimed again.
+	InitializePool(ctx context.Context, pool *v1.IPPool) (bool, error)
+
+	// RemovePool drops the pool with the given key along with every address
+	// acquired from it.
+	RemovePool(ctx context.Context, key string) error
+
+	// GetIPAddress acquires the next free address of the claim's pool.
+	GetIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error)
+
+	// GetPairedIPAddress acquires the next free address of the pool paired
+	// with the claim's pool.  Nil is returned when the pool is not paired.
+	GetPairedIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error)
+
+	// ClaimIPAddress acquires the specific address of an existing IPAddress.
+	ClaimIPAddress(ctx context.Context, pool *v1.IPPool, address ipamv1.IPAddress) error
+
+	// ClaimIPAddresses acquires the addresses of existing IPAddresses and
+	// returns the reason an address could not be acquired keyed by the
+	// IPAddress's name.
+	ClaimIPAddresses(ctx context.Context, pool *v1.IPPool, addresses []ipamv1.IPAddress) (map[string]error, error)
+
+	// ReleaseIPConfiguration releases the address of an IPAddress.
+	ReleaseIPConfiguration(ctx context.Context, ipAddr *ipamv1.IPAddress) error
+
+	// GetPoolUsage reports the address usage of a loaded pool.
+	GetPoolUsage(ctx context.Context, pool *v1.IPPool) (*PoolUsage, error)
+
+	// ReleaseUnclaimedAddresses releases the acquired addresses of a pool
+	// which are not in addresses, and returns them.
+	ReleaseUnclaimedAddresses(ctx context.Context, pool *v1.IPPool, addresses []string) ([]string, error)
+}
@@ -0,0 +1,144 @@
+package mgmt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	goipam "github.com/metal-stack/go-ipam"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	StorageMemory   = "memory"
+	StorageEtcd     = "etcd"
+	StorageRedis    = "redis"
+	StoragePostgres = "postgres"
+	StorageMongoDB  = "mongodb"
+
+	// StorageKubernetes keeps the allocator's state in ConfigMaps.
+	StorageKubernetes = "kubernetes"
+)
+
+// StorageConfig holds the connection settings of the allocator's storage
+// backend.
+type StorageConfig struct {
+	// Type is one of memory, kubernetes, etcd, redis, postgres or mongodb.
+	Type string
+
+	// Client and Namespace locate the ConfigMaps of the kubernetes backend.
+	Client    client.Client
+	Namespace string
+
+	Host     string
+	Port     string
+	Username string
+	Password string
+
+	// Database is the postgres or mongodb database holding the prefixes.
+	Database string
+
+	// SSLMode is the postgres sslmode.
+	SSLMode string
+
+	// Cert and Key are the PEM encoded client certificate and key used to
+	// connect to etcd.
+	Cert []byte
+	Key  []byte
+
+	// InsecureSkipVerify disables verification of the etcd server certificate.
+	InsecureSkipVerify bool
+}
+
+// LoadSecret overrides the settings with the keys of a secret mounted at dir.
+// Recognized keys are host, port, username, password, database, sslmode,
+// tls.crt and tls.key.  Missing keys are ignored.
+func (c *StorageConfig) LoadSecret(dir string) error {
+	fields := map[string]*string{
+		"host":     &c.Host,
+		"port":     &c.Port,
+		"username": &c.Username,
+		"password": &c.Password,
+		"database": &c.Database,
+		"sslmode":  &c.SSLMode,
+	}
+	for key, field := range fields {
+		value, err := readSecretKey(dir, key)
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			*field = strings.TrimSpace(string(value))
+		}
+	}
+
+	var err error
+	if c.Cert, err = readSecretKey(dir, "tls.crt"); err != nil {
+		return err
+	}
+	if c.Key, err = readSecretKey(dir, "tls.key"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readSecretKey(dir, key string) ([]byte, error) {
+	value, err := os.ReadFile(filepath.Join(dir, key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// NewStorage connects to the storage backend described by config.
+func NewStorage(ctx context.Context, config StorageConfig) (goipam.Storage, error) {
+	switch config.Type {
+	case "", StorageMemory:
+		return goipam.NewMemory(), nil
+	case StorageKubernetes:
+		return NewKubernetesStorage(config.Client, config.Namespace), nil
+	case StorageEtcd:
+		return goipam.NewEtcd(config.Host, config.Port, config.Cert, config.Key, config.InsecureSkipVerify), nil
+	case StorageRedis:
+		// go-ipam connects to redis without authentication or TLS, so
+		// settings it would silently ignore are refused.
+		if config.Username != "" || config.Password != "" || len(config.Cert) > 0 || len(config.Key) > 0 || config.InsecureSkipVerify {
+			return nil, fmt.Errorf("the %v storage backend supports neither authentication nor TLS", StorageRedis)
+		}
+		return goipam.NewRedis(config.Host, config.Port), nil
+	case StoragePostgres:
+		username, password := postgresCredentials(config)
+		return goipam.NewPostgresStorage(config.Host, config.Port, username, password, config.Database, goipam.SSLMode(config.SSLMode))
+	case StorageMongoDB:
+		return goipam.NewMongo(ctx, goipam.MongoConfig{
+			DatabaseName:       config.Database,
+			CollectionName:     "prefixes",
+			MongoClientOptions: mongoClientOptions(config),
+		})
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", config.Type)
+}
+
+// postgresCredentials escapes the username and password, which go-ipam
+// pastes into the postgres URL as they are.
+func postgresCredentials(config StorageConfig) (string, string) {
+	userinfo := url.UserPassword(config.Username, config.Password).String()
+	username, password, _ := strings.Cut(userinfo, ":")
+	return username, password
+}
+
+func mongoClientOptions(config StorageConfig) *options.ClientOptions {
+	clientOptions := options.Client().ApplyURI("mongodb://" + net.JoinHostPort(config.Host, config.Port))
+	if config.Username != "" {
+		clientOptions.SetAuth(options.Credential{
+			Username: config.Username,
+			Password: config.Password,
+		})
+	}
+	return clientOptions
+}
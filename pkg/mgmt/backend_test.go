@@ -0,0 +1,239 @@
+package mgmt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goipam "github.com/metal-stack/go-ipam"
+	"go.etcd.io/etcd/server/v3/embed"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+// testStorage runs an allocator against storage and checks that a second
+// allocator on the same storage sees its state.
+func testStorage(t *testing.T, storage goipam.Storage) {
+	t.Helper()
+	ctx := context.Background()
+	if err := storage.DeleteAllPrefixes(ctx); err != nil {
+		t.Fatalf("unable to clear storage: %v", err)
+	}
+	defer func() {
+		if err := storage.DeleteAllPrefixes(ctx); err != nil {
+			t.Errorf("unable to clear storage: %v", err)
+		}
+	}()
+
+	pool := &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec:       v1.IPPoolSpec{AddressCidr: "192.168.1.0/29", Prefix: 24},
+	}
+	allocator := NewGoIPAMAllocator(storage)
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+	ip, err := allocator.GetIPAddress(ctx, testClaim(pool, "claim"))
+	if err != nil {
+		t.Fatalf("unable to get address: %v", err)
+	}
+
+	// A restarted allocator adopts the prefix along with the allocation.
+	restarted := NewGoIPAMAllocator(storage)
+	if _, err := restarted.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+	usage, err := restarted.GetPoolUsage(ctx, pool)
+	if err != nil {
+		t.Fatalf("unable to get usage: %v", err)
+	}
+	if usage.Allocated != 1 {
+		t.Errorf("got %v allocated addresses after a restart, want 1", usage.Allocated)
+	}
+	next, err := restarted.GetIPAddress(ctx, testClaim(pool, "other"))
+	if err != nil {
+		t.Fatalf("unable to get address: %v", err)
+	}
+	if next.Spec.Address == ip.Spec.Address {
+		t.Errorf("%v was handed out twice", ip.Spec.Address)
+	}
+
+	if err := restarted.ReleaseIPConfiguration(ctx, ip); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	if err := restarted.RemovePool(ctx, poolKey(pool)); err != nil {
+		t.Fatalf("unable to remove pool: %v", err)
+	}
+	if cidrs, err := storage.ReadAllPrefixCidrs(ctx); err != nil || len(cidrs) != 0 {
+		t.Errorf("got prefixes %v, %v after removing the pool", cidrs, err)
+	}
+}
+
+func TestRedisStorage(t *testing.T) {
+	server := miniredis.RunT(t)
+	host, port, err := net.SplitHostPort(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := NewStorage(context.Background(), StorageConfig{Type: StorageRedis, Host: host, Port: port})
+	if err != nil {
+		t.Fatalf("unable to connect to redis: %v", err)
+	}
+	testStorage(t, storage)
+}
+
+func TestRedisStorageRejectsCredentials(t *testing.T) {
+	for name, config := range map[string]StorageConfig{
+		"password":    {Password: "secret"},
+		"username":    {Username: "ipam"},
+		"certificate": {Cert: []byte("cert"), Key: []byte("key")},
+		"insecure":    {InsecureSkipVerify: true},
+	} {
+		config.Type = StorageRedis
+		config.Host = "localhost"
+		config.Port = "6379"
+		if _, err := NewStorage(context.Background(), config); err == nil {
+			t.Errorf("%v: expected redis settings which can't be applied to be rejected", name)
+		}
+	}
+}
+
+// freePort returns a local port nothing is listening on.
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestEtcdStorage(t *testing.T) {
+	config := embed.NewConfig()
+	config.Dir = t.TempDir()
+	config.LogLevel = "error"
+	port := freePort(t)
+	clientURL, _ := url.Parse("http://127.0.0.1:" + port)
+	peerURL, _ := url.Parse("http://127.0.0.1:" + freePort(t))
+	config.LCUrls, config.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	config.LPUrls, config.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+
+	server, err := embed.StartEtcd(config)
+	if err != nil {
+		t.Fatalf("unable to start etcd: %v", err)
+	}
+	defer server.Close()
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("etcd did not become ready")
+	}
+
+	storage, err := NewStorage(context.Background(), StorageConfig{Type: StorageEtcd, Host: "127.0.0.1", Port: port})
+	if err != nil {
+		t.Fatalf("unable to connect to etcd: %v", err)
+	}
+	testStorage(t, storage)
+}
+
+func TestLoadSecret(t *testing.T) {
+	dir := t.TempDir()
+	for key, value := range map[string]string{
+		"host":     "db.example.com\n",
+		"username": " ipam\n",
+		"password": "p@ss:word\n",
+		"database": "ipam",
+		"tls.crt":  "cert\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, key), []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := StorageConfig{Host: "localhost", Port: "5432", SSLMode: "require"}
+	if err := config.LoadSecret(dir); err != nil {
+		t.Fatalf("unable to load secret: %v", err)
+	}
+	// Values are trimmed, the certificate is taken as it is and keys which
+	// are missing from the secret keep their setting.
+	want := StorageConfig{
+		Host:     "db.example.com",
+		Port:     "5432",
+		Username: "ipam",
+		Password: "p@ss:word",
+		Database: "ipam",
+		SSLMode:  "require",
+		Cert:     []byte("cert\n"),
+	}
+	if fmt.Sprint(config) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", config, want)
+	}
+}
+
+func TestPostgresDataSource(t *testing.T) {
+	config := StorageConfig{
+		Host:     "db.example.com",
+		Port:     "5432",
+		Username: "ipam:admin",
+		Password: "p@ss/word?",
+		Database: "ipam",
+		SSLMode:  "verify-full",
+	}
+	username, password := postgresCredentials(config)
+	// The URL go-ipam builds from the settings.
+	dsn := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?%s", username, password, config.Host, config.Port, config.Database, goipam.SSLMode(config.SSLMode))
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("unable to parse %v: %v", dsn, err)
+	}
+	if parsed.User.Username() != config.Username {
+		t.Errorf("got username %q, want %q", parsed.User.Username(), config.Username)
+	}
+	if got, _ := parsed.User.Password(); got != config.Password {
+		t.Errorf("got password %q, want %q", got, config.Password)
+	}
+	if parsed.Host != "db.example.com:5432" || parsed.Path != "/ipam" || parsed.Query().Get("sslmode") != "verify-full" {
+		t.Errorf("got %v, want db.example.com:5432/ipam with sslmode verify-full", parsed)
+	}
+}
+
+func TestMongoClientOptions(t *testing.T) {
+	options := mongoClientOptions(StorageConfig{Host: "fd00::1", Port: "27017"})
+	if err := options.Validate(); err != nil {
+		t.Fatalf("invalid options: %v", err)
+	}
+	if len(options.Hosts) != 1 || options.Hosts[0] != "[fd00::1]:27017" {
+		t.Errorf("got hosts %v, want [fd00::1]:27017", options.Hosts)
+	}
+	if options.Auth != nil {
+		t.Errorf("expected no credentials without a username, got %+v", options.Auth)
+	}
+
+	options = mongoClientOptions(StorageConfig{Host: "mongo", Port: "27017", Username: "ipam", Password: "secret"})
+	if options.Auth == nil || options.Auth.Username != "ipam" || options.Auth.Password != "secret" {
+		t.Errorf("got credentials %+v, want ipam and secret", options.Auth)
+	}
+}
+
+func TestNewStorageUnknown(t *testing.T) {
+	if _, err := NewStorage(context.Background(), StorageConfig{Type: "cassandra"}); err == nil {
+		t.Errorf("expected an unknown backend to be rejected")
+	}
+	storage, err := NewStorage(context.Background(), StorageConfig{})
+	if err != nil || storage.Name() != goipam.NewMemory().Name() {
+		t.Errorf("expected the memory backend by default, got %v, %v", storage, err)
+	}
+}
@@ -0,0 +1,92 @@
+package mgmt
+
+import (
+	"net/netip"
+	"sync"
+
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+)
+
+// claimedAddresses remembers the IPAddresses a backend was seen holding, so
+// that external backends don't claim them again on every resync of their
+// pool and the go-ipam allocator can tell who an acquired address belongs to.
+// It is dropped along with the pool when the pool is loaded again.  Each
+// address is held by a single IPAddress and each IPAddress holds a single
+// address.
+type claimedAddresses struct {
+	mu sync.Mutex
+	// addresses maps the name of each IPAddress to its address.
+	addresses map[string]string
+	// names maps each address to the name of the IPAddress holding it.
+	names map[string]string
+}
+
+func newClaimedAddresses() *claimedAddresses {
+	return &claimedAddresses{
+		addresses: map[string]string{},
+		names:     map[string]string{},
+	}
+}
+
+// has reports whether the backend was seen holding the address of ipAddr.
+func (c *claimedAddresses) has(ipAddr ipamv1.IPAddress) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	address, ok := c.addresses[ipAddr.Name]
+	return ok && address == canonicalAddress(ipAddr.Spec.Address)
+}
+
+// add records ipAddr as holding its address, in place of the address it held
+// before and of the IPAddress which held the address before.
+func (c *claimedAddresses) add(ipAddr ipamv1.IPAddress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	address := canonicalAddress(ipAddr.Spec.Address)
+	if previous, ok := c.addresses[ipAddr.Name]; ok {
+		delete(c.names, previous)
+	}
+	if previous, ok := c.names[address]; ok {
+		delete(c.addresses, previous)
+	}
+	c.addresses[ipAddr.Name] = address
+	c.names[address] = ipAddr.Name
+}
+
+// forget forgets ipAddr, unless the backend was seen holding another address
+// for it.
+func (c *claimedAddresses) forget(ipAddr ipamv1.IPAddress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	address := canonicalAddress(ipAddr.Spec.Address)
+	if c.addresses[ipAddr.Name] == address {
+		delete(c.addresses, ipAddr.Name)
+		delete(c.names, address)
+	}
+}
+
+// owner returns the name of the IPAddress holding address, if any.
+func (c *claimedAddresses) owner(address string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.names[canonicalAddress(address)]
+	return name, ok
+}
+
+// remove forgets the IPAddress holding address.
+func (c *claimedAddresses) remove(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	address = canonicalAddress(address)
+	if name, ok := c.names[address]; ok {
+		delete(c.addresses, name)
+		delete(c.names, address)
+	}
+}
+
+// canonicalAddress returns address in its canonical form, if it is valid.
+func canonicalAddress(address string) string {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		return addr.String()
+	}
+	return address
+}
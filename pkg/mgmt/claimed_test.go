@@ -0,0 +1,45 @@
+package mgmt
+
+import (
+	"testing"
+
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+)
+
+func TestClaimedAddresses(t *testing.T) {
+	ipAddress := func(name, address string) ipamv1.IPAddress {
+		ip := ipamv1.IPAddress{}
+		ip.Name = name
+		ip.Spec.Address = address
+		return ip
+	}
+	claimed := newClaimedAddresses()
+	claimed.add(ipAddress("a", "fd00::0:1"))
+	if name, ok := claimed.owner("fd00::1"); !ok || name != "a" || !claimed.has(ipAddress("a", "fd00::1")) {
+		t.Errorf("got owner %q, %v, want a", name, ok)
+	}
+
+	// Moving an IPAddress to another address frees the old one.
+	claimed.add(ipAddress("a", "fd00::2"))
+	if _, ok := claimed.owner("fd00::1"); ok {
+		t.Errorf("expected the old address to be freed")
+	}
+
+	// Another IPAddress taking the address replaces its holder.
+	claimed.add(ipAddress("b", "fd00::2"))
+	if claimed.has(ipAddress("a", "fd00::2")) {
+		t.Errorf("expected a to be replaced by b")
+	}
+
+	// Forgetting an IPAddress which doesn't hold the address keeps it.
+	claimed.forget(ipAddress("a", "fd00::2"))
+	if name, _ := claimed.owner("fd00::2"); name != "b" {
+		t.Errorf("got owner %q, want b", name)
+	}
+	claimed.forget(ipAddress("b", "fd00::2"))
+	claimed.add(ipAddress("c", "fd00::3"))
+	claimed.remove("fd00::3")
+	if len(claimed.addresses) != 0 || len(claimed.names) != 0 {
+		t.Errorf("got %v and %v left, want nothing", claimed.addresses, claimed.names)
+	}
+}
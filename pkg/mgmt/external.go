@@ -0,0 +1,302 @@
+package mgmt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+const (
+	// BackendInfoblox is the backend of pools handing out addresses from
+	// Infoblox.
+	BackendInfoblox = "infoblox"
+
+	// BackendNetBox is the backend of pools handing out addresses from NetBox.
+	BackendNetBox = "netbox"
+
+	// BackendHTTP is the backend of pools handing out addresses from an
+	// external allocator implementing the HTTP protocol.
+	BackendHTTP = "http"
+)
+
+// externalTimeout bounds every request to an external backend.
+const externalTimeout = 30 * time.Second
+
+// PoolBackend returns the name of the external backend serving the pool, or
+// an empty string for pools served by the built-in allocator.
+func PoolBackend(spec v1.IPPoolSpec) string {
+	switch {
+	case spec.Infoblox != nil:
+		return BackendInfoblox
+	case spec.NetBox != nil:
+		return BackendNetBox
+	case spec.HTTP != nil:
+		return BackendHTTP
+	}
+	return ""
+}
+
+// dispatchedPool is a pool loaded into the allocator serving it.
+type dispatchedPool struct {
+	pool      *v1.IPPool
+	allocator Allocator
+}
+
+// dispatcher hands every pool to the allocator of its backend.
+type dispatcher struct {
+	defaultAllocator Allocator
+	backends         map[string]Allocator
+
+	// mu guards pools.
+	mu    sync.RWMutex
+	pools map[string]dispatchedPool
+}
+
+// NewDispatcher returns an allocator which serves pools configured for an
+// external backend with the allocator registered under the backend's name in
+// backends, and every other pool with defaultAllocator.
+func NewDispatcher(defaultAllocator Allocator, backends map[string]Allocator) Allocator {
+	return &dispatcher{
+		defaultAllocator: defaultAllocator,
+		backends:         backends,
+		pools:            make(map[string]dispatchedPool),
+	}
+}
+
+func (d *dispatcher) allocatorFor(spec v1.IPPoolSpec) (Allocator, error) {
+	backend := PoolBackend(spec)
+	if backend == "" {
+		return d.defaultAllocator, nil
+	}
+	allocator, ok := d.backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("the %v backend is not enabled", backend)
+	}
+	return allocator, nil
+}
+
+func (d *dispatcher) loaded(key string) (dispatchedPool, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	loaded, ok := d.pools[key]
+	return loaded, ok
+}
+
+func (d *dispatcher) InitializePool(ctx context.Context, pool *v1.IPPool) (bool, error) {
+	key := poolKey(pool)
+	allocator, err := d.allocatorFor(pool.Spec)
+	if err != nil {
+		return false, err
+	}
+
+	// A pool moved to another backend is dropped from the old one first.
+	if current, ok := d.loaded(key); ok && current.allocator != allocator {
+		if err := d.RemovePool(ctx, key); err != nil {
+			return false, err
+		}
+	}
+	rebuilt, err := allocator.InitializePool(ctx, pool)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pools[key] = dispatchedPool{pool: pool, allocator: allocator}
+	return rebuilt, nil
+}
+
+func (d *dispatcher) RemovePool(ctx context.Context, key string) error {
+	current, ok := d.loaded(key)
+	if !ok {
+		return d.defaultAllocator.RemovePool(ctx, key)
+	}
+	if err := current.allocator.RemovePool(ctx, key); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pools, key)
+	return nil
+}
+
+func (d *dispatcher) poolFor(namespace, name string) (dispatchedPool, error) {
+	loaded, ok := d.loaded(fmt.Sprintf("%v/%v", namespace, name))
+	if !ok {
+		return dispatchedPool{}, fmt.Errorf("pool %v: %w", name, ErrPoolNotInitialized)
+	}
+	return loaded, nil
+}
+
+func (d *dispatcher) GetIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	loaded, err := d.poolFor(ipClaim.Namespace, ipClaim.Spec.PoolRef.Name)
+	if err != nil {
+		return nil, err
+	}
+	return loaded.allocator.GetIPAddress(ctx, ipClaim)
+}
+
+// GetPairedIPAddress acquires the address from the paired pool as if it was
+// claimed by a claim named after the paired IPAddress, so that the pools
+// can be served by different backends.
+func (d *dispatcher) GetPairedIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	loaded, err := d.poolFor(ipClaim.Namespace, ipClaim.Spec.PoolRef.Name)
+	if err != nil {
+		return nil, err
+	}
+	pairedPool := loaded.pool.Spec.PairedPool
+	if pairedPool == "" {
+		return nil, nil
+	}
+	paired, err := d.poolFor(ipClaim.Namespace, pairedPool)
+	if err != nil {
+		return nil, fmt.Errorf("paired pool %v: %w", pairedPool, err)
+	}
+
+	ipv6, err := PoolIPv6(loaded.pool.Spec)
+	if err != nil {
+		return nil, err
+	}
+	pairedIPv6, err := PoolIPv6(paired.pool.Spec)
+	if err != nil {
+		return nil, err
+	}
+	if ipv6 == pairedIPv6 {
+		return nil, fmt.Errorf("paired pool %v has the same IP family as pool %v", pairedPool, loaded.pool.Name)
+	}
+
+	pairedClaim := ipClaim.DeepCopy()
+	pairedClaim.Name = PairedAddressName(ipClaim.Name, pairedIPv6)
+	pairedClaim.Spec.PoolRef.Name = pairedPool
+	ipAddress, err := paired.allocator.GetIPAddress(ctx, pairedClaim)
+	if err != nil {
+		return nil, err
+	}
+	ipAddress.Spec.ClaimRef.Name = ipClaim.Name
+	return ipAddress, nil
+}
+
+func (d *dispatcher) ClaimIPAddress(ctx context.Context, pool *v1.IPPool, address ipamv1.IPAddress) error {
+	loaded, err := d.poolFor(pool.Namespace, pool.Name)
+	if err != nil {
+		return err
+	}
+	return loaded.allocator.ClaimIPAddress(ctx, pool, address)
+}
+
+func (d *dispatcher) ClaimIPAddresses(ctx context.Context, pool *v1.IPPool, addresses []ipamv1.IPAddress) (map[string]error, error) {
+	loaded, err := d.poolFor(pool.Namespace, pool.Name)
+	if err != nil {
+		return nil, err
+	}
+	return loaded.allocator.ClaimIPAddresses(ctx, pool, addresses)
+}
+
+func (d *dispatcher) ReleaseIPConfiguration(ctx context.Context, ipAddr *ipamv1.IPAddress) error {
+	loaded, err := d.poolFor(ipAddr.Namespace, ipAddr.Spec.PoolRef.Name)
+	if err != nil {
+		return err
+	}
+	return loaded.allocator.ReleaseIPConfiguration(ctx, ipAddr)
+}
+
+func (d *dispatcher) GetPoolUsage(ctx context.Context, pool *v1.IPPool) (*PoolUsage, error) {
+	loaded, err := d.poolFor(pool.Namespace, pool.Name)
+	if err != nil {
+		return nil, err
+	}
+	return loaded.allocator.GetPoolUsage(ctx, pool)
+}
+
+func (d *dispatcher) ReleaseUnclaimedAddresses(ctx context.Context, pool *v1.IPPool, addresses []string) ([]string, error) {
+	loaded, err := d.poolFor(pool.Namespace, pool.Name)
+	if err != nil {
+		return nil, err
+	}
+	return loaded.allocator.ReleaseUnclaimedAddresses(ctx, pool, addresses)
+}
+
+// credentials is the content of a secret referenced by a pool.
+type credentials map[string][]byte
+
+// readCredentials reads the secret name in the pool's namespace and returns
+// its content along with its resourceVersion.
+func readCredentials(ctx context.Context, reader client.Reader, pool *v1.IPPool, name string) (credentials, string, error) {
+	if name == "" {
+		return nil, "", fmt.Errorf("pool %v does not reference a credentials secret", pool.Name)
+	}
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: pool.Namespace, Name: name}, secret); err != nil {
+		return nil, "", fmt.Errorf("unable to read credentials secret %v: %w", name, err)
+	}
+	return secret.Data, secret.ResourceVersion, nil
+}
+
+func (c credentials) get(key string) string {
+	return strings.TrimSpace(string(c[key]))
+}
+
+// httpClient returns a client for an external backend trusting the ca.crt
+// of the credentials, if any, in addition to the system's roots.  The client
+// authenticates with the tls.crt and tls.key of the credentials, if any.
+func (c credentials) httpClient(insecureSkipVerify bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if ca := c["ca.crt"]; len(ca) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("ca.crt holds no valid certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cert, key := c["tls.crt"], c["tls.key"]; len(cert) > 0 && len(key) > 0 {
+		keyPair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport: transport,
+		Timeout:   externalTimeout,
+	}, nil
+}
+
+// ClaimMachine returns the name of the machine owning the claim, if any.
+func ClaimMachine(ipClaim *ipamv1.IPAddressClaim) string {
+	for _, owner := range ipClaim.OwnerReferences {
+		if owner.Kind == "Machine" {
+			return owner.Name
+		}
+	}
+	return ""
+}
+
+// baseURL returns host as a URL, defaulting to https.
+func baseURL(host string) string {
+	host = strings.TrimSuffix(host, "/")
+	if strings.Contains(host, "://") {
+		return host
+	}
+	return "https://" + host
+}
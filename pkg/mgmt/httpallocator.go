@@ -0,0 +1,548 @@
+package mgmt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go4.org/netipx"
+	"k8s.io/apimachinery/pkg/api/equality"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+const (
+	httpDefaultRetries = 3
+
+	// httpMaxBackoff bounds the wait between two attempts of a request.
+	httpMaxBackoff = 5 * time.Second
+)
+
+// httpPool is a pool loaded into the HTTP allocator.
+type httpPool struct {
+	pool      *v1.IPPool
+	client    *httpAllocatorClient
+	addresses netipx.IPRange
+
+	// secretVersion is the resourceVersion of the credentials secret the
+	// client was built from, if any.
+	secretVersion string
+
+	// claimed holds the IPAddresses known to be held by the allocator.
+	claimed *claimedAddresses
+
+	// pruned is true once the addresses of deleted IPAddresses have been
+	// released.
+	pruned bool
+}
+
+// HTTPAllocator hands out the addresses of pools from external allocators
+// implementing the controller's HTTP protocol.  See README.md for the
+// protocol.
+type HTTPAllocator struct {
+	// secrets reads the credentials of the pools.
+	secrets client.Reader
+
+	// mu guards pools.
+	mu    sync.RWMutex
+	pools map[string]httpPool
+}
+
+var _ Allocator = &HTTPAllocator{}
+
+// NewHTTPAllocator returns an allocator for pools configured for an external
+// HTTP allocator.  Credentials are read with secrets.
+func NewHTTPAllocator(secrets client.Reader) *HTTPAllocator {
+	return &HTTPAllocator{
+		secrets: secrets,
+		pools:   make(map[string]httpPool),
+	}
+}
+
+// httpAllocateRequest is the body of an allocate request.
+type httpAllocateRequest struct {
+	Namespace string `json:"namespace"`
+	Pool      string `json:"pool"`
+	Name      string `json:"name"`
+	Claim     string `json:"claim"`
+	Machine   string `json:"machine,omitempty"`
+	Address   string `json:"address,omitempty"`
+}
+
+// httpAllocateResponse is the body of the response to an allocate request.
+type httpAllocateResponse struct {
+	Address string `json:"address"`
+}
+
+// httpReleaseRequest is the body of a release request.
+type httpReleaseRequest struct {
+	Namespace string `json:"namespace"`
+	Pool      string `json:"pool"`
+	Name      string `json:"name"`
+	Claim     string `json:"claim,omitempty"`
+	Address   string `json:"address"`
+}
+
+// httpAddressesResponse is the body of the response to an addresses request.
+type httpAddressesResponse struct {
+	Addresses []struct {
+		Address string `json:"address"`
+		Name    string `json:"name"`
+	} `json:"addresses"`
+	Total    int64 `json:"total,omitempty"`
+	Reserved int64 `json:"reserved,omitempty"`
+}
+
+func (a *HTTPAllocator) loadedPool(key string) (httpPool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	loaded, ok := a.pools[key]
+	if !ok {
+		return httpPool{}, ErrPoolNotInitialized
+	}
+	return loaded, nil
+}
+
+// InitializePool reads the pool's credentials and checks that the allocator
+// serves the pool.  A loaded pool is only loaded again when its HTTP settings
+// or its credentials change.
+func (a *HTTPAllocator) InitializePool(ctx context.Context, pool *v1.IPPool) (bool, error) {
+	config := pool.Spec.HTTP
+	if config == nil {
+		return false, fmt.Errorf("pool %v is not configured for an HTTP allocator", pool.Name)
+	}
+	addressRange, err := ParseAddressRange(config.Network)
+	if err != nil {
+		return false, fmt.Errorf("invalid network %v: %w", config.Network, err)
+	}
+
+	creds := credentials{}
+	secretVersion := ""
+	if config.CredentialsSecret != "" {
+		if creds, secretVersion, err = readCredentials(ctx, a.secrets, pool, config.CredentialsSecret); err != nil {
+			return false, err
+		}
+	}
+
+	key := poolKey(pool)
+	a.mu.Lock()
+	if current, ok := a.pools[key]; ok && current.secretVersion == secretVersion && equality.Semantic.DeepEqual(current.pool.Spec.HTTP, config) {
+		current.pool = pool
+		a.pools[key] = current
+		a.mu.Unlock()
+		return false, nil
+	}
+	a.mu.Unlock()
+
+	httpClient, err := creds.httpClient(config.InsecureSkipVerify)
+	if err != nil {
+		return false, err
+	}
+	if config.TimeoutSeconds > 0 {
+		httpClient.Timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	retries := httpDefaultRetries
+	if config.Retries != nil {
+		retries = *config.Retries
+	}
+	loaded := httpPool{
+		pool: pool,
+		client: &httpAllocatorClient{
+			http:    httpClient,
+			url:     baseURL(config.URL),
+			token:   creds.get("token"),
+			retries: retries,
+		},
+		addresses:     addressRange.IPRange,
+		secretVersion: secretVersion,
+		claimed:       newClaimedAddresses(),
+	}
+	if _, err := loaded.client.addresses(ctx, pool); err != nil {
+		return false, fmt.Errorf("unable to reach the allocator of pool %v: %w", pool.Name, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	current, ok := a.pools[key]
+	loaded.pruned = ok && current.pruned && equality.Semantic.DeepEqual(current.pool.Spec.HTTP, config)
+	a.pools[key] = loaded
+	return true, nil
+}
+
+// RemovePool forgets the pool.  Its addresses are released as its
+// IPAddresses are released.
+func (a *HTTPAllocator) RemovePool(ctx context.Context, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pools, key)
+	return nil
+}
+
+// GetIPAddress asks the allocator for an address for the claim.
+func (a *HTTPAllocator) GetIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	loaded, err := a.loadedPool(fmt.Sprintf("%v/%v", ipClaim.Namespace, ipClaim.Spec.PoolRef.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := loaded.allocate(ctx, httpAllocateRequest{
+		Namespace: ipClaim.Namespace,
+		Pool:      loaded.pool.Name,
+		Name:      ipClaim.Name,
+		Claim:     ipClaim.Name,
+		Machine:   ClaimMachine(ipClaim),
+	})
+	var httpErr *httpAllocatorError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict {
+		return nil, fmt.Errorf("%w: no addresses left in pool %v: %v", ErrPoolExhausted, loaded.pool.Name, httpErr.Message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("HTTP allocator handed out IP %v for pool %v", address, loaded.pool.Name)
+
+	ipAddress := NewIPAddress(ipClaim, loaded.pool, ipClaim.Name, address.String())
+	loaded.claimed.add(*ipAddress)
+	return ipAddress, nil
+}
+
+// GetPairedIPAddress is not supported, pairing is handled by the dispatcher.
+func (a *HTTPAllocator) GetPairedIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	return nil, errors.New("paired pools are only supported through the dispatcher")
+}
+
+// ClaimIPAddress asks the allocator for the address of an existing
+// IPAddress.
+func (a *HTTPAllocator) ClaimIPAddress(ctx context.Context, pool *v1.IPPool, address ipamv1.IPAddress) error {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return err
+	}
+	if err := loaded.claim(ctx, address); err != nil {
+		return err
+	}
+	loaded.claimed.add(address)
+	return nil
+}
+
+// ClaimIPAddresses claims the addresses of IPAddresses the allocator doesn't
+// hold for them yet.  The allocator is not asked at all when every IPAddress
+// is known to be held already.
+func (a *HTTPAllocator) ClaimIPAddresses(ctx context.Context, pool *v1.IPPool, addresses []ipamv1.IPAddress) (map[string]error, error) {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return nil, err
+	}
+	failures := map[string]error{}
+	var unclaimed []ipamv1.IPAddress
+	for _, address := range addresses {
+		if !loaded.claimed.has(address) {
+			unclaimed = append(unclaimed, address)
+		}
+	}
+	if len(unclaimed) == 0 {
+		return failures, nil
+	}
+
+	held, err := loaded.client.addresses(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	heldBy := map[string]string{}
+	for _, address := range held.Addresses {
+		if addr, err := netip.ParseAddr(address.Address); err == nil {
+			heldBy[addr.String()] = address.Name
+		}
+	}
+
+	for _, address := range unclaimed {
+		if addr, err := netip.ParseAddr(address.Spec.Address); err == nil && heldBy[addr.String()] == address.Name && loaded.addresses.Contains(addr) {
+			loaded.claimed.add(address)
+			continue
+		}
+		if err := loaded.claim(ctx, address); err != nil {
+			failures[address.Name] = err
+			continue
+		}
+		loaded.claimed.add(address)
+	}
+	return failures, nil
+}
+
+// ReleaseIPConfiguration asks the allocator to release the address held for
+// the IPAddress.  An address the allocator holds for another name is
+// reported as in use and kept.
+func (a *HTTPAllocator) ReleaseIPConfiguration(ctx context.Context, ipAddr *ipamv1.IPAddress) error {
+	loaded, err := a.loadedPool(fmt.Sprintf("%v/%v", ipAddr.Namespace, ipAddr.Spec.PoolRef.Name))
+	if err != nil {
+		return err
+	}
+	parsedIP, err := netip.ParseAddr(ipAddr.Spec.Address)
+	if err != nil {
+		return err
+	}
+	if err := loaded.release(ctx, parsedIP, ipAddr.Name, ipAddr.Spec.ClaimRef.Name); err != nil {
+		return err
+	}
+	loaded.claimed.forget(*ipAddr)
+	return nil
+}
+
+// GetPoolUsage counts the addresses the allocator holds for the pool.
+func (a *HTTPAllocator) GetPoolUsage(ctx context.Context, pool *v1.IPPool) (*PoolUsage, error) {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return nil, err
+	}
+	held, err := loaded.client.addresses(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &PoolUsage{
+		Total:    held.Total,
+		Reserved: held.Reserved,
+	}
+	if usage.Total == 0 {
+		usage.Total = rangeSize(loaded.addresses)
+	}
+	for _, address := range held.Addresses {
+		if addr, err := netip.ParseAddr(address.Address); err == nil && loaded.addresses.Contains(addr) {
+			usage.Allocated++
+		}
+	}
+	return usage, nil
+}
+
+// ReleaseUnclaimedAddresses releases the addresses the allocator holds for
+// the pool inside its network which are not in addresses.  It only looks for
+// them once after the pool is loaded.
+func (a *HTTPAllocator) ReleaseUnclaimedAddresses(ctx context.Context, pool *v1.IPPool, addresses []string) ([]string, error) {
+	key := poolKey(pool)
+	loaded, err := a.loadedPool(key)
+	if err != nil {
+		return nil, err
+	}
+	if loaded.pruned {
+		return nil, nil
+	}
+
+	inUse := map[netip.Addr]bool{}
+	for _, address := range addresses {
+		if addr, err := netip.ParseAddr(address); err == nil {
+			inUse[addr] = true
+		}
+	}
+	held, err := loaded.client.addresses(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	for _, address := range held.Addresses {
+		addr, err := netip.ParseAddr(address.Address)
+		if err != nil || !loaded.addresses.Contains(addr) || inUse[addr] {
+			continue
+		}
+		if err := loaded.release(ctx, addr, address.Name, ""); err != nil {
+			return released, err
+		}
+		loaded.claimed.remove(addr.String())
+		log.Infof("Released unclaimed IP %v from the HTTP allocator of pool %v", addr, pool.Name)
+		released = append(released, addr.String())
+	}
+
+	a.mu.Lock()
+	if current, ok := a.pools[key]; ok {
+		current.pruned = true
+		a.pools[key] = current
+	}
+	a.mu.Unlock()
+	return released, nil
+}
+
+// allocate sends an allocate request and checks the address handed out.
+func (p httpPool) allocate(ctx context.Context, request httpAllocateRequest) (netip.Addr, error) {
+	var response httpAllocateResponse
+	if err := p.client.do(ctx, http.MethodPost, "allocate", nil, request, &response); err != nil {
+		return netip.Addr{}, err
+	}
+	address, err := netip.ParseAddr(response.Address)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("allocator of pool %v returned an invalid address %q", p.pool.Name, response.Address)
+	}
+	if !p.addresses.Contains(address) {
+		return netip.Addr{}, fmt.Errorf("%w: allocator of pool %v returned address %v outside of %v", ErrAddressOutOfRange, p.pool.Name, address, p.addresses)
+	}
+	return address, nil
+}
+
+// claim asks the allocator to hold the address of an existing IPAddress.
+func (p httpPool) claim(ctx context.Context, address ipamv1.IPAddress) error {
+	parsedIP, err := netip.ParseAddr(address.Spec.Address)
+	if err != nil {
+		return err
+	}
+	if !p.addresses.Contains(parsedIP) {
+		return fmt.Errorf("%w: address %v is not in network %v of pool %v", ErrAddressOutOfRange, parsedIP, p.addresses, p.pool.Name)
+	}
+
+	allocated, err := p.allocate(ctx, httpAllocateRequest{
+		Namespace: address.Namespace,
+		Pool:      p.pool.Name,
+		Name:      address.Name,
+		Claim:     address.Spec.ClaimRef.Name,
+		Address:   parsedIP.String(),
+	})
+	var httpErr *httpAllocatorError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%w: address %v is held by the allocator of pool %v: %v", ErrAddressInUse, parsedIP, p.pool.Name, httpErr.Message)
+	}
+	if err != nil {
+		return err
+	}
+	if allocated != parsedIP {
+		return fmt.Errorf("allocator of pool %v returned %v instead of %v", p.pool.Name, allocated, parsedIP)
+	}
+	return nil
+}
+
+// release asks the allocator to release address, held for the IPAddress
+// name of claim.
+func (p httpPool) release(ctx context.Context, address netip.Addr, name, claim string) error {
+	err := p.client.do(ctx, http.MethodPost, "release", nil, httpReleaseRequest{
+		Namespace: p.pool.Namespace,
+		Pool:      p.pool.Name,
+		Name:      name,
+		Claim:     claim,
+		Address:   address.String(),
+	}, nil)
+	var httpErr *httpAllocatorError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusNotFound:
+			return nil
+		case http.StatusConflict:
+			return fmt.Errorf("%w: address %v is held by the allocator of pool %v for another name: %v", ErrAddressInUse, address, p.pool.Name, httpErr.Message)
+		}
+	}
+	return err
+}
+
+// httpAllocatorError is an error returned by an external allocator.
+type httpAllocatorError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *httpAllocatorError) Error() string {
+	return fmt.Sprintf("allocator returned %v: %v", e.StatusCode, e.Message)
+}
+
+// retryable reports whether the request may succeed when sent again.
+func (e *httpAllocatorError) retryable() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests
+}
+
+// httpAllocatorClient calls the endpoints of an external allocator.
+type httpAllocatorClient struct {
+	http    *http.Client
+	url     string
+	token   string
+	retries int
+}
+
+func (c *httpAllocatorClient) addresses(ctx context.Context, pool *v1.IPPool) (*httpAddressesResponse, error) {
+	response := &httpAddressesResponse{}
+	err := c.do(ctx, http.MethodGet, "addresses", url.Values{
+		"namespace": {pool.Namespace},
+		"pool":      {pool.Name},
+	}, nil, response)
+	return response, err
+}
+
+// do sends a request for path, relative to the allocator's URL, and decodes
+// the response into out.  Requests failing with a connection error or a 5xx
+// status are retried with an exponential backoff.
+func (c *httpAllocatorClient) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	requestURL := c.url + "/" + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, requestURL, encoded, out)
+		var httpErr *httpAllocatorError
+		if err == nil || attempt >= c.retries || ctx.Err() != nil || (errors.As(err, &httpErr) && !httpErr.retryable()) {
+			return err
+		}
+		log.Warnf("Request to allocator %v failed, retrying in %v: %v", requestURL, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > httpMaxBackoff {
+			backoff = httpMaxBackoff
+		}
+	}
+}
+
+func (c *httpAllocatorClient) send(ctx context.Context, method, requestURL string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		httpErr := &httpAllocatorError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &message); err == nil && message.Error != "" {
+			httpErr.Message = message.Error
+		}
+		return httpErr
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,200 @@
+package mgmt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+// fakeHTTPAllocator implements the HTTP allocator protocol for a single pool
+// without checking the addresses it is asked for against any network.
+type fakeHTTPAllocator struct {
+	mu       sync.Mutex
+	held     map[string]string
+	requests map[string]int
+}
+
+func newFakeHTTPAllocator() *fakeHTTPAllocator {
+	return &fakeHTTPAllocator{
+		held:     map[string]string{},
+		requests: map[string]int{},
+	}
+}
+
+func (f *fakeHTTPAllocator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.URL.Path]++
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/addresses":
+		response := httpAddressesResponse{}
+		for address, name := range f.held {
+			response.Addresses = append(response.Addresses, struct {
+				Address string `json:"address"`
+				Name    string `json:"name"`
+			}{address, name})
+		}
+		_ = json.NewEncoder(w).Encode(response)
+
+	case "/allocate":
+		var request httpAllocateRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Address == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if name, ok := f.held[request.Address]; ok && name != request.Name {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "held by " + name})
+			return
+		}
+		f.held[request.Address] = request.Name
+		_ = json.NewEncoder(w).Encode(httpAllocateResponse{Address: request.Address})
+
+	case "/release":
+		var request httpReleaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if name, ok := f.held[request.Address]; ok && name != request.Name {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "held by " + name})
+			return
+		}
+		delete(f.held, request.Address)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newHTTPAllocatorTest(t *testing.T, server *fakeHTTPAllocator) (*HTTPAllocator, *v1.IPPool) {
+	t.Helper()
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	pool := &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec: v1.IPPoolSpec{
+			Prefix: 24,
+			HTTP: &v1.HTTPAllocatorConfig{
+				URL:     httpServer.URL,
+				Network: "10.6.0.0/24",
+			},
+		},
+	}
+	return NewHTTPAllocator(fake.NewClientBuilder().Build()), pool
+}
+
+func TestHTTPAllocatorClaimIPAddresses(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeHTTPAllocator()
+	server.held["10.6.0.1"] = "held"
+	server.held["10.6.0.2"] = "other"
+	allocator, pool := newHTTPAllocatorTest(t, server)
+	if rebuilt, err := allocator.InitializePool(ctx, pool); err != nil || !rebuilt {
+		t.Fatalf("unable to initialize pool: %v, %v", rebuilt, err)
+	}
+	if rebuilt, err := allocator.InitializePool(ctx, pool.DeepCopy()); err != nil || rebuilt {
+		t.Errorf("expected the unchanged pool to be kept, got %v, %v", rebuilt, err)
+	}
+	if server.requests["/addresses"] != 1 {
+		t.Errorf("got %v requests for the addresses, want 1", server.requests["/addresses"])
+	}
+
+	ipAddress := func(name, address string) ipamv1.IPAddress {
+		return *NewIPAddress(testClaim(pool, name), pool, name, address)
+	}
+	addresses := []ipamv1.IPAddress{
+		ipAddress("held", "10.6.0.1"),
+		ipAddress("stolen", "10.6.0.2"),
+		ipAddress("free", "10.6.0.3"),
+		ipAddress("outside", "10.7.0.1"),
+	}
+	failures, err := allocator.ClaimIPAddresses(ctx, pool, addresses)
+	if err != nil {
+		t.Fatalf("unable to claim addresses: %v", err)
+	}
+	if !errors.Is(failures["stolen"], ErrAddressInUse) || !errors.Is(failures["outside"], ErrAddressOutOfRange) || len(failures) != 2 {
+		t.Errorf("got failures %v, want stolen in use and outside out of range", failures)
+	}
+	if server.held["10.6.0.3"] != "free" {
+		t.Errorf("expected the free address to be allocated, got %v", server.held)
+	}
+
+	// Claimed addresses are not sent to the allocator again.
+	server.requests = map[string]int{}
+	failures, err = allocator.ClaimIPAddresses(ctx, pool, []ipamv1.IPAddress{addresses[0], addresses[2]})
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("unable to claim addresses: %v, %v", failures, err)
+	}
+	if len(server.requests) != 0 {
+		t.Errorf("got requests %v for claimed addresses, want none", server.requests)
+	}
+}
+
+func TestHTTPAllocatorReleaseUnclaimedAddresses(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeHTTPAllocator()
+	server.held["10.6.0.1"] = "kept"
+	server.held["10.6.0.2"] = "gone"
+	// The allocator serves other networks under the same pool name.
+	server.held["10.7.0.1"] = "elsewhere"
+	allocator, pool := newHTTPAllocatorTest(t, server)
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+
+	released, err := allocator.ReleaseUnclaimedAddresses(ctx, pool, []string{"10.6.0.1"})
+	if err != nil {
+		t.Fatalf("unable to release unclaimed addresses: %v", err)
+	}
+	if len(released) != 1 || released[0] != "10.6.0.2" {
+		t.Errorf("got %v released, want only 10.6.0.2", released)
+	}
+	if _, ok := server.held["10.7.0.1"]; !ok {
+		t.Errorf("expected the address outside of the pool's network to be kept")
+	}
+}
+
+func TestHTTPAllocatorReleaseDuplicate(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeHTTPAllocator()
+	allocator, pool := newHTTPAllocatorTest(t, server)
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+	held := NewIPAddress(testClaim(pool, "held"), pool, "held", "10.6.0.1")
+	if err := allocator.ClaimIPAddress(ctx, pool, *held); err != nil {
+		t.Fatalf("unable to claim address: %v", err)
+	}
+
+	duplicate := NewIPAddress(testClaim(pool, "duplicate"), pool, "duplicate", held.Spec.Address)
+	if err := allocator.ReleaseIPConfiguration(ctx, duplicate); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("expected the address held for another name to be in use, got %v", err)
+	}
+	if server.held[held.Spec.Address] != "held" {
+		t.Errorf("expected the address to stay held, got %v", server.held)
+	}
+	if !allocator.pools["ns/pool"].claimed.has(*held) {
+		t.Errorf("expected the holding IPAddress to stay claimed")
+	}
+
+	if err := allocator.ReleaseIPConfiguration(ctx, held); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	if len(server.held) != 0 {
+		t.Errorf("got addresses %v left, want none", server.held)
+	}
+}
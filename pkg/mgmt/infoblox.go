@@ -0,0 +1,698 @@
+package mgmt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go4.org/netipx"
+	"k8s.io/apimachinery/pkg/api/equality"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+const (
+	infobloxDefaultWAPIVersion = "v2.12"
+	infobloxDefaultNetworkView = "default"
+
+	// infobloxCommentPrefix marks the host records created by the controller.
+	// Host records without it are never deleted.
+	infobloxCommentPrefix = "Allocated by machine-ipam-controller for IPAddressClaim "
+
+	infobloxPageSize = 1000
+)
+
+// infobloxPool is a pool loaded into the Infoblox allocator.
+type infobloxPool struct {
+	pool    *v1.IPPool
+	client  *infobloxClient
+	network netip.Prefix
+
+	// secretVersion is the resourceVersion of the credentials secret the
+	// client was built from.
+	secretVersion string
+
+	// claimed holds the IPAddresses known to be held by their host records.
+	claimed *claimedAddresses
+
+	// pruned is true once the host records of deleted IPAddresses have been
+	// released.
+	pruned bool
+}
+
+// InfobloxAllocator hands out the addresses of pools from Infoblox networks
+// through the WAPI.  Every address is held by a host record, created when the
+// address is handed out and deleted when it is released.
+type InfobloxAllocator struct {
+	// secrets reads the credentials of the pools.
+	secrets client.Reader
+
+	// mu guards pools.
+	mu    sync.RWMutex
+	pools map[string]infobloxPool
+}
+
+var _ Allocator = &InfobloxAllocator{}
+
+// NewInfobloxAllocator returns an allocator for pools configured for
+// Infoblox.  Credentials are read with secrets.
+func NewInfobloxAllocator(secrets client.Reader) *InfobloxAllocator {
+	return &InfobloxAllocator{
+		secrets: secrets,
+		pools:   make(map[string]infobloxPool),
+	}
+}
+
+func (a *InfobloxAllocator) loadedPool(key string) (infobloxPool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	loaded, ok := a.pools[key]
+	if !ok {
+		return infobloxPool{}, ErrPoolNotInitialized
+	}
+	return loaded, nil
+}
+
+// InitializePool reads the pool's credentials and checks that its network
+// exists in Infoblox.  A loaded pool is only loaded again when its Infoblox
+// settings or its credentials change.
+func (a *InfobloxAllocator) InitializePool(ctx context.Context, pool *v1.IPPool) (bool, error) {
+	config := pool.Spec.Infoblox
+	if config == nil {
+		return false, fmt.Errorf("pool %v is not configured for Infoblox", pool.Name)
+	}
+	network, err := netip.ParsePrefix(config.Network)
+	if err != nil {
+		return false, fmt.Errorf("invalid Infoblox network %v: %w", config.Network, err)
+	}
+	creds, secretVersion, err := readCredentials(ctx, a.secrets, pool, config.CredentialsSecret)
+	if err != nil {
+		return false, err
+	}
+
+	key := poolKey(pool)
+	a.mu.Lock()
+	if current, ok := a.pools[key]; ok && current.secretVersion == secretVersion && equality.Semantic.DeepEqual(current.pool.Spec.Infoblox, config) {
+		current.pool = pool
+		a.pools[key] = current
+		a.mu.Unlock()
+		return false, nil
+	}
+	a.mu.Unlock()
+
+	httpClient, err := creds.httpClient(config.InsecureSkipVerify)
+	if err != nil {
+		return false, err
+	}
+	c := &infobloxClient{
+		http:        httpClient,
+		url:         fmt.Sprintf("%v/wapi/%v", baseURL(config.Host), defaultString(config.WAPIVersion, infobloxDefaultWAPIVersion)),
+		username:    creds.get("username"),
+		password:    creds.get("password"),
+		networkView: defaultString(config.NetworkView, infobloxDefaultNetworkView),
+	}
+
+	networkObject := "network"
+	if network.Addr().Is6() {
+		networkObject = "ipv6network"
+	}
+	networks, err := c.list(ctx, networkObject, url.Values{
+		"network":      {network.String()},
+		"network_view": {c.networkView},
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to look up Infoblox network %v: %w", network, err)
+	}
+	if len(networks) == 0 {
+		return false, fmt.Errorf("network %v not found in Infoblox network view %v", network, c.networkView)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	current, ok := a.pools[key]
+	a.pools[key] = infobloxPool{
+		pool:          pool,
+		client:        c,
+		network:       network,
+		secretVersion: secretVersion,
+		claimed:       newClaimedAddresses(),
+		pruned:        ok && current.pruned && equality.Semantic.DeepEqual(current.pool.Spec.Infoblox, config),
+	}
+	return true, nil
+}
+
+// RemovePool forgets the pool.  Its host records are deleted as its
+// IPAddresses are released.
+func (a *InfobloxAllocator) RemovePool(ctx context.Context, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pools, key)
+	return nil
+}
+
+// GetIPAddress creates a host record holding the next available address of
+// the pool's network.
+func (a *InfobloxAllocator) GetIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	loaded, err := a.loadedPool(fmt.Sprintf("%v/%v", ipClaim.Namespace, ipClaim.Spec.PoolRef.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	nextAvailable := fmt.Sprintf("func:nextavailableip:%v,%v", loaded.network, loaded.client.networkView)
+	host, err := loaded.client.createHost(ctx, loaded.hostRecord(ipClaim.Namespace, ipClaim.Name, ipClaim.Name, nextAvailable))
+	if err != nil {
+		var wapiErr *infobloxError
+		if errors.As(err, &wapiErr) && wapiErr.exhausted() {
+			return nil, fmt.Errorf("%w: no addresses left in Infoblox network %v of pool %v", ErrPoolExhausted, loaded.network, loaded.pool.Name)
+		}
+		return nil, err
+	}
+	address := host.address()
+	if address == "" {
+		return nil, fmt.Errorf("Infoblox host record %v holds no address", host.Name)
+	}
+	log.Infof("Infoblox host record %v holds IP %v for pool %v", host.Name, address, loaded.pool.Name)
+
+	ipAddress := NewIPAddress(ipClaim, loaded.pool, ipClaim.Name, address)
+	loaded.claimed.add(*ipAddress)
+	return ipAddress, nil
+}
+
+// GetPairedIPAddress is not supported, pairing is handled by the dispatcher.
+func (a *InfobloxAllocator) GetPairedIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	return nil, errors.New("paired pools are only supported through the dispatcher")
+}
+
+// ClaimIPAddress makes sure a host record holds the address of an existing
+// IPAddress.  An address held by a host record the controller didn't create,
+// or created for another claim, is reported as a conflict.
+func (a *InfobloxAllocator) ClaimIPAddress(ctx context.Context, pool *v1.IPPool, address ipamv1.IPAddress) error {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return err
+	}
+	parsedIP, err := loaded.parseAddress(address.Spec.Address)
+	if err != nil {
+		return err
+	}
+
+	hosts, err := loaded.client.hostsByAddress(ctx, parsedIP)
+	if err != nil {
+		return err
+	}
+	held, err := loaded.checkHosts(address, parsedIP, hosts)
+	if err != nil {
+		return err
+	}
+	if !held {
+		if err := loaded.createHost(ctx, address, parsedIP); err != nil {
+			return err
+		}
+	}
+	loaded.claimed.add(address)
+	return nil
+}
+
+// ClaimIPAddresses claims the addresses of the IPAddresses not known to be
+// held by their host records yet.  The used addresses of the network and the
+// host records of the pool's namespace are looked up once for all of them.
+func (a *InfobloxAllocator) ClaimIPAddresses(ctx context.Context, pool *v1.IPPool, addresses []ipamv1.IPAddress) (map[string]error, error) {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return nil, err
+	}
+	failures := map[string]error{}
+	var unclaimed []ipamv1.IPAddress
+	for _, address := range addresses {
+		if !loaded.claimed.has(address) {
+			unclaimed = append(unclaimed, address)
+		}
+	}
+	if len(unclaimed) == 0 {
+		return failures, nil
+	}
+
+	used, err := loaded.usedAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inUse := map[netip.Addr]bool{}
+	for _, address := range used {
+		if addr, err := netip.ParseAddr(address.IPAddress); err == nil {
+			inUse[addr] = true
+		}
+	}
+	hosts, err := loaded.client.listHosts(ctx, url.Values{
+		"comment~": {"^" + regexp.QuoteMeta(infobloxCommentPrefix+pool.Namespace+"/")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	hostsByAddress := map[netip.Addr][]infobloxHost{}
+	for _, host := range hosts {
+		if addr, err := netip.ParseAddr(host.address()); err == nil {
+			hostsByAddress[addr] = append(hostsByAddress[addr], host)
+		}
+	}
+
+	for _, address := range unclaimed {
+		parsedIP, err := loaded.parseAddress(address.Spec.Address)
+		if err != nil {
+			failures[address.Name] = err
+			continue
+		}
+		held, err := loaded.checkHosts(address, parsedIP, hostsByAddress[parsedIP])
+		if err != nil {
+			failures[address.Name] = err
+			continue
+		}
+		if !held {
+			if inUse[parsedIP] {
+				failures[address.Name] = fmt.Errorf("%w: address %v is used in Infoblox network %v", ErrAddressInUse, parsedIP, loaded.network)
+				continue
+			}
+			if err := loaded.createHost(ctx, address, parsedIP); err != nil {
+				failures[address.Name] = err
+				continue
+			}
+		}
+		loaded.claimed.add(address)
+	}
+	return failures, nil
+}
+
+// ReleaseIPConfiguration deletes the host records the controller created for
+// the address on behalf of the IPAddress's claim.  Host records of other
+// claims holding the same address are left alone.
+func (a *InfobloxAllocator) ReleaseIPConfiguration(ctx context.Context, ipAddr *ipamv1.IPAddress) error {
+	loaded, err := a.loadedPool(fmt.Sprintf("%v/%v", ipAddr.Namespace, ipAddr.Spec.PoolRef.Name))
+	if err != nil {
+		return err
+	}
+	parsedIP, err := netip.ParseAddr(ipAddr.Spec.Address)
+	if err != nil {
+		return err
+	}
+
+	loaded.claimed.forget(*ipAddr)
+	hosts, err := loaded.client.hostsByAddress(ctx, parsedIP)
+	if err != nil {
+		return err
+	}
+	comment := infobloxComment(ipAddr.Namespace, ipAddr.Spec.ClaimRef.Name)
+	for _, host := range hosts {
+		if !host.owned() {
+			log.Warnf("Not deleting Infoblox host record %v of IP %v, it was not created by the controller", host.Name, parsedIP)
+			continue
+		}
+		if host.Comment != comment {
+			log.Warnf("Not deleting Infoblox host record %v of IP %v, it belongs to IPAddressClaim %v", host.Name, parsedIP, strings.TrimPrefix(host.Comment, infobloxCommentPrefix))
+			continue
+		}
+		log.Infof("Deleting Infoblox host record %v of IP %v", host.Name, parsedIP)
+		if err := loaded.client.do(ctx, http.MethodDelete, host.Ref, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPoolUsage counts the used addresses of the pool's network, including
+// those not handed out by the controller.
+func (a *InfobloxAllocator) GetPoolUsage(ctx context.Context, pool *v1.IPPool) (*PoolUsage, error) {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &PoolUsage{
+		Total: rangeSize(netipx.RangeOfPrefix(loaded.network)),
+	}
+	if loaded.network.Addr().Is4() && loaded.network.Bits() < 31 {
+		// Network and broadcast addresses
+		usage.Reserved = 2
+	}
+
+	addresses, err := loaded.usedAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		if !containsString(address.Types, "NETWORK") && !containsString(address.Types, "BROADCAST") {
+			usage.Allocated++
+		}
+	}
+	return usage, nil
+}
+
+// ReleaseUnclaimedAddresses deletes the host records the controller created
+// in the pool's network for IPAddresses which are gone.  It only looks for
+// them once after the pool is loaded.
+func (a *InfobloxAllocator) ReleaseUnclaimedAddresses(ctx context.Context, pool *v1.IPPool, addresses []string) ([]string, error) {
+	key := poolKey(pool)
+	loaded, err := a.loadedPool(key)
+	if err != nil {
+		return nil, err
+	}
+	if loaded.pruned {
+		return nil, nil
+	}
+
+	inUse := map[netip.Addr]bool{}
+	for _, address := range addresses {
+		if addr, err := netip.ParseAddr(address); err == nil {
+			inUse[addr] = true
+		}
+	}
+
+	hosts, err := loaded.client.listHosts(ctx, url.Values{
+		"comment~": {"^" + regexp.QuoteMeta(infobloxCommentPrefix+pool.Namespace+"/")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	for _, host := range hosts {
+		addr, err := netip.ParseAddr(host.address())
+		if err != nil || !loaded.network.Contains(addr) || inUse[addr] || !host.owned() {
+			continue
+		}
+		if err := loaded.client.do(ctx, http.MethodDelete, host.Ref, nil, nil, nil); err != nil {
+			return released, err
+		}
+		loaded.claimed.remove(addr.String())
+		log.Infof("Deleted Infoblox host record %v of unclaimed IP %v in pool %v", host.Name, addr, pool.Name)
+		released = append(released, addr.String())
+	}
+
+	a.mu.Lock()
+	if current, ok := a.pools[key]; ok {
+		current.pruned = true
+		a.pools[key] = current
+	}
+	a.mu.Unlock()
+	return released, nil
+}
+
+// parseAddress parses the address of an IPAddress of the pool.
+func (p infobloxPool) parseAddress(address string) (netip.Addr, error) {
+	parsedIP, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !p.network.Contains(parsedIP) {
+		return netip.Addr{}, fmt.Errorf("%w: address %v is not in Infoblox network %v of pool %v", ErrAddressOutOfRange, parsedIP, p.network, p.pool.Name)
+	}
+	return parsedIP, nil
+}
+
+// checkHosts checks that the host records holding the address of ipAddr were
+// created by the controller for its claim, and reports whether there are any.
+func (p infobloxPool) checkHosts(ipAddr ipamv1.IPAddress, address netip.Addr, hosts []infobloxHost) (bool, error) {
+	comment := infobloxComment(ipAddr.Namespace, ipAddr.Spec.ClaimRef.Name)
+	for _, host := range hosts {
+		if !host.owned() {
+			return false, fmt.Errorf("%w: address %v is held by Infoblox host record %v", ErrAddressInUse, address, host.Name)
+		}
+		if host.Comment != comment {
+			return false, fmt.Errorf("%w: address %v is held by Infoblox host record %v for IPAddressClaim %v", ErrAddressInUse, address, host.Name, strings.TrimPrefix(host.Comment, infobloxCommentPrefix))
+		}
+	}
+	return len(hosts) > 0, nil
+}
+
+// createHost creates the host record holding the address of an existing
+// IPAddress.
+func (p infobloxPool) createHost(ctx context.Context, ipAddr ipamv1.IPAddress, address netip.Addr) error {
+	if _, err := p.client.createHost(ctx, p.hostRecord(ipAddr.Namespace, ipAddr.Spec.ClaimRef.Name, ipAddr.Name, address.String())); err != nil {
+		return err
+	}
+	log.Infof("IP %v has been claimed in Infoblox for pool %v", address, p.pool.Name)
+	return nil
+}
+
+// infobloxAddress is a WAPI ipv4address or ipv6address object.
+type infobloxAddress struct {
+	IPAddress string   `json:"ip_address"`
+	Types     []string `json:"types"`
+}
+
+// usedAddresses returns the used addresses of the pool's network.
+func (p infobloxPool) usedAddresses(ctx context.Context) ([]infobloxAddress, error) {
+	addressObject := "ipv4address"
+	if p.network.Addr().Is6() {
+		addressObject = "ipv6address"
+	}
+	results, err := p.client.list(ctx, addressObject, url.Values{
+		"network":        {p.network.String()},
+		"network_view":   {p.client.networkView},
+		"status":         {"USED"},
+		"_return_fields": {"ip_address,types"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]infobloxAddress, 0, len(results))
+	for _, raw := range results {
+		var address infobloxAddress
+		if err := json.Unmarshal(raw, &address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// infobloxComment returns the comment of the host records created for a
+// claim.
+func infobloxComment(namespace, claimName string) string {
+	return infobloxCommentPrefix + namespace + "/" + claimName
+}
+
+// hostRecord returns the host record holding address for the claim.
+func (p infobloxPool) hostRecord(namespace, claimName, name, address string) infobloxHost {
+	config := p.pool.Spec.Infoblox
+	host := infobloxHost{
+		Name:    name,
+		Comment: infobloxComment(namespace, claimName),
+	}
+	if config.DomainName != "" {
+		host.Name += "." + strings.TrimPrefix(config.DomainName, ".")
+	}
+	if config.DNSView != "" {
+		host.ConfigureForDNS = true
+		host.View = config.DNSView
+	}
+	if p.network.Addr().Is6() {
+		host.IPv6Addrs = []infobloxHostAddress{{IPv6Addr: address}}
+	} else {
+		host.IPv4Addrs = []infobloxHostAddress{{IPv4Addr: address}}
+	}
+	return host
+}
+
+// infobloxHost is a WAPI record:host object.
+type infobloxHost struct {
+	Ref             string                `json:"_ref,omitempty"`
+	Name            string                `json:"name"`
+	Comment         string                `json:"comment,omitempty"`
+	ConfigureForDNS bool                  `json:"configure_for_dns"`
+	View            string                `json:"view,omitempty"`
+	IPv4Addrs       []infobloxHostAddress `json:"ipv4addrs,omitempty"`
+	IPv6Addrs       []infobloxHostAddress `json:"ipv6addrs,omitempty"`
+}
+
+type infobloxHostAddress struct {
+	IPv4Addr string `json:"ipv4addr,omitempty"`
+	IPv6Addr string `json:"ipv6addr,omitempty"`
+}
+
+// address returns the first address of the host record.
+func (h infobloxHost) address() string {
+	for _, addr := range h.IPv4Addrs {
+		return addr.IPv4Addr
+	}
+	for _, addr := range h.IPv6Addrs {
+		return addr.IPv6Addr
+	}
+	return ""
+}
+
+func (h infobloxHost) owned() bool {
+	return strings.HasPrefix(h.Comment, infobloxCommentPrefix)
+}
+
+// infobloxError is an error returned by the WAPI.
+type infobloxError struct {
+	Err  string `json:"Error"`
+	Code string `json:"code"`
+	Text string `json:"text"`
+}
+
+func (e *infobloxError) Error() string {
+	return fmt.Sprintf("infoblox: %v: %v", e.Code, e.Text)
+}
+
+// infobloxConflictCode is the code of the WAPI error returned when no
+// address is left for a nextavailableip function, among other conflicts.
+const infobloxConflictCode = "Client.Ibap.Data.Conflict"
+
+// exhausted reports whether the error was returned for a nextavailableip
+// function finding no address.  The text is only looked at when the grid
+// master returns no code, as its wording differs between WAPI versions.
+func (e *infobloxError) exhausted() bool {
+	if e.Code != "" {
+		return e.Code == infobloxConflictCode
+	}
+	return strings.Contains(e.Text, "available IP") || strings.Contains(e.Err, "available IP")
+}
+
+// infobloxClient calls the WAPI of a grid master.
+type infobloxClient struct {
+	http        *http.Client
+	url         string
+	username    string
+	password    string
+	networkView string
+}
+
+const infobloxHostFields = "name,comment,ipv4addrs,ipv6addrs"
+
+// createHost creates a host record and returns it as created.
+func (c *infobloxClient) createHost(ctx context.Context, host infobloxHost) (infobloxHost, error) {
+	var created struct {
+		Result infobloxHost `json:"result"`
+	}
+	err := c.do(ctx, http.MethodPost, "record:host", url.Values{
+		"_return_fields":    {infobloxHostFields},
+		"_return_as_object": {"1"},
+	}, host, &created)
+	return created.Result, err
+}
+
+// hostsByAddress returns the host records holding address.
+func (c *infobloxClient) hostsByAddress(ctx context.Context, address netip.Addr) ([]infobloxHost, error) {
+	query := url.Values{}
+	if address.Is6() {
+		query.Set("ipv6addr", address.String())
+	} else {
+		query.Set("ipv4addr", address.String())
+	}
+	return c.listHosts(ctx, query)
+}
+
+func (c *infobloxClient) listHosts(ctx context.Context, query url.Values) ([]infobloxHost, error) {
+	query.Set("network_view", c.networkView)
+	query.Set("_return_fields", infobloxHostFields)
+	results, err := c.list(ctx, "record:host", query)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]infobloxHost, 0, len(results))
+	for _, raw := range results {
+		var host infobloxHost
+		if err := json.Unmarshal(raw, &host); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// list returns every object matching query, following the WAPI's paging.
+func (c *infobloxClient) list(ctx context.Context, object string, query url.Values) ([]json.RawMessage, error) {
+	query.Set("_paging", "1")
+	query.Set("_return_as_object", "1")
+	query.Set("_max_results", fmt.Sprint(infobloxPageSize))
+
+	var results []json.RawMessage
+	for {
+		var page struct {
+			Result     []json.RawMessage `json:"result"`
+			NextPageID string            `json:"next_page_id"`
+		}
+		if err := c.do(ctx, http.MethodGet, object, query, nil, &page); err != nil {
+			return nil, err
+		}
+		results = append(results, page.Result...)
+		if page.NextPageID == "" {
+			return results, nil
+		}
+		query = url.Values{
+			"_page_id": {page.NextPageID},
+		}
+	}
+}
+
+// do sends a request for path, relative to the WAPI's base URL, and decodes
+// the response into out.
+func (c *infobloxClient) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	requestURL := c.url + "/" + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		wapiErr := &infobloxError{}
+		if err := json.Unmarshal(data, wapiErr); err == nil && wapiErr.Text != "" {
+			return wapiErr
+		}
+		return fmt.Errorf("infoblox returned %v for %v %v", resp.Status, method, path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func defaultString(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
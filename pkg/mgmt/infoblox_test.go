@@ -0,0 +1,436 @@
+package mgmt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"go4.org/netipx"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+// fakeWAPI serves the parts of the Infoblox WAPI used by the allocator for a
+// single network.
+type fakeWAPI struct {
+	network netip.Prefix
+
+	mu    sync.Mutex
+	hosts map[string]infobloxHost
+	// noCodes leaves the code out of errors, as older grid masters do.
+	noCodes bool
+	// fixed holds used addresses which are not held by host records.
+	fixed    map[netip.Addr]bool
+	nextRef  int
+	requests map[string]int
+}
+
+func newFakeWAPI(network string) *fakeWAPI {
+	return &fakeWAPI{
+		network:  netip.MustParsePrefix(network),
+		hosts:    map[string]infobloxHost{},
+		fixed:    map[netip.Addr]bool{},
+		requests: map[string]int{},
+	}
+}
+
+func (f *fakeWAPI) addHost(host infobloxHost) {
+	f.nextRef++
+	host.Ref = fmt.Sprintf("record:host/%d", f.nextRef)
+	f.hosts[host.Ref] = host
+}
+
+// used returns the used addresses of the network by type.
+func (f *fakeWAPI) used() map[netip.Addr][]string {
+	used := map[netip.Addr][]string{}
+	r := netipx.RangeOfPrefix(f.network)
+	used[r.From()] = []string{"NETWORK"}
+	used[r.To()] = []string{"BROADCAST"}
+	for addr := range f.fixed {
+		used[addr] = []string{"FA"}
+	}
+	for _, host := range f.hosts {
+		if addr, err := netip.ParseAddr(host.address()); err == nil {
+			used[addr] = append(used[addr], "HOST")
+		}
+	}
+	return used
+}
+
+func (f *fakeWAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "infoblox" {
+		http.Error(w, "Authorization Required", http.StatusUnauthorized)
+		return
+	}
+	object := strings.TrimPrefix(r.URL.Path, "/wapi/v2.12/")
+	f.requests[r.Method+" "+strings.Split(object, "/")[0]]++
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && object == "network":
+		var networks []interface{}
+		if query.Get("network") == f.network.String() {
+			networks = append(networks, map[string]string{"_ref": "network/1", "network": f.network.String()})
+		}
+		writeWAPIResult(w, networks)
+
+	case r.Method == http.MethodGet && object == "ipv4address":
+		var addresses []infobloxAddress
+		for addr, types := range f.used() {
+			addresses = append(addresses, infobloxAddress{IPAddress: addr.String(), Types: types})
+		}
+		writeWAPIResult(w, addresses)
+
+	case r.Method == http.MethodGet && object == "record:host":
+		comment, err := regexp.Compile(query.Get("comment~"))
+		if err != nil {
+			writeWAPIError(w, http.StatusBadRequest, "Client.Ibap.Proto", err.Error())
+			return
+		}
+		var hosts []infobloxHost
+		for _, host := range f.hosts {
+			if address := query.Get("ipv4addr"); address != "" && host.address() != address {
+				continue
+			}
+			if !comment.MatchString(host.Comment) {
+				continue
+			}
+			hosts = append(hosts, host)
+		}
+		writeWAPIResult(w, hosts)
+
+	case r.Method == http.MethodPost && object == "record:host":
+		var host infobloxHost
+		if err := json.NewDecoder(r.Body).Decode(&host); err != nil || len(host.IPv4Addrs) != 1 {
+			writeWAPIError(w, http.StatusBadRequest, "Client.Ibap.Proto", "invalid host record")
+			return
+		}
+		used := f.used()
+		address := host.IPv4Addrs[0].IPv4Addr
+		if strings.HasPrefix(address, "func:nextavailableip:") {
+			address = ""
+			for addr := f.network.Addr(); f.network.Contains(addr); addr = addr.Next() {
+				if _, ok := used[addr]; !ok {
+					address = addr.String()
+					break
+				}
+			}
+			if address == "" {
+				code := "Client.Ibap.Data.Conflict"
+				if f.noCodes {
+					code = ""
+				}
+				writeWAPIError(w, http.StatusBadRequest, code, "Cannot find 1 available IP address(es) in this network")
+				return
+			}
+		} else if _, ok := used[netip.MustParseAddr(address)]; ok {
+			writeWAPIError(w, http.StatusBadRequest, "Client.Ibap.Data.Conflict", fmt.Sprintf("The IP address %v is already in use", address))
+			return
+		}
+		host.IPv4Addrs[0].IPv4Addr = address
+		f.addHost(host)
+		writeWAPIResult(w, f.hosts[fmt.Sprintf("record:host/%d", f.nextRef)])
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(object, "record:host/"):
+		if _, ok := f.hosts[object]; !ok {
+			writeWAPIError(w, http.StatusNotFound, "Client.Ibap.Data.NotFound", "Reference not found")
+			return
+		}
+		delete(f.hosts, object)
+		writeWAPIResult(w, object)
+
+	default:
+		writeWAPIError(w, http.StatusBadRequest, "Client.Ibap.Proto", "unsupported request "+r.Method+" "+object)
+	}
+}
+
+func writeWAPIResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": result})
+}
+
+func writeWAPIError(w http.ResponseWriter, status int, code, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(infobloxError{Err: code + ": " + text, Code: code, Text: text})
+}
+
+// newInfobloxTest returns an allocator reading the credentials of a pool
+// served by wapi.
+func newInfobloxTest(t *testing.T, wapi *fakeWAPI, password string) (*InfobloxAllocator, *v1.IPPool, client.Client) {
+	t.Helper()
+	server := httptest.NewServer(wapi)
+	t.Cleanup(server.Close)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "infoblox-credentials"},
+		Data: map[string][]byte{
+			"username": []byte("admin"),
+			"password": []byte(password),
+		},
+	}
+	secrets := fake.NewClientBuilder().WithObjects(secret).Build()
+	pool := &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec: v1.IPPoolSpec{
+			Prefix: 29,
+			Infoblox: &v1.InfobloxConfig{
+				Host:              server.URL,
+				Network:           wapi.network.String(),
+				CredentialsSecret: secret.Name,
+			},
+		},
+	}
+	return NewInfobloxAllocator(secrets), pool, secrets
+}
+
+func TestInfobloxAllocate(t *testing.T) {
+	ctx := context.Background()
+	wapi := newFakeWAPI("10.1.0.0/29")
+	allocator, pool, _ := newInfobloxTest(t, wapi, "infoblox")
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+
+	var addresses []*ipamv1.IPAddress
+	for i := 0; i < 6; i++ {
+		ip, err := allocator.GetIPAddress(ctx, testClaim(pool, fmt.Sprintf("claim-%d", i)))
+		if err != nil {
+			t.Fatalf("unable to get address: %v", err)
+		}
+		if want := fmt.Sprintf("10.1.0.%d", i+1); ip.Spec.Address != want {
+			t.Errorf("got %v, want %v", ip.Spec.Address, want)
+		}
+		addresses = append(addresses, ip)
+	}
+	if _, err := allocator.GetIPAddress(ctx, testClaim(pool, "claim-6")); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("expected the pool to be exhausted, got %v", err)
+	}
+	for _, host := range wapi.hosts {
+		if !strings.HasPrefix(host.Comment, infobloxCommentPrefix+"ns/claim-") {
+			t.Errorf("host record %v has comment %q", host.Name, host.Comment)
+		}
+	}
+
+	if err := allocator.ReleaseIPConfiguration(ctx, addresses[0]); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	usage, err := allocator.GetPoolUsage(ctx, pool)
+	if err != nil {
+		t.Fatalf("unable to get usage: %v", err)
+	}
+	if usage.Total != 8 || usage.Reserved != 2 || usage.Allocated != 5 {
+		t.Errorf("got usage %+v, want 5 of 8 addresses allocated and 2 reserved", usage)
+	}
+	ip, err := allocator.GetIPAddress(ctx, testClaim(pool, "claim-7"))
+	if err != nil || ip.Spec.Address != addresses[0].Spec.Address {
+		t.Errorf("expected the released address to be handed out again, got %v, %v", ip, err)
+	}
+
+	// Host records of IPAddresses which are gone are deleted, others stay.
+	inUse := []string{}
+	for _, ip := range addresses[2:] {
+		inUse = append(inUse, ip.Spec.Address)
+	}
+	wapi.addHost(infobloxHost{Name: "printer", IPv4Addrs: []infobloxHostAddress{{IPv4Addr: "10.1.0.2"}}})
+	released, err := allocator.ReleaseUnclaimedAddresses(ctx, pool, inUse)
+	if err != nil {
+		t.Fatalf("unable to release unclaimed addresses: %v", err)
+	}
+	if len(released) != 2 {
+		t.Errorf("got %v released, want the addresses of claim-1 and claim-7", released)
+	}
+	if len(wapi.hosts) != 5 {
+		t.Errorf("got %v host records left, want 5", len(wapi.hosts))
+	}
+}
+
+func TestInfobloxExhausted(t *testing.T) {
+	ctx := context.Background()
+	for _, noCodes := range []bool{false, true} {
+		wapi := newFakeWAPI("10.1.0.0/30")
+		wapi.noCodes = noCodes
+		allocator, pool, _ := newInfobloxTest(t, wapi, "infoblox")
+		if _, err := allocator.InitializePool(ctx, pool); err != nil {
+			t.Fatalf("unable to initialize pool: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := allocator.GetIPAddress(ctx, testClaim(pool, fmt.Sprintf("claim-%d", i))); err != nil {
+				t.Fatalf("unable to get address: %v", err)
+			}
+		}
+		if _, err := allocator.GetIPAddress(ctx, testClaim(pool, "claim-2")); !errors.Is(err, ErrPoolExhausted) {
+			t.Errorf("without codes %v: expected the pool to be exhausted, got %v", noCodes, err)
+		}
+	}
+
+	// Other errors are not taken for exhaustion.
+	for _, wapiErr := range []infobloxError{
+		{Code: "Client.Ibap.Data.NotFound", Text: "Cannot find 1 available IP address(es) in this network"},
+		{Text: "Reference not found"},
+	} {
+		if wapiErr.exhausted() {
+			t.Errorf("%v taken for exhaustion", &wapiErr)
+		}
+	}
+}
+
+func TestInfobloxClaimConflicts(t *testing.T) {
+	ctx := context.Background()
+	wapi := newFakeWAPI("10.1.0.0/29")
+	wapi.addHost(infobloxHost{Name: "held", Comment: infobloxComment("ns", "held"), IPv4Addrs: []infobloxHostAddress{{IPv4Addr: "10.1.0.1"}}})
+	wapi.addHost(infobloxHost{Name: "other", Comment: infobloxComment("ns", "other"), IPv4Addrs: []infobloxHostAddress{{IPv4Addr: "10.1.0.2"}}})
+	wapi.addHost(infobloxHost{Name: "printer", IPv4Addrs: []infobloxHostAddress{{IPv4Addr: "10.1.0.3"}}})
+	wapi.fixed[netip.MustParseAddr("10.1.0.4")] = true
+	allocator, pool, _ := newInfobloxTest(t, wapi, "infoblox")
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+
+	ipAddress := func(claim, address string) ipamv1.IPAddress {
+		return *NewIPAddress(testClaim(pool, claim), pool, claim, address)
+	}
+	addresses := []ipamv1.IPAddress{
+		ipAddress("held", "10.1.0.1"),
+		ipAddress("stolen", "10.1.0.2"),
+		ipAddress("printed", "10.1.0.3"),
+		ipAddress("fixed", "10.1.0.4"),
+		ipAddress("free", "10.1.0.5"),
+		ipAddress("outside", "10.2.0.1"),
+	}
+	failures, err := allocator.ClaimIPAddresses(ctx, pool, addresses)
+	if err != nil {
+		t.Fatalf("unable to claim addresses: %v", err)
+	}
+	for name, want := range map[string]error{
+		"stolen":  ErrAddressInUse,
+		"printed": ErrAddressInUse,
+		"fixed":   ErrAddressInUse,
+		"outside": ErrAddressOutOfRange,
+	} {
+		if !errors.Is(failures[name], want) {
+			t.Errorf("%v: got %v, want %v", name, failures[name], want)
+		}
+	}
+	if len(failures) != 4 {
+		t.Errorf("got failures %v, want 4", failures)
+	}
+	// The network is looked up once for all the addresses.
+	if wapi.requests["GET ipv4address"] != 1 || wapi.requests["GET record:host"] != 1 {
+		t.Errorf("got requests %v, want one lookup of the network's addresses and host records", wapi.requests)
+	}
+	if hosts, _ := allocator.pools["ns/pool"].client.hostsByAddress(ctx, netip.MustParseAddr("10.1.0.5")); len(hosts) != 1 || hosts[0].Comment != infobloxComment("ns", "free") {
+		t.Errorf("expected a host record to be created for the free address, got %v", hosts)
+	}
+
+	// A single claim is checked against the claim of the host record.
+	if err := allocator.ClaimIPAddress(ctx, pool, addresses[1]); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("expected an address held for another claim to be rejected, got %v", err)
+	}
+
+	// Claimed addresses are not looked up again.
+	wapi.requests = map[string]int{}
+	failures, err = allocator.ClaimIPAddresses(ctx, pool, []ipamv1.IPAddress{addresses[0], addresses[4]})
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("unable to claim addresses: %v, %v", failures, err)
+	}
+	if len(wapi.requests) != 0 {
+		t.Errorf("got requests %v for claimed addresses, want none", wapi.requests)
+	}
+}
+
+func TestInfobloxReleaseDuplicate(t *testing.T) {
+	ctx := context.Background()
+	wapi := newFakeWAPI("10.1.0.0/29")
+	allocator, pool, _ := newInfobloxTest(t, wapi, "infoblox")
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+	held, err := allocator.GetIPAddress(ctx, testClaim(pool, "held"))
+	if err != nil {
+		t.Fatalf("unable to get address: %v", err)
+	}
+
+	// An IPAddress of another claim duplicating the address is released.
+	duplicate := NewIPAddress(testClaim(pool, "duplicate"), pool, "duplicate", held.Spec.Address)
+	if err := allocator.ReleaseIPConfiguration(ctx, duplicate); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	hosts, err := allocator.pools["ns/pool"].client.hostsByAddress(ctx, netip.MustParseAddr(held.Spec.Address))
+	if err != nil || len(hosts) != 1 || hosts[0].Comment != infobloxComment("ns", "held") {
+		t.Errorf("expected the host record of the holding claim to be kept, got %v, %v", hosts, err)
+	}
+	if !allocator.pools["ns/pool"].claimed.has(*held) {
+		t.Errorf("expected the holding IPAddress to stay claimed")
+	}
+
+	if err := allocator.ReleaseIPConfiguration(ctx, held); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	if len(wapi.hosts) != 0 {
+		t.Errorf("got host records %v left, want none", wapi.hosts)
+	}
+}
+
+func TestInfobloxInitializePoolCache(t *testing.T) {
+	ctx := context.Background()
+	wapi := newFakeWAPI("10.1.0.0/29")
+	allocator, pool, secrets := newInfobloxTest(t, wapi, "infoblox")
+	if rebuilt, err := allocator.InitializePool(ctx, pool); err != nil || !rebuilt {
+		t.Fatalf("expected the pool to be loaded, got %v, %v", rebuilt, err)
+	}
+	if rebuilt, err := allocator.InitializePool(ctx, pool.DeepCopy()); err != nil || rebuilt {
+		t.Errorf("expected the unchanged pool to be kept, got %v, %v", rebuilt, err)
+	}
+	if wapi.requests["GET network"] != 1 {
+		t.Errorf("got %v network lookups, want 1", wapi.requests["GET network"])
+	}
+
+	secret := &corev1.Secret{}
+	if err := secrets.Get(ctx, client.ObjectKey{Namespace: "ns", Name: "infoblox-credentials"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	secret.Data["username"] = []byte("admin")
+	secret.Labels = map[string]string{"rotated": "true"}
+	if err := secrets.Update(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt, err := allocator.InitializePool(ctx, pool); err != nil || !rebuilt {
+		t.Errorf("expected the pool to be loaded again with new credentials, got %v, %v", rebuilt, err)
+	}
+
+	changed := pool.DeepCopy()
+	changed.Spec.Infoblox.DomainName = "example.com"
+	if rebuilt, err := allocator.InitializePool(ctx, changed); err != nil || !rebuilt {
+		t.Errorf("expected the changed pool to be loaded again, got %v, %v", rebuilt, err)
+	}
+}
+
+func TestInfobloxAuthFailure(t *testing.T) {
+	ctx := context.Background()
+	wapi := newFakeWAPI("10.1.0.0/29")
+	allocator, pool, _ := newInfobloxTest(t, wapi, "wrong")
+	_, err := allocator.InitializePool(ctx, pool)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the pool to fail to load with a 401, got %v", err)
+	}
+	if _, err := allocator.GetPoolUsage(ctx, pool); !errors.Is(err, ErrPoolNotInitialized) {
+		t.Errorf("expected the pool not to be loaded, got %v", err)
+	}
+}
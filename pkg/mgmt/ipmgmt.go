@@ -5,11 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"sort"
+	"sync"
+
 	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
 
 	goipam "github.com/metal-stack/go-ipam"
 	log "github.com/sirupsen/logrus"
+	"go4.org/netipx"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
@@ -17,107 +22,716 @@ import (
 
 type PoolInfo struct {
 	IPPool *v1.IPPool
-	Prefix *goipam.Prefix
+
+	// Prefixes are the allocator prefixes backing the pool's address ranges.
+	Prefixes []string
+
+	// IPv6 is true when the pool hands out IPv6 addresses.
+	IPv6 bool
+
+	// allocator is the allocator which loaded the pool.
+	allocator *GoIPAMAllocator
+
+	// Total is the number of addresses in the pool's address ranges.
+	Total int64
+
+	// Reserved is the number of addresses in the pool's address ranges which
+	// will never be handed out.
+	Reserved int64
+
+	// blocked is the number of addresses in Prefixes the allocator holds
+	// which are not allocations.  Besides the reserved addresses, this covers
+	// the padding needed to line ranges up with prefix boundaries.
+	blocked int64
+
+	// available holds every address of the pool which can be handed out.
+	available *netipx.IPSet
+
+	// excluded holds the addresses excluded from the pool.
+	excluded *netipx.IPSet
+
+	// adopted is true when prefixes of the pool were found in storage, so
+	// they may hold addresses whose IPAddresses are gone.
+	adopted bool
+
+	// owners records the IPAddress each address was handed out or claimed
+	// for.  Addresses acquired before the pool was loaded have no record
+	// until they are claimed.
+	owners *claimedAddresses
 }
 
-var ipam = goipam.New()
-var ipams = make(map[string]PoolInfo)
+// PoolUsage summarizes how the addresses of a pool are being used.
+type PoolUsage struct {
+	Total     int64
+	Reserved  int64
+	Allocated int64
+}
+
+// Free returns the number of addresses which can still be allocated.
+func (u PoolUsage) Free() int64 {
+	free := u.Total - u.Reserved - u.Allocated
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+var (
+	// ErrPoolNotInitialized is returned when a pool has not been loaded into the allocator.
+	ErrPoolNotInitialized = errors.New("pool not initialized")
+
+	// ErrPoolExhausted is returned when a pool has no free addresses left.
+	ErrPoolExhausted = errors.New("pool exhausted")
+
+	// ErrAddressExcluded is returned when an address is excluded from its pool.
+	ErrAddressExcluded = errors.New("address excluded")
+
+	// ErrAddressOutOfRange is returned when an address is not inside the
+	// address ranges of its pool, typically after the pool was shrunk.
+	ErrAddressOutOfRange = errors.New("address out of range")
+
+	// ErrAddressInUse is returned when an external backend holds an address
+	// for something other than its IPAddress.
+	ErrAddressInUse = errors.New("address in use")
+)
+
+// GoIPAMAllocator is the Allocator built on go-ipam.  Pools are carved into
+// prefixes of a single go-ipam allocator.
+type GoIPAMAllocator struct {
+	ipam    goipam.Ipamer
+	storage goipam.Storage
+
+	// ipamsMu guards ipams.
+	ipamsMu sync.RWMutex
+	ipams   map[string]PoolInfo
+
+	// layoutMu serializes the creation and removal of allocator prefixes,
+	// which look at the prefixes of every loaded pool to adopt or remove
+	// stored ones.
+	layoutMu sync.Mutex
+}
+
+var _ Allocator = &GoIPAMAllocator{}
+
+// NewGoIPAMAllocator returns an allocator keeping its state in storage.
+func NewGoIPAMAllocator(storage goipam.Storage) *GoIPAMAllocator {
+	log.Infof("Using %v storage for the allocator", storage.Name())
+	return &GoIPAMAllocator{
+		ipam:    goipam.NewWithStorage(storage),
+		storage: storage,
+		ipams:   make(map[string]PoolInfo),
+	}
+}
+
+func (a *GoIPAMAllocator) loadedPool(key string) PoolInfo {
+	a.ipamsMu.RLock()
+	defer a.ipamsMu.RUnlock()
+	return a.ipams[key]
+}
+
+func (a *GoIPAMAllocator) storePool(key string, poolInfo PoolInfo) {
+	a.ipamsMu.Lock()
+	defer a.ipamsMu.Unlock()
+	if poolInfo.IPPool == nil {
+		delete(a.ipams, key)
+		return
+	}
+	a.ipams[key] = poolInfo
+}
 
 func poolKey(pool *v1.IPPool) string {
 	return fmt.Sprintf("%v/%v", pool.Namespace, pool.Name)
 }
 
-func InitializePool(ctx context.Context, pool *v1.IPPool) error {
+// prefixFor returns the allocator prefix of the pool which contains address.
+func (p PoolInfo) prefixFor(address netip.Addr) (string, error) {
+	if p.excluded.Contains(address) {
+		return "", fmt.Errorf("%w: address %v is excluded from pool %v", ErrAddressExcluded, address, p.IPPool.Name)
+	}
+	if !p.available.Contains(address) {
+		return "", fmt.Errorf("%w: address %v is not available in pool %v", ErrAddressOutOfRange, address, p.IPPool.Name)
+	}
+	for _, cidr := range p.Prefixes {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return "", err
+		}
+		if prefix.Contains(address) {
+			return cidr, nil
+		}
+	}
+	return "", fmt.Errorf("address %v is not part of pool %v", address, p.IPPool.Name)
+}
+
+// InitializePool loads the pool into the allocator.  When the pool is already
+// loaded and a field which determines the pool's ranges changed, the pool is
+// rebuilt and the caller is expected to claim the pool's addresses again.
+// A new gateway only moves the address blocked for it, and other changes,
+// such as nameservers, are picked up as they are.
+func (a *GoIPAMAllocator) InitializePool(ctx context.Context, pool *v1.IPPool) (bool, error) {
 	key := poolKey(pool)
 
-	if ipams[key].IPPool == nil {
-		if len(pool.Spec.AddressCidr) > 0 {
-			ipamPrefix, err := ipam.NewPrefix(ctx, pool.Spec.AddressCidr)
-			if err != nil {
-				return err
+	a.ipamsMu.Lock()
+	if current := a.ipams[key]; current.IPPool != nil && !addressesChanged(current.IPPool.Spec, pool.Spec) &&
+		current.IPPool.Spec.Gateway == pool.Spec.Gateway {
+		current.IPPool = pool
+		a.ipams[key] = current
+		a.ipamsMu.Unlock()
+		return false, nil
+	}
+	a.ipamsMu.Unlock()
+
+	a.layoutMu.Lock()
+	defer a.layoutMu.Unlock()
+
+	if current := a.loadedPool(key); current.IPPool != nil {
+		if !addressesChanged(current.IPPool.Spec, pool.Spec) {
+			updated, err := a.updateGateway(ctx, current, pool)
+			if err != nil || updated {
+				return false, err
 			}
-			log.Infof("Created prefix %v", ipamPrefix)
-			ipams[key] = PoolInfo{
-				IPPool: pool,
-				Prefix: ipamPrefix,
+		}
+
+		// The allocator has no way to block addresses which are already
+		// acquired or to resize a prefix, so the pool is rebuilt.
+		log.Infof("Address configuration of pool %v changed, rebuilding pool", key)
+		if err := a.removePool(ctx, key); err != nil {
+			return false, err
+		}
+	}
+
+	return true, a.initializePool(ctx, pool)
+}
+
+// addressesChanged reports whether a spec change affects the ranges the pool
+// hands out addresses from.  Gateway changes are applied by updateGateway.
+func addressesChanged(current, updated v1.IPPoolSpec) bool {
+	return current.AddressCidr != updated.AddressCidr ||
+		!equality.Semantic.DeepEqual(current.Addresses, updated.Addresses) ||
+		!equality.Semantic.DeepEqual(current.Excludes, updated.Excludes) ||
+		current.Prefix != updated.Prefix
+}
+
+// updateGateway applies a new gateway to a loaded pool: the old gateway is
+// released and the new one blocked in the pool's prefixes.  An IPAddress
+// holding the new gateway keeps it and is reported as excluded when the
+// pool's addresses are claimed again.  It returns false when the pool's
+// prefixes no longer cover its addresses, in which case the pool has to be
+// rebuilt.
+func (a *GoIPAMAllocator) updateGateway(ctx context.Context, current PoolInfo, pool *v1.IPPool) (bool, error) {
+	ranges, excludes, err := poolRanges(pool)
+	if err != nil {
+		return false, err
+	}
+	updated := PoolInfo{
+		IPPool:    pool,
+		Prefixes:  current.Prefixes,
+		IPv6:      current.IPv6,
+		allocator: a,
+		blocked:   current.blocked,
+		adopted:   current.adopted,
+		owners:    current.owners,
+	}
+	if err := updated.addressSets(ranges, excludes); err != nil {
+		return false, err
+	}
+	cover, err := coverPrefixes(updated.available)
+	if err != nil {
+		return false, err
+	}
+	if len(cover) != len(current.Prefixes) {
+		return false, nil
+	}
+	for i, prefix := range cover {
+		if prefix.String() != current.Prefixes[i] {
+			return false, nil
+		}
+	}
+
+	for _, gateway := range []string{current.IPPool.Spec.Gateway, pool.Spec.Gateway} {
+		addr, err := netip.ParseAddr(gateway)
+		if err != nil {
+			continue
+		}
+		var cidr string
+		for _, prefix := range cover {
+			if prefix.Contains(addr) {
+				cidr = prefix.String()
 			}
 		}
+		switch {
+		case cidr == "":
+			continue
+		case updated.available.Contains(addr) && !current.available.Contains(addr):
+			err := a.ipam.ReleaseIPFromPrefix(ctx, cidr, addr.String())
+			if err != nil && !errors.Is(err, goipam.ErrNotFound) {
+				return false, err
+			}
+			updated.blocked--
+		case current.available.Contains(addr) && !updated.available.Contains(addr):
+			_, err := a.ipam.AcquireSpecificIP(ctx, cidr, addr.String())
+			if err != nil && !errors.Is(err, goipam.ErrAlreadyAllocated) {
+				return false, err
+			}
+			updated.blocked++
+		}
+	}
+	log.Infof("Gateway of pool %v changed from %q to %q", poolKey(pool), current.IPPool.Spec.Gateway, pool.Spec.Gateway)
+	a.storePool(poolKey(pool), updated)
+	return true, nil
+}
+
+// poolRanges returns the address ranges and excludes of the pool.
+func poolRanges(pool *v1.IPPool) ([]AddressRange, []AddressRange, error) {
+	ranges, err := PoolAddressRanges(pool.Spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	excludes, err := PoolExcludes(pool.Spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ranges, excludes, nil
+}
+
+func (a *GoIPAMAllocator) initializePool(ctx context.Context, pool *v1.IPPool) error {
+	key := poolKey(pool)
+
+	ranges, excludes, err := poolRanges(pool)
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	ipv6, err := PoolIPv6(pool.Spec)
+	if err != nil {
+		return err
+	}
+
+	poolInfo := PoolInfo{
+		IPPool:    pool,
+		IPv6:      ipv6,
+		allocator: a,
+		owners:    newClaimedAddresses(),
+	}
+	if err := poolInfo.addRanges(ctx, ranges, excludes); err != nil {
+		log.Warnf("Unable to initialize pool %v: %v", key, err)
+		for _, cidr := range poolInfo.Prefixes {
+			if err := poolInfo.deletePrefix(ctx, cidr); err != nil {
+				log.Warnf("Unable to remove prefix %v: %v", cidr, err)
+			}
+		}
+		return err
+	}
+	a.storePool(key, poolInfo)
+
+	return nil
+}
+
+// addRanges creates the allocator prefixes which back the given ranges.
+// Address ranges rarely line up with prefix boundaries, so they are covered by
+// prefixes large enough for the allocator and every address of those
+// prefixes which must not be handed out is blocked: the first and last
+// addresses of CIDR entries, the subnet's network and broadcast addresses and
+// any excluded address.
+func (p *PoolInfo) addRanges(ctx context.Context, ranges []AddressRange, excludes []AddressRange) error {
+	if err := p.addressSets(ranges, excludes); err != nil {
+		return err
+	}
+	cover, err := coverPrefixes(p.available)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range cover {
+		if err := p.addPrefix(ctx, prefix, p.available); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addressSets works out the addresses of the pool which can be handed out and
+// those which are excluded, along with the pool's total and reserved counts.
+func (p *PoolInfo) addressSets(ranges []AddressRange, excludes []AddressRange) error {
+	var rangeBuilder, allowedBuilder, excludedBuilder netipx.IPSetBuilder
+	for _, addressRange := range ranges {
+		p.Total = saturatingAdd(p.Total, rangeSize(addressRange.IPRange))
+		rangeBuilder.AddRange(addressRange.IPRange)
+		allowedBuilder.AddRange(addressRange.IPRange)
+
+		if addressRange.CIDR {
+			if prefix, ok := addressRange.Prefix(); ok && !pointToPoint(prefix.Addr(), prefix.Bits()) {
+				allowedBuilder.Remove(addressRange.From())
+				if addressRange.From().Is4() {
+					allowedBuilder.Remove(addressRange.To())
+				}
+			}
+			continue
+		}
+		for _, addr := range []netip.Addr{addressRange.From(), addressRange.To()} {
+			for boundary := range subnetBoundaries(addr, p.IPPool.Spec.Prefix) {
+				if addressRange.Contains(boundary) {
+					allowedBuilder.Remove(boundary)
+				}
+			}
+		}
+	}
+	for _, exclude := range excludes {
+		allowedBuilder.RemoveRange(exclude.IPRange)
+		excludedBuilder.AddRange(exclude.IPRange)
+	}
+
+	allowed, err := allowedBuilder.IPSet()
+	if err != nil {
+		return err
+	}
+	if p.excluded, err = excludedBuilder.IPSet(); err != nil {
+		return err
+	}
+	p.available = allowed
+
+	// Every address in a range which is not allowed is reserved.
+	rangeBuilder.RemoveSet(allowed)
+	notAllowed, err := rangeBuilder.IPSet()
+	if err != nil {
+		return err
+	}
+	for _, notAllowedRange := range notAllowed.Ranges() {
+		p.Reserved = saturatingAdd(p.Reserved, rangeSize(notAllowedRange))
+	}
+
+	return nil
+}
+
+// coverPrefixes returns the allocator prefixes covering allowed.  Prefixes
+// are never smaller than the allocator can hand addresses out from.
+func coverPrefixes(allowed *netipx.IPSet) ([]netip.Prefix, error) {
+	var coverBuilder netipx.IPSetBuilder
+	for _, prefix := range allowed.Prefixes() {
+		if bits := maxPrefixBits(prefix.Addr()); prefix.Bits() > bits {
+			prefix = netip.PrefixFrom(prefix.Addr(), bits).Masked()
+		}
+		coverBuilder.AddPrefix(prefix)
+	}
+	cover, err := coverBuilder.IPSet()
+	if err != nil {
+		return nil, err
+	}
+	return cover.Prefixes(), nil
+}
+
+// addPrefix creates an allocator prefix from which only the addresses in
+// allowed can be acquired.  A prefix left in storage by an earlier run is
+// adopted along with its allocations.
+func (p *PoolInfo) addPrefix(ctx context.Context, prefix netip.Prefix, allowed *netipx.IPSet) error {
+	ipamPrefix := p.allocator.ipam.PrefixFrom(ctx, prefix.String())
+	if ipamPrefix != nil && !p.allocator.inUse(ipamPrefix.Cidr) {
+		log.Infof("Adopted prefix %v", ipamPrefix)
+		p.adopted = true
 	} else {
-		// pool already initialized.  Need to validate nothing changed.
-		log.Info("Pool already initialized.")
+		if err := p.allocator.deleteOrphans(ctx, prefix); err != nil {
+			return err
+		}
+		var err error
+		if ipamPrefix, err = p.allocator.ipam.NewPrefix(ctx, prefix.String()); err != nil {
+			return err
+		}
+		log.Infof("Created prefix %v", ipamPrefix)
+
+		// The allocator blocks the first and last address of a prefix.
+		prefixRange := netipx.RangeOfPrefix(prefix)
+		for _, addr := range []netip.Addr{prefixRange.From(), prefixRange.To()} {
+			if !allowed.Contains(addr) {
+				continue
+			}
+			err := p.allocator.ipam.ReleaseIPFromPrefix(ctx, ipamPrefix.Cidr, addr.String())
+			if err != nil && !errors.Is(err, goipam.ErrNotFound) {
+				return err
+			}
+		}
 	}
+	p.Prefixes = append(p.Prefixes, ipamPrefix.Cidr)
 
+	var paddingBuilder netipx.IPSetBuilder
+	paddingBuilder.AddPrefix(prefix)
+	paddingBuilder.RemoveSet(allowed)
+	padding, err := paddingBuilder.IPSet()
+	if err != nil {
+		return err
+	}
+	for _, paddingRange := range padding.Ranges() {
+		for addr := paddingRange.From(); paddingRange.Contains(addr); addr = addr.Next() {
+			_, err := p.allocator.ipam.AcquireSpecificIP(ctx, ipamPrefix.Cidr, addr.String())
+			if err != nil && !errors.Is(err, goipam.ErrAlreadyAllocated) {
+				return err
+			}
+		}
+		p.blocked += rangeSize(paddingRange)
+	}
 	return nil
 }
 
-func RemovePool(ctx context.Context, pool string) error {
+// inUse reports whether an allocator prefix backs a loaded pool.
+func (a *GoIPAMAllocator) inUse(cidr string) bool {
+	a.ipamsMu.RLock()
+	defer a.ipamsMu.RUnlock()
+	for _, poolInfo := range a.ipams {
+		for _, prefix := range poolInfo.Prefixes {
+			if prefix == cidr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deleteOrphans removes prefixes overlapping prefix which were left in
+// storage by an earlier run and don't back any loaded pool, typically because
+// the pool's ranges changed while the controller was down.
+func (a *GoIPAMAllocator) deleteOrphans(ctx context.Context, prefix netip.Prefix) error {
+	cidrs, err := a.storage.ReadAllPrefixCidrs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cidr := range cidrs {
+		existing, err := netip.ParsePrefix(cidr)
+		if err != nil || !existing.Overlaps(prefix) || a.inUse(cidr) {
+			continue
+		}
+		orphan := a.ipam.PrefixFrom(ctx, cidr)
+		if orphan == nil {
+			continue
+		}
+		log.Infof("Removing orphaned prefix %v", cidr)
+		if _, err := a.storage.DeletePrefix(ctx, *orphan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePrefix removes an allocator prefix along with any addresses still
+// acquired from it.  The allocator itself refuses to delete prefixes with
+// acquired addresses, which every prefix padding a range has.
+func (p *PoolInfo) deletePrefix(ctx context.Context, cidr string) error {
+	prefix := p.allocator.ipam.PrefixFrom(ctx, cidr)
+	if prefix == nil {
+		return fmt.Errorf("%w: unable to find prefix for cidr:%s", goipam.ErrNotFound, cidr)
+	}
+	_, err := p.allocator.storage.DeletePrefix(ctx, *prefix)
+	return err
+}
+
+func (a *GoIPAMAllocator) RemovePool(ctx context.Context, pool string) error {
+	a.layoutMu.Lock()
+	defer a.layoutMu.Unlock()
+	return a.removePool(ctx, pool)
+}
+
+func (a *GoIPAMAllocator) removePool(ctx context.Context, pool string) error {
 	var err error
 	// Remove associated IPAddresses
-	ippool := ipams[pool]
+	ippool := a.loadedPool(pool)
 	if ippool.IPPool != nil {
 		log.Info("Removing Prefix...")
-		ips := ippool.Prefix
-		_, err = ipam.DeletePrefix(ctx, ips.Cidr)
+		for _, cidr := range ippool.Prefixes {
+			if deleteErr := ippool.deletePrefix(ctx, cidr); deleteErr != nil {
+				log.Warnf("Unable to remove prefix %v: %v", cidr, deleteErr)
+				err = deleteErr
+			}
+		}
 	}
 
 	// Remove Pool
-	ipams[pool] = PoolInfo{}
+	a.storePool(pool, PoolInfo{})
 	return err
 }
 
-func ClaimIPAddress(ctx context.Context, pool *v1.IPPool, address ipamv1.IPAddress) error {
-	poolInfo := ipams[poolKey(pool)]
+func (a *GoIPAMAllocator) ClaimIPAddress(ctx context.Context, pool *v1.IPPool, address ipamv1.IPAddress) error {
+	poolInfo := a.loadedPool(poolKey(pool))
 	if poolInfo.IPPool == nil {
-		return errors.New("pool not initialized")
+		return ErrPoolNotInitialized
+	}
+
+	parsedIP, err := netip.ParseAddr(address.Spec.Address)
+	if err != nil {
+		return err
+	}
+	cidr, err := poolInfo.prefixFor(parsedIP)
+	if err != nil {
+		return err
 	}
 
-	_, err := ipam.AcquireSpecificIP(ctx, poolInfo.Prefix.Cidr, address.Spec.Address)
+	_, err = a.ipam.AcquireSpecificIP(ctx, cidr, address.Spec.Address)
+	if errors.Is(err, goipam.ErrAlreadyAllocated) {
+		log.Debugf("IP %v is already claimed for pool %v", address.Spec.Address, pool.Name)
+		return poolInfo.adopt(address)
+	}
 	if err != nil {
 		return err
 	}
 	log.Infof("IP %v has been claimed for pool %v", address.Spec.Address, pool.Name)
+	poolInfo.owners.add(address)
+
+	return nil
+}
 
+// adopt records an address the allocator already holds as held by address,
+// unless it was handed out or claimed for another IPAddress.
+func (p PoolInfo) adopt(address ipamv1.IPAddress) error {
+	if owner, ok := p.owners.owner(address.Spec.Address); ok && owner != address.Name {
+		return fmt.Errorf("%w: address %v of pool %v is held by IPAddress %v", ErrAddressInUse, address.Spec.Address, p.IPPool.Name, owner)
+	}
+	p.owners.add(address)
 	return nil
 }
 
-func GetIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+// ClaimIPAddresses marks the addresses of IPAddresses as used in the pool.
+// Addresses the allocator already holds are only checked against the pool,
+// so reloading a pool adopted from storage costs one read per prefix rather
+// than one per IPAddress.  The reason an IPAddress could not be claimed is
+// returned keyed by its name.
+func (a *GoIPAMAllocator) ClaimIPAddresses(ctx context.Context, pool *v1.IPPool, addresses []ipamv1.IPAddress) (map[string]error, error) {
+	poolInfo := a.loadedPool(poolKey(pool))
+	if poolInfo.IPPool == nil {
+		return nil, ErrPoolNotInitialized
+	}
+
+	acquired := map[netip.Addr]bool{}
+	for _, cidr := range poolInfo.Prefixes {
+		prefix := a.ipam.PrefixFrom(ctx, cidr)
+		if prefix == nil {
+			return nil, fmt.Errorf("prefix %v not found", cidr)
+		}
+		addrs, err := acquiredAddresses(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			acquired[addr] = true
+		}
+	}
+
+	failures := map[string]error{}
+	for _, address := range addresses {
+		parsedIP, err := netip.ParseAddr(address.Spec.Address)
+		if err != nil {
+			failures[address.Name] = err
+			continue
+		}
+		if _, err := poolInfo.prefixFor(parsedIP); err != nil {
+			failures[address.Name] = err
+			continue
+		}
+		if acquired[parsedIP] {
+			if err := poolInfo.adopt(address); err != nil {
+				failures[address.Name] = err
+			}
+			continue
+		}
+		if err := a.ClaimIPAddress(ctx, pool, address); err != nil {
+			failures[address.Name] = err
+		}
+	}
+	return failures, nil
+}
+
+func (a *GoIPAMAllocator) GetIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	return a.acquireIPAddress(ctx, ipClaim, ipClaim.Spec.PoolRef.Name, ipClaim.GetName())
+}
+
+// GetPairedIPAddress allocates the address of the other IP family for a
+// claim against a dual-stack pool.  Nil is returned when the claim's pool is
+// not paired with another pool.
+func (a *GoIPAMAllocator) GetPairedIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	poolInfo := a.loadedPool(fmt.Sprintf("%v/%v", ipClaim.Namespace, ipClaim.Spec.PoolRef.Name))
+	if poolInfo.IPPool == nil {
+		return nil, ErrPoolNotInitialized
+	}
+
+	pairedPool := poolInfo.IPPool.Spec.PairedPool
+	if pairedPool == "" {
+		return nil, nil
+	}
+	pairedInfo := a.loadedPool(fmt.Sprintf("%v/%v", ipClaim.Namespace, pairedPool))
+	if pairedInfo.IPPool == nil {
+		return nil, fmt.Errorf("paired pool %v: %w", pairedPool, ErrPoolNotInitialized)
+	}
+	if pairedInfo.IPv6 == poolInfo.IPv6 {
+		return nil, fmt.Errorf("paired pool %v has the same IP family as pool %v", pairedPool, poolInfo.IPPool.Name)
+	}
+
+	return a.acquireIPAddress(ctx, ipClaim, pairedPool, PairedAddressName(ipClaim.GetName(), pairedInfo.IPv6))
+}
+
+// PairedAddressName returns the name of the IPAddress allocated from the
+// paired pool of a dual-stack claim.
+func PairedAddressName(claimName string, ipv6 bool) string {
+	if ipv6 {
+		return claimName + "-ipv6"
+	}
+	return claimName + "-ipv4"
+}
+
+// acquireIPAddress allocates an address from poolName and returns it as an
+// IPAddress named name.
+func (a *GoIPAMAllocator) acquireIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim, poolName string, name string) (*ipamv1.IPAddress, error) {
 	var ipAddrs []string
 
-	poolInfo := ipams[fmt.Sprintf("%v/%v", ipClaim.Namespace, ipClaim.Spec.PoolRef.Name)]
+	poolInfo := a.loadedPool(fmt.Sprintf("%v/%v", ipClaim.Namespace, poolName))
 	if poolInfo.IPPool == nil {
-		return nil, errors.New("pool not initialized")
+		return nil, ErrPoolNotInitialized
 	}
 
-	ipAddr, err := ipam.AcquireIP(ctx, poolInfo.Prefix.Cidr)
-	if err != nil {
-		return nil, err
+	for _, cidr := range poolInfo.Prefixes {
+		ipAddr, err := a.ipam.AcquireIP(ctx, cidr)
+		if errors.Is(err, goipam.ErrNoIPAvailable) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ipAddrs = append(ipAddrs, fmt.Sprintf("%v", ipAddr.IP.String()))
+		break
+	}
+	if len(ipAddrs) == 0 {
+		return nil, fmt.Errorf("%w: no addresses left in pool %v", ErrPoolExhausted, poolName)
 	}
-	ipAddrs = append(ipAddrs, fmt.Sprintf("%v", ipAddr.IP.String()))
+
+	ipAddress := NewIPAddress(ipClaim, poolInfo.IPPool, name, ipAddrs[0])
+	poolInfo.owners.add(*ipAddress)
+	return ipAddress, nil
+}
+
+// NewIPAddress returns an IPAddress named name which binds address of pool
+// to the claim.
+func NewIPAddress(ipClaim *ipamv1.IPAddressClaim, pool *v1.IPPool, name string, address string) *ipamv1.IPAddress {
 	apiGroup := "ipamcontroller.openshift.io"
 	ipAddress := ipamv1.IPAddress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      ipClaim.GetName(),
+			Name:      name,
 			Namespace: ipClaim.GetNamespace(),
 		},
 		Spec: ipamv1.IPAddressSpec{
-			Address: ipAddrs[0],
+			Address: address,
 			ClaimRef: corev1.LocalObjectReference{
 				Name: ipClaim.GetName(),
 			},
-			Gateway: poolInfo.IPPool.Spec.Gateway,
+			Gateway: pool.Spec.Gateway,
 			PoolRef: corev1.TypedLocalObjectReference{
 				APIGroup: &apiGroup,
 				Kind:     "IPPool",
-				Name:     ipClaim.Spec.PoolRef.Name,
+				Name:     pool.Name,
 			},
-			Prefix: poolInfo.IPPool.Spec.Prefix,
+			Prefix: pool.Spec.Prefix,
 		},
 	}
 
-	return &ipAddress, nil
+	return &ipAddress
 }
 
-func ReleaseIPConfiguration(ctx context.Context, ipAddr *ipamv1.IPAddress) error {
+func (a *GoIPAMAllocator) ReleaseIPConfiguration(ctx context.Context, ipAddr *ipamv1.IPAddress) error {
 	address := ipAddr.Spec.Address
 	if address == "" {
 		return errors.New("no IP addresses associated with the interface")
@@ -130,12 +744,162 @@ func ReleaseIPConfiguration(ctx context.Context, ipAddr *ipamv1.IPAddress) error
 	}
 	log.Infof("Converted Addr: %v", parsedIP)
 
-	poolInfo := ipams[fmt.Sprintf("%v/%v", ipAddr.Namespace, ipAddr.Spec.PoolRef.Name)]
+	poolInfo := a.loadedPool(fmt.Sprintf("%v/%v", ipAddr.Namespace, ipAddr.Spec.PoolRef.Name))
+	if poolInfo.IPPool == nil {
+		return ErrPoolNotInitialized
+	}
+	cidr, err := poolInfo.prefixFor(parsedIP)
+	if errors.Is(err, ErrAddressExcluded) || errors.Is(err, ErrAddressOutOfRange) {
+		// Excluded and out of range addresses are never acquired, so there is
+		// nothing to release.
+		log.Infof("Not releasing IP %v: %v", parsedIP, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner, ok := poolInfo.owners.owner(address); ok && owner != ipAddr.Name {
+		// The IPAddress duplicated the address of another one, which keeps it
+		log.Infof("Not releasing IP %v: held by IPAddress %v", parsedIP, owner)
+		return nil
+	}
 	ip := &goipam.IP{
 		IP:           parsedIP,
-		ParentPrefix: poolInfo.Prefix.Cidr,
+		ParentPrefix: cidr,
 	}
 	log.Info("Releasing IP from pool")
-	_, err = ipam.ReleaseIP(ctx, ip)
-	return err
+	if _, err := a.ipam.ReleaseIP(ctx, ip); err != nil {
+		return err
+	}
+	poolInfo.owners.remove(address)
+	return nil
+}
+
+// GetPoolUsage reports the address usage of an initialized pool.
+func (a *GoIPAMAllocator) GetPoolUsage(ctx context.Context, pool *v1.IPPool) (*PoolUsage, error) {
+	poolInfo := a.loadedPool(poolKey(pool))
+	if poolInfo.IPPool == nil {
+		return nil, ErrPoolNotInitialized
+	}
+
+	usage := &PoolUsage{
+		Total:    poolInfo.Total,
+		Reserved: poolInfo.Reserved,
+	}
+	for _, cidr := range poolInfo.Prefixes {
+		prefix := a.ipam.PrefixFrom(ctx, cidr)
+		if prefix == nil {
+			return nil, fmt.Errorf("prefix %v not found", cidr)
+		}
+		usage.Allocated += int64(prefix.Usage().AcquiredIPs)
+	}
+	usage.Allocated -= poolInfo.blocked
+
+	return usage, nil
+}
+
+// ReleaseUnclaimedAddresses releases the addresses of a pool adopted from
+// storage which are no longer held by any of the given addresses, such as
+// those of IPAddresses deleted while the controller was down.  It does nothing
+// for pools built from scratch.
+func (a *GoIPAMAllocator) ReleaseUnclaimedAddresses(ctx context.Context, pool *v1.IPPool, addresses []string) ([]string, error) {
+	key := poolKey(pool)
+	poolInfo := a.loadedPool(key)
+	if poolInfo.IPPool == nil {
+		return nil, ErrPoolNotInitialized
+	}
+	if !poolInfo.adopted {
+		return nil, nil
+	}
+
+	inUse := map[string]bool{}
+	for _, address := range addresses {
+		if addr, err := netip.ParseAddr(address); err == nil {
+			inUse[addr.String()] = true
+		}
+	}
+
+	var released []string
+	for _, cidr := range poolInfo.Prefixes {
+		prefix := a.ipam.PrefixFrom(ctx, cidr)
+		if prefix == nil {
+			return released, fmt.Errorf("prefix %v not found", cidr)
+		}
+		acquired, err := acquiredAddresses(prefix)
+		if err != nil {
+			return released, err
+		}
+		for _, addr := range acquired {
+			if inUse[addr.String()] || !poolInfo.available.Contains(addr) {
+				continue
+			}
+			if err := a.ipam.ReleaseIPFromPrefix(ctx, cidr, addr.String()); err != nil && !errors.Is(err, goipam.ErrNotFound) {
+				return released, err
+			}
+			log.Infof("Released unclaimed IP %v from pool %v", addr, pool.Name)
+			poolInfo.owners.remove(addr.String())
+			released = append(released, addr.String())
+		}
+	}
+
+	a.ipamsMu.Lock()
+	if current := a.ipams[key]; current.IPPool != nil {
+		current.adopted = false
+		a.ipams[key] = current
+	}
+	a.ipamsMu.Unlock()
+	return released, nil
+}
+
+// acquiredAddresses returns the addresses acquired from an allocator prefix.
+func acquiredAddresses(prefix *goipam.Prefix) ([]netip.Addr, error) {
+	state, err := newPrefixState(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired []netip.Addr
+	for ip := range state.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, err
+		}
+		acquired = append(acquired, addr)
+	}
+	return acquired, nil
+}
+
+// SummarizeAddresses sorts the given addresses and collapses runs of
+// consecutive addresses into first-last ranges.  Unparseable addresses are
+// returned as-is at the end of the list.
+func SummarizeAddresses(addresses []string) []string {
+	var parsed []netip.Addr
+	var invalid []string
+	for _, address := range addresses {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			invalid = append(invalid, address)
+			continue
+		}
+		parsed = append(parsed, addr)
+	}
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].Less(parsed[j])
+	})
+
+	var summary []string
+	for i := 0; i < len(parsed); {
+		first := parsed[i]
+		last := first
+		for i++; i < len(parsed) && parsed[i] == last.Next(); i++ {
+			last = parsed[i]
+		}
+		if first == last {
+			summary = append(summary, first.String())
+		} else {
+			summary = append(summary, fmt.Sprintf("%v-%v", first, last))
+		}
+	}
+
+	return append(summary, invalid...)
 }
@@ -0,0 +1,162 @@
+package mgmt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	goipam "github.com/metal-stack/go-ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+func TestInitializePoolRebuilds(t *testing.T) {
+	ctx := context.Background()
+	allocator := NewGoIPAMAllocator(goipam.NewMemory())
+	pool := &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec:       v1.IPPoolSpec{AddressCidr: "192.168.1.0/29", Prefix: 24, Gateway: "192.168.1.1"},
+	}
+
+	rebuilt, err := allocator.InitializePool(ctx, pool)
+	if err != nil || !rebuilt {
+		t.Fatalf("expected the pool to be built, got %v, %v", rebuilt, err)
+	}
+
+	updated := pool.DeepCopy()
+	updated.Spec.Nameserver = []string{"192.168.1.53"}
+	if rebuilt, err := allocator.InitializePool(ctx, updated); err != nil || rebuilt {
+		t.Fatalf("expected a nameserver change to keep the pool, got %v, %v", rebuilt, err)
+	}
+
+	updated = updated.DeepCopy()
+	updated.Spec.Gateway = "192.168.1.6"
+	if rebuilt, err := allocator.InitializePool(ctx, updated); err != nil || rebuilt {
+		t.Fatalf("expected a gateway change to keep the pool, got %v, %v", rebuilt, err)
+	}
+
+	updated = updated.DeepCopy()
+	updated.Spec.Excludes = []string{"192.168.1.2"}
+	if rebuilt, err := allocator.InitializePool(ctx, updated); err != nil || !rebuilt {
+		t.Fatalf("expected an excludes change to rebuild the pool, got %v, %v", rebuilt, err)
+	}
+}
+
+func TestInitializePoolGatewayChange(t *testing.T) {
+	ctx := context.Background()
+	allocator := NewGoIPAMAllocator(goipam.NewMemory())
+	pool := &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec:       v1.IPPoolSpec{AddressCidr: "192.168.1.0/29", Prefix: 24, Gateway: "192.168.1.1"},
+	}
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+
+	held, err := allocator.GetIPAddress(ctx, testClaim(pool, "held"))
+	if err != nil {
+		t.Fatalf("unable to get address: %v", err)
+	}
+	if held.Spec.Address != "192.168.1.2" {
+		t.Fatalf("got %v, want 192.168.1.2", held.Spec.Address)
+	}
+
+	// Move the gateway onto the address already handed out.
+	updated := pool.DeepCopy()
+	updated.Spec.Gateway = "192.168.1.2"
+	if _, err := allocator.InitializePool(ctx, updated); err != nil {
+		t.Fatalf("unable to update pool: %v", err)
+	}
+	failures, err := allocator.ClaimIPAddresses(ctx, updated, []ipamv1.IPAddress{*held})
+	if err != nil {
+		t.Fatalf("unable to claim addresses: %v", err)
+	}
+	if !errors.Is(failures[held.Name], ErrAddressExcluded) {
+		t.Errorf("expected the address on the new gateway to be excluded, got %v", failures[held.Name])
+	}
+
+	usage, err := allocator.GetPoolUsage(ctx, updated)
+	if err != nil {
+		t.Fatalf("unable to get usage: %v", err)
+	}
+	if usage.Reserved != 3 || usage.Allocated != 0 || usage.Free() != 5 {
+		t.Errorf("got usage %+v, want 3 reserved, 0 allocated and 5 free", usage)
+	}
+
+	// The old gateway is handed out along with the rest of the pool, the new
+	// one never is.
+	seen := map[string]bool{}
+	for {
+		ip, err := allocator.GetIPAddress(ctx, testClaim(updated, "claim"))
+		if errors.Is(err, ErrPoolExhausted) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unable to get address: %v", err)
+		}
+		seen[ip.Spec.Address] = true
+	}
+	if !seen["192.168.1.1"] || seen["192.168.1.2"] || len(seen) != 5 {
+		t.Errorf("got addresses %v, want 192.168.1.1 and 192.168.1.3-192.168.1.6", seen)
+	}
+}
+
+func TestClaimIPAddressOwnership(t *testing.T) {
+	ctx := context.Background()
+	allocator := NewGoIPAMAllocator(goipam.NewMemory())
+	pool := &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec:       v1.IPPoolSpec{AddressCidr: "192.168.1.0/29", Prefix: 24, Gateway: "192.168.1.1"},
+	}
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+
+	held, err := allocator.GetIPAddress(ctx, testClaim(pool, "held"))
+	if err != nil {
+		t.Fatalf("unable to get address: %v", err)
+	}
+	if err := allocator.ClaimIPAddress(ctx, pool, *held); err != nil {
+		t.Errorf("expected the address to be claimed again for its IPAddress, got %v", err)
+	}
+	duplicate := *NewIPAddress(testClaim(pool, "duplicate"), pool, "duplicate", held.Spec.Address)
+	if err := allocator.ClaimIPAddress(ctx, pool, duplicate); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("expected the address of another IPAddress to be in use, got %v", err)
+	}
+	failures, err := allocator.ClaimIPAddresses(ctx, pool, []ipamv1.IPAddress{duplicate})
+	if err != nil {
+		t.Fatalf("unable to claim addresses: %v", err)
+	}
+	if !errors.Is(failures[duplicate.Name], ErrAddressInUse) {
+		t.Errorf("expected the address of another IPAddress to be in use, got %v", failures[duplicate.Name])
+	}
+
+	// Releasing the duplicate leaves the address with its IPAddress.
+	if err := allocator.ReleaseIPConfiguration(ctx, &duplicate); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	if err := allocator.ClaimIPAddress(ctx, pool, duplicate); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("expected the address to stay held, got %v", err)
+	}
+	if err := allocator.ReleaseIPConfiguration(ctx, held); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	if err := allocator.ClaimIPAddress(ctx, pool, duplicate); err != nil {
+		t.Errorf("expected the released address to be claimed, got %v", err)
+	}
+
+	// Addresses acquired before the pool was loaded are adopted by the first
+	// IPAddress claiming them.
+	reloaded := NewGoIPAMAllocator(allocator.storage)
+	if _, err := reloaded.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+	if err := reloaded.ClaimIPAddress(ctx, pool, duplicate); err != nil {
+		t.Errorf("expected the stored address to be adopted, got %v", err)
+	}
+	if err := reloaded.ClaimIPAddress(ctx, pool, *held); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("expected the adopted address to be in use, got %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package mgmt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+
+	goipam "github.com/metal-stack/go-ipam"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PrefixStoreLabel marks the ConfigMaps holding allocator prefixes.
+	PrefixStoreLabel = "ipamcontroller.openshift.io/allocator-prefix"
+
+	prefixCidrKey    = "cidr"
+	prefixVersionKey = "version"
+	prefixDataKey    = "prefix"
+)
+
+// kubernetesStorage keeps every allocator prefix in a ConfigMap, so that the
+// allocator's state survives restarts without an external database.  Each
+// ConfigMap holds the gzipped gob encoding of its prefix along with the
+// prefix's version.  Updates are rejected unless both the version and the
+// ConfigMap's resourceVersion match what was read, which makes concurrent
+// writers retry instead of overwriting each other.
+type kubernetesStorage struct {
+	client    client.Client
+	namespace string
+}
+
+// NewKubernetesStorage returns a storage keeping prefixes in ConfigMaps in
+// namespace.  The client should read from the API server rather than a cache.
+func NewKubernetesStorage(c client.Client, namespace string) goipam.Storage {
+	return &kubernetesStorage{
+		client:    c,
+		namespace: namespace,
+	}
+}
+
+func (s *kubernetesStorage) Name() string {
+	return "kubernetes"
+}
+
+// configMapName derives a valid object name from the prefix's key, which
+// may hold characters such as ':' and '/'.
+func configMapName(cidr string) string {
+	sum := sha256.Sum256([]byte(cidr))
+	return "ipam-prefix-" + hex.EncodeToString(sum[:16])
+}
+
+func (s *kubernetesStorage) namespacedName(cidr string) types.NamespacedName {
+	return types.NamespacedName{Namespace: s.namespace, Name: configMapName(cidr)}
+}
+
+func (s *kubernetesStorage) get(ctx context.Context, cidr string) (*corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := s.client.Get(ctx, s.namespacedName(cidr), configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: prefix %s not found", goipam.ErrNotFound, cidr)
+		}
+		return nil, err
+	}
+	return configMap, nil
+}
+
+// encode stores the prefix in the ConfigMap.
+func encode(configMap *corev1.ConfigMap, state *prefixState) error {
+	encoded, err := state.encode()
+	if err != nil {
+		return err
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(encoded); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	configMap.Data = map[string]string{
+		prefixCidrKey:    state.Cidr,
+		prefixVersionKey: strconv.FormatInt(state.Version, 10),
+	}
+	configMap.BinaryData = map[string][]byte{
+		prefixDataKey: compressed.Bytes(),
+	}
+	return nil
+}
+
+// decode reads the prefix stored in the ConfigMap.
+func decode(configMap *corev1.ConfigMap) (*prefixState, error) {
+	r, err := gzip.NewReader(bytes.NewReader(configMap.BinaryData[prefixDataKey]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prefix from ConfigMap %v: %w", configMap.Name, err)
+	}
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read prefix from ConfigMap %v: %w", configMap.Name, err)
+	}
+	return decodePrefixState(encoded)
+}
+
+func (s *kubernetesStorage) CreatePrefix(ctx context.Context, prefix goipam.Prefix) (goipam.Prefix, error) {
+	state, err := newPrefixState(&prefix)
+	if err != nil {
+		return goipam.Prefix{}, err
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configMapName(prefix.Cidr),
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				PrefixStoreLabel: "true",
+			},
+		},
+	}
+	if err := encode(configMap, state); err != nil {
+		return goipam.Prefix{}, err
+	}
+	if err := s.client.Create(ctx, configMap); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return goipam.Prefix{}, fmt.Errorf("prefix already created:%v", prefix.Cidr)
+		}
+		return goipam.Prefix{}, err
+	}
+	return prefix, nil
+}
+
+func (s *kubernetesStorage) ReadPrefix(ctx context.Context, prefix string) (goipam.Prefix, error) {
+	configMap, err := s.get(ctx, prefix)
+	if err != nil {
+		return goipam.Prefix{}, err
+	}
+	state, err := decode(configMap)
+	if err != nil {
+		return goipam.Prefix{}, err
+	}
+	return state.prefix()
+}
+
+func (s *kubernetesStorage) DeleteAllPrefixes(ctx context.Context) error {
+	return s.client.DeleteAllOf(ctx, &corev1.ConfigMap{},
+		client.InNamespace(s.namespace), client.MatchingLabels{PrefixStoreLabel: "true"})
+}
+
+func (s *kubernetesStorage) list(ctx context.Context) ([]corev1.ConfigMap, error) {
+	configMaps := &corev1.ConfigMapList{}
+	err := s.client.List(ctx, configMaps,
+		client.InNamespace(s.namespace), client.MatchingLabels{PrefixStoreLabel: "true"})
+	return configMaps.Items, err
+}
+
+func (s *kubernetesStorage) ReadAllPrefixes(ctx context.Context) (goipam.Prefixes, error) {
+	configMaps, err := s.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make(goipam.Prefixes, 0, len(configMaps))
+	for i := range configMaps {
+		state, err := decode(&configMaps[i])
+		if err != nil {
+			return nil, err
+		}
+		prefix, err := state.prefix()
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func (s *kubernetesStorage) ReadAllPrefixCidrs(ctx context.Context) ([]string, error) {
+	configMaps, err := s.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cidrs := make([]string, 0, len(configMaps))
+	for _, configMap := range configMaps {
+		cidrs = append(cidrs, configMap.Data[prefixCidrKey])
+	}
+	return cidrs, nil
+}
+
+func (s *kubernetesStorage) UpdatePrefix(ctx context.Context, prefix goipam.Prefix) (goipam.Prefix, error) {
+	if prefix.Cidr == "" {
+		return goipam.Prefix{}, fmt.Errorf("prefix not present:%v", prefix)
+	}
+	state, err := newPrefixState(&prefix)
+	if err != nil {
+		return goipam.Prefix{}, err
+	}
+	configMap, err := s.get(ctx, prefix.Cidr)
+	if err != nil {
+		return goipam.Prefix{}, err
+	}
+	if configMap.Data[prefixVersionKey] != strconv.FormatInt(state.Version, 10) {
+		return goipam.Prefix{}, fmt.Errorf("%w: unable to update prefix:%s", goipam.ErrOptimisticLockError, prefix.Cidr)
+	}
+
+	state.Version++
+	if err := encode(configMap, state); err != nil {
+		return goipam.Prefix{}, err
+	}
+	if err := s.client.Update(ctx, configMap); err != nil {
+		if apierrors.IsConflict(err) {
+			return goipam.Prefix{}, fmt.Errorf("%w: unable to update prefix:%s", goipam.ErrOptimisticLockError, prefix.Cidr)
+		}
+		return goipam.Prefix{}, err
+	}
+	return state.prefix()
+}
+
+func (s *kubernetesStorage) DeletePrefix(ctx context.Context, prefix goipam.Prefix) (goipam.Prefix, error) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configMapName(prefix.Cidr),
+			Namespace: s.namespace,
+		},
+	}
+	if err := s.client.Delete(ctx, configMap); err != nil && !apierrors.IsNotFound(err) {
+		return goipam.Prefix{}, err
+	}
+	return prefix, nil
+}
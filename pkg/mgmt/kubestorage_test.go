@@ -0,0 +1,141 @@
+package mgmt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	goipam "github.com/metal-stack/go-ipam"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestKubernetesStorageRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	storage := NewKubernetesStorage(c, "ns")
+
+	ipam := goipam.NewWithStorage(storage)
+	for _, cidr := range []string{"192.168.1.0/29", "fd00::/126"} {
+		if _, err := ipam.NewPrefix(ctx, cidr); err != nil {
+			t.Fatalf("unable to create prefix %v: %v", cidr, err)
+		}
+	}
+	if _, err := ipam.AcquireSpecificIP(ctx, "192.168.1.0/29", "192.168.1.3"); err != nil {
+		t.Fatalf("unable to acquire address: %v", err)
+	}
+	if _, err := ipam.NewPrefix(ctx, "192.168.1.0/29"); err == nil {
+		t.Errorf("expected creating an existing prefix to fail")
+	}
+
+	configMaps := &corev1.ConfigMapList{}
+	if err := c.List(ctx, configMaps, client.InNamespace("ns"), client.MatchingLabels{PrefixStoreLabel: "true"}); err != nil {
+		t.Fatalf("unable to list ConfigMaps: %v", err)
+	}
+	if len(configMaps.Items) != 2 {
+		t.Fatalf("got %v ConfigMaps, want 2", len(configMaps.Items))
+	}
+
+	// A second allocator on the same storage sees the first one's state.
+	other := goipam.NewWithStorage(NewKubernetesStorage(c, "ns"))
+	prefix := other.PrefixFrom(ctx, "192.168.1.0/29")
+	if prefix == nil {
+		t.Fatalf("prefix not found")
+	}
+	state, err := newPrefixState(prefix)
+	if err != nil {
+		t.Fatalf("unable to decode prefix: %v", err)
+	}
+	if !state.IPs["192.168.1.3"] {
+		t.Errorf("expected 192.168.1.3 to be acquired, got %v", state.IPs)
+	}
+	if _, err := other.AcquireSpecificIP(ctx, "192.168.1.0/29", "192.168.1.3"); !errors.Is(err, goipam.ErrAlreadyAllocated) {
+		t.Errorf("expected the address to be allocated already, got %v", err)
+	}
+
+	cidrs, err := storage.ReadAllPrefixCidrs(ctx)
+	if err != nil {
+		t.Fatalf("unable to read prefixes: %v", err)
+	}
+	if len(cidrs) != 2 {
+		t.Errorf("got %v, want both prefixes", cidrs)
+	}
+	prefixes, err := storage.ReadAllPrefixes(ctx)
+	if err != nil {
+		t.Fatalf("unable to read prefixes: %v", err)
+	}
+	if len(prefixes) != 2 {
+		t.Errorf("got %v prefixes, want 2", len(prefixes))
+	}
+
+	if _, err := storage.DeletePrefix(ctx, *prefix); err != nil {
+		t.Fatalf("unable to delete prefix: %v", err)
+	}
+	if _, err := storage.ReadPrefix(ctx, "192.168.1.0/29"); !errors.Is(err, goipam.ErrNotFound) {
+		t.Errorf("expected the deleted prefix not to be found, got %v", err)
+	}
+	if err := storage.DeleteAllPrefixes(ctx); err != nil {
+		t.Fatalf("unable to delete prefixes: %v", err)
+	}
+	if cidrs, err := storage.ReadAllPrefixCidrs(ctx); err != nil || len(cidrs) != 0 {
+		t.Errorf("got %v, %v after deleting every prefix", cidrs, err)
+	}
+}
+
+func TestKubernetesStorageVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	storage := NewKubernetesStorage(c, "ns")
+	ipam := goipam.NewWithStorage(storage)
+	if _, err := ipam.NewPrefix(ctx, "192.168.1.0/29"); err != nil {
+		t.Fatalf("unable to create prefix: %v", err)
+	}
+
+	stale, err := storage.ReadPrefix(ctx, "192.168.1.0/29")
+	if err != nil {
+		t.Fatalf("unable to read prefix: %v", err)
+	}
+	if _, err := ipam.AcquireSpecificIP(ctx, "192.168.1.0/29", "192.168.1.2"); err != nil {
+		t.Fatalf("unable to acquire address: %v", err)
+	}
+	if _, err := storage.UpdatePrefix(ctx, stale); !errors.Is(err, goipam.ErrOptimisticLockError) {
+		t.Errorf("expected a stale prefix version to be rejected, got %v", err)
+	}
+
+	// A writer racing between the read and the write of an update is caught
+	// by the ConfigMap's resourceVersion.
+	current, err := storage.ReadPrefix(ctx, "192.168.1.0/29")
+	if err != nil {
+		t.Fatalf("unable to read prefix: %v", err)
+	}
+	racing := NewKubernetesStorage(&racingClient{Client: c}, "ns")
+	if _, err := racing.UpdatePrefix(ctx, current); !errors.Is(err, goipam.ErrOptimisticLockError) {
+		t.Errorf("expected a concurrent update to be rejected, got %v", err)
+	}
+
+	if _, err := ipam.AcquireSpecificIP(ctx, "192.168.1.0/29", "192.168.1.3"); err != nil {
+		t.Errorf("unable to acquire address after a conflict: %v", err)
+	}
+}
+
+// racingClient updates every ConfigMap behind the caller's back right before
+// the caller updates it.
+type racingClient struct {
+	client.Client
+}
+
+func (c *racingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	current := &corev1.ConfigMap{}
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), current); err != nil {
+		return err
+	}
+	if current.Annotations == nil {
+		current.Annotations = map[string]string{}
+	}
+	current.Annotations["racing"] = current.ResourceVersion
+	if err := c.Client.Update(ctx, current); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
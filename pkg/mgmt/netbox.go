@@ -0,0 +1,713 @@
+package mgmt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go4.org/netipx"
+	"k8s.io/apimachinery/pkg/api/equality"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+const (
+	// netboxManagedTag marks the IP addresses created by the controller.
+	// Addresses without it are never deleted.
+	netboxManagedTag = "machine-ipam-controller"
+
+	netboxPageSize = 1000
+)
+
+// netboxPool is a pool loaded into the NetBox allocator.
+type netboxPool struct {
+	pool   *v1.IPPool
+	client *netboxClient
+
+	// addresses are the addresses of the prefix or IP range and parent is
+	// the smallest prefix containing them.
+	addresses netipx.IPRange
+	parent    netip.Prefix
+
+	// vrf is the VRF of the prefix or IP range, nil for the global table.
+	vrf *netboxVRF
+
+	// availablePath is the path of the prefix's or IP range's available-ips
+	// endpoint.
+	availablePath string
+
+	// secretVersion is the resourceVersion of the credentials secret the
+	// client was built from.
+	secretVersion string
+
+	// claimed holds the IPAddresses known to be held by their NetBox IP
+	// addresses.
+	claimed *claimedAddresses
+
+	// pruned is true once the addresses of deleted IPAddresses have been
+	// released.
+	pruned bool
+}
+
+// NetBoxAllocator hands out the addresses of pools from NetBox prefixes and
+// IP ranges through the REST API.  Every address handed out is created as a
+// NetBox IP address describing its claim and machine, and deleted when it is
+// released.
+type NetBoxAllocator struct {
+	// secrets reads the credentials of the pools.
+	secrets client.Reader
+
+	// mu guards pools and tags.
+	mu    sync.RWMutex
+	pools map[string]netboxPool
+
+	// tags holds the NetBox URLs the managed tag is known to exist in.
+	tags map[string]bool
+}
+
+var _ Allocator = &NetBoxAllocator{}
+
+// NewNetBoxAllocator returns an allocator for pools configured for NetBox.
+// Credentials are read with secrets.
+func NewNetBoxAllocator(secrets client.Reader) *NetBoxAllocator {
+	return &NetBoxAllocator{
+		secrets: secrets,
+		pools:   make(map[string]netboxPool),
+		tags:    make(map[string]bool),
+	}
+}
+
+func (a *NetBoxAllocator) loadedPool(key string) (netboxPool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	loaded, ok := a.pools[key]
+	if !ok {
+		return netboxPool{}, ErrPoolNotInitialized
+	}
+	return loaded, nil
+}
+
+// InitializePool reads the pool's credentials and looks up its prefix or IP
+// range in NetBox.  A loaded pool is only loaded again when its NetBox
+// settings or its credentials change.
+func (a *NetBoxAllocator) InitializePool(ctx context.Context, pool *v1.IPPool) (bool, error) {
+	config := pool.Spec.NetBox
+	if config == nil {
+		return false, fmt.Errorf("pool %v is not configured for NetBox", pool.Name)
+	}
+	creds, secretVersion, err := readCredentials(ctx, a.secrets, pool, config.CredentialsSecret)
+	if err != nil {
+		return false, err
+	}
+
+	key := poolKey(pool)
+	a.mu.Lock()
+	if current, ok := a.pools[key]; ok && current.secretVersion == secretVersion && equality.Semantic.DeepEqual(current.pool.Spec.NetBox, config) {
+		current.pool = pool
+		a.pools[key] = current
+		a.mu.Unlock()
+		return false, nil
+	}
+	a.mu.Unlock()
+
+	httpClient, err := creds.httpClient(config.InsecureSkipVerify)
+	if err != nil {
+		return false, err
+	}
+	loaded := netboxPool{
+		pool: pool,
+		client: &netboxClient{
+			http:  httpClient,
+			url:   baseURL(config.URL) + "/api/",
+			token: creds.get("token"),
+		},
+		secretVersion: secretVersion,
+		claimed:       newClaimedAddresses(),
+	}
+
+	query := url.Values{}
+	if config.VRF != "" {
+		vrfs, err := loaded.client.list(ctx, "ipam/vrfs/", url.Values{"name": {config.VRF}})
+		if err != nil {
+			return false, fmt.Errorf("unable to look up NetBox VRF %v: %w", config.VRF, err)
+		}
+		if len(vrfs) != 1 {
+			return false, fmt.Errorf("found %v NetBox VRFs named %v, want 1", len(vrfs), config.VRF)
+		}
+		var vrf netboxVRF
+		if err := json.Unmarshal(vrfs[0], &vrf); err != nil {
+			return false, err
+		}
+		query.Set("vrf_id", fmt.Sprint(vrf.ID))
+	}
+
+	var objects []json.RawMessage
+	objectPath := "ipam/prefixes/"
+	if config.Prefix != "" {
+		prefix, err := netip.ParsePrefix(config.Prefix)
+		if err != nil {
+			return false, fmt.Errorf("invalid NetBox prefix %v: %w", config.Prefix, err)
+		}
+		loaded.addresses = netipx.RangeOfPrefix(prefix.Masked())
+		loaded.parent = prefix.Masked()
+		query.Set("prefix", prefix.Masked().String())
+		objects, err = loaded.client.list(ctx, objectPath, query)
+		if err != nil {
+			return false, fmt.Errorf("unable to look up NetBox prefix %v: %w", prefix, err)
+		}
+	} else {
+		addressRange, err := ParseAddressRange(config.IPRange)
+		if err != nil {
+			return false, fmt.Errorf("invalid NetBox IP range %v: %w", config.IPRange, err)
+		}
+		loaded.addresses = addressRange.IPRange
+		loaded.parent = coveringPrefix(addressRange.IPRange)
+		objectPath = "ipam/ip-ranges/"
+		query.Set("start_address", addressRange.From().String())
+		query.Set("end_address", addressRange.To().String())
+		objects, err = loaded.client.list(ctx, objectPath, query)
+		if err != nil {
+			return false, fmt.Errorf("unable to look up NetBox IP range %v: %w", addressRange.IPRange, err)
+		}
+	}
+	switch {
+	case len(objects) == 0:
+		return false, fmt.Errorf("%v not found in NetBox", ExternalNetwork(pool.Spec))
+	case len(objects) > 1:
+		return false, fmt.Errorf("%v matches %v NetBox objects, set the VRF of pool %v", ExternalNetwork(pool.Spec), len(objects), pool.Name)
+	}
+	var object struct {
+		ID  int        `json:"id"`
+		VRF *netboxVRF `json:"vrf"`
+	}
+	if err := json.Unmarshal(objects[0], &object); err != nil {
+		return false, err
+	}
+	loaded.vrf = object.VRF
+	loaded.availablePath = fmt.Sprintf("%v%d/available-ips/", objectPath, object.ID)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	current, ok := a.pools[key]
+	loaded.pruned = ok && current.pruned && equality.Semantic.DeepEqual(current.pool.Spec.NetBox, config)
+	a.pools[key] = loaded
+	return true, nil
+}
+
+// RemovePool forgets the pool.  Its IP addresses are deleted as its
+// IPAddresses are released.
+func (a *NetBoxAllocator) RemovePool(ctx context.Context, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pools, key)
+	return nil
+}
+
+// GetIPAddress creates the next available IP address of the pool's prefix or
+// IP range in NetBox.
+func (a *NetBoxAllocator) GetIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	loaded, err := a.loadedPool(fmt.Sprintf("%v/%v", ipClaim.Namespace, ipClaim.Spec.PoolRef.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := a.ipAddressFor(ctx, loaded, ipClaim.Namespace, ipClaim.Name, ClaimMachine(ipClaim))
+	if err != nil {
+		return nil, err
+	}
+	var created netboxIPAddress
+	if err := loaded.client.do(ctx, http.MethodPost, loaded.availablePath, nil, request, &created); err != nil {
+		var netboxErr *netboxError
+		if errors.As(err, &netboxErr) && netboxErr.StatusCode == http.StatusConflict {
+			return nil, fmt.Errorf("%w: no addresses left in %v of pool %v", ErrPoolExhausted, ExternalNetwork(loaded.pool.Spec), loaded.pool.Name)
+		}
+		return nil, err
+	}
+	address, err := created.addr()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("NetBox IP address %v holds IP %v for pool %v", created.ID, address, loaded.pool.Name)
+
+	ipAddress := NewIPAddress(ipClaim, loaded.pool, ipClaim.Name, address.String())
+	loaded.claimed.add(*ipAddress)
+	return ipAddress, nil
+}
+
+// GetPairedIPAddress is not supported, pairing is handled by the dispatcher.
+func (a *NetBoxAllocator) GetPairedIPAddress(ctx context.Context, ipClaim *ipamv1.IPAddressClaim) (*ipamv1.IPAddress, error) {
+	return nil, errors.New("paired pools are only supported through the dispatcher")
+}
+
+// ClaimIPAddress makes sure NetBox holds the address of an existing
+// IPAddress.  An address NetBox holds for something else, including another
+// claim, is reported as a conflict.
+func (a *NetBoxAllocator) ClaimIPAddress(ctx context.Context, pool *v1.IPPool, address ipamv1.IPAddress) error {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return err
+	}
+	parsedIP, err := loaded.parseAddress(address.Spec.Address)
+	if err != nil {
+		return err
+	}
+
+	existing, err := loaded.client.ipAddresses(ctx, loaded.query(url.Values{"address": {parsedIP.String()}}))
+	if err != nil {
+		return err
+	}
+	held, err := checkNetBoxIPAddresses(address, parsedIP, existing)
+	if err != nil {
+		return err
+	}
+	if !held {
+		if err := a.createIPAddress(ctx, loaded, address, parsedIP); err != nil {
+			return err
+		}
+	}
+	loaded.claimed.add(address)
+	return nil
+}
+
+// ClaimIPAddresses claims the addresses of the IPAddresses not known to be
+// held by their NetBox IP addresses yet.  The IP addresses of the pool's
+// prefix or IP range are looked up once for all of them.
+func (a *NetBoxAllocator) ClaimIPAddresses(ctx context.Context, pool *v1.IPPool, addresses []ipamv1.IPAddress) (map[string]error, error) {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return nil, err
+	}
+	failures := map[string]error{}
+	var unclaimed []ipamv1.IPAddress
+	for _, address := range addresses {
+		if !loaded.claimed.has(address) {
+			unclaimed = append(unclaimed, address)
+		}
+	}
+	if len(unclaimed) == 0 {
+		return failures, nil
+	}
+
+	existing, err := loaded.client.ipAddresses(ctx, loaded.query(url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	byAddress := map[netip.Addr][]netboxIPAddress{}
+	for _, ipAddress := range existing {
+		if addr, err := ipAddress.addr(); err == nil {
+			byAddress[addr] = append(byAddress[addr], ipAddress)
+		}
+	}
+
+	for _, address := range unclaimed {
+		parsedIP, err := loaded.parseAddress(address.Spec.Address)
+		if err != nil {
+			failures[address.Name] = err
+			continue
+		}
+		held, err := checkNetBoxIPAddresses(address, parsedIP, byAddress[parsedIP])
+		if err != nil {
+			failures[address.Name] = err
+			continue
+		}
+		if !held {
+			if err := a.createIPAddress(ctx, loaded, address, parsedIP); err != nil {
+				failures[address.Name] = err
+				continue
+			}
+		}
+		loaded.claimed.add(address)
+	}
+	return failures, nil
+}
+
+// createIPAddress creates the NetBox IP address holding the address of an
+// existing IPAddress.
+func (a *NetBoxAllocator) createIPAddress(ctx context.Context, loaded netboxPool, ipAddr ipamv1.IPAddress, address netip.Addr) error {
+	request, err := a.ipAddressFor(ctx, loaded, ipAddr.Namespace, ipAddr.Spec.ClaimRef.Name, "")
+	if err != nil {
+		return err
+	}
+	request.Address = netip.PrefixFrom(address, loaded.pool.Spec.Prefix).String()
+	request.VRF = loaded.vrf
+	if err := loaded.client.do(ctx, http.MethodPost, "ipam/ip-addresses/", nil, request, nil); err != nil {
+		return err
+	}
+	log.Infof("IP %v has been claimed in NetBox for pool %v", address, loaded.pool.Name)
+	return nil
+}
+
+// ReleaseIPConfiguration deletes the NetBox IP addresses the controller
+// created for the address on behalf of the IPAddress's claim.  NetBox IP
+// addresses of other claims holding the same address are left alone.
+func (a *NetBoxAllocator) ReleaseIPConfiguration(ctx context.Context, ipAddr *ipamv1.IPAddress) error {
+	loaded, err := a.loadedPool(fmt.Sprintf("%v/%v", ipAddr.Namespace, ipAddr.Spec.PoolRef.Name))
+	if err != nil {
+		return err
+	}
+	parsedIP, err := netip.ParseAddr(ipAddr.Spec.Address)
+	if err != nil {
+		return err
+	}
+
+	existing, err := loaded.client.ipAddresses(ctx, loaded.query(url.Values{"address": {parsedIP.String()}}))
+	if err != nil {
+		return err
+	}
+	description := netboxClaimDescription(ipAddr.Namespace, ipAddr.Spec.ClaimRef.Name)
+	for _, ipAddress := range existing {
+		if !ipAddress.owned() {
+			log.Warnf("Not deleting NetBox IP address %v of IP %v, it was not created by the controller", ipAddress.ID, parsedIP)
+			continue
+		}
+		if !strings.HasSuffix(ipAddress.Description, description) {
+			log.Warnf("Not deleting NetBox IP address %v of IP %v, it is held for %v", ipAddress.ID, parsedIP, ipAddress.Description)
+			continue
+		}
+		log.Infof("Deleting NetBox IP address %v of IP %v", ipAddress.ID, parsedIP)
+		if err := loaded.client.delete(ctx, ipAddress.ID); err != nil {
+			return err
+		}
+	}
+	loaded.claimed.forget(*ipAddr)
+	return nil
+}
+
+// GetPoolUsage counts the NetBox IP addresses in the pool's prefix or IP
+// range, including those not handed out by the controller.
+func (a *NetBoxAllocator) GetPoolUsage(ctx context.Context, pool *v1.IPPool) (*PoolUsage, error) {
+	loaded, err := a.loadedPool(poolKey(pool))
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &PoolUsage{
+		Total: rangeSize(loaded.addresses),
+	}
+	if pool.Spec.NetBox.Prefix != "" && loaded.parent.Addr().Is4() && loaded.parent.Bits() < 31 {
+		// Network and broadcast addresses
+		usage.Reserved = 2
+	}
+
+	existing, err := loaded.client.ipAddresses(ctx, loaded.query(url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	for _, ipAddress := range existing {
+		if addr, err := ipAddress.addr(); err == nil && loaded.addresses.Contains(addr) {
+			usage.Allocated++
+		}
+	}
+	return usage, nil
+}
+
+// ReleaseUnclaimedAddresses deletes the NetBox IP addresses the controller
+// created in the pool's prefix or IP range for IPAddresses which are gone.
+// It only looks for them once after the pool is loaded.
+func (a *NetBoxAllocator) ReleaseUnclaimedAddresses(ctx context.Context, pool *v1.IPPool, addresses []string) ([]string, error) {
+	key := poolKey(pool)
+	loaded, err := a.loadedPool(key)
+	if err != nil {
+		return nil, err
+	}
+	if loaded.pruned {
+		return nil, nil
+	}
+
+	inUse := map[netip.Addr]bool{}
+	for _, address := range addresses {
+		if addr, err := netip.ParseAddr(address); err == nil {
+			inUse[addr] = true
+		}
+	}
+
+	existing, err := loaded.client.ipAddresses(ctx, loaded.query(url.Values{"tag": {netboxManagedTag}}))
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	for _, ipAddress := range existing {
+		addr, err := ipAddress.addr()
+		if err != nil || !loaded.addresses.Contains(addr) || inUse[addr] || !ipAddress.owned() ||
+			!strings.Contains(ipAddress.Description, netboxClaimDescription(pool.Namespace, "")) {
+			continue
+		}
+		if err := loaded.client.delete(ctx, ipAddress.ID); err != nil {
+			return released, err
+		}
+		loaded.claimed.remove(addr.String())
+		log.Infof("Deleted NetBox IP address %v of unclaimed IP %v in pool %v", ipAddress.ID, addr, pool.Name)
+		released = append(released, addr.String())
+	}
+
+	a.mu.Lock()
+	if current, ok := a.pools[key]; ok {
+		current.pruned = true
+		a.pools[key] = current
+	}
+	a.mu.Unlock()
+	return released, nil
+}
+
+// parseAddress parses the address of an IPAddress of the pool.
+func (p netboxPool) parseAddress(address string) (netip.Addr, error) {
+	parsedIP, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !p.addresses.Contains(parsedIP) {
+		return netip.Addr{}, fmt.Errorf("%w: address %v is not in %v of pool %v", ErrAddressOutOfRange, parsedIP, ExternalNetwork(p.pool.Spec), p.pool.Name)
+	}
+	return parsedIP, nil
+}
+
+// query scopes an IP address query to the pool's prefix or IP range and VRF.
+func (p netboxPool) query(query url.Values) url.Values {
+	query.Set("parent", p.parent.String())
+	if p.vrf != nil {
+		query.Set("vrf_id", fmt.Sprint(p.vrf.ID))
+	} else {
+		query.Set("vrf_id", "null")
+	}
+	return query
+}
+
+// checkNetBoxIPAddresses checks that the NetBox IP addresses holding the
+// address of ipAddr were created by the controller for its claim, and reports
+// whether there are any.
+func checkNetBoxIPAddresses(ipAddr ipamv1.IPAddress, address netip.Addr, existing []netboxIPAddress) (bool, error) {
+	for _, ipAddress := range existing {
+		if !ipAddress.owned() {
+			return false, fmt.Errorf("%w: address %v is held by NetBox IP address %v", ErrAddressInUse, address, ipAddress.ID)
+		}
+		if !strings.HasSuffix(ipAddress.Description, netboxClaimDescription(ipAddr.Namespace, ipAddr.Spec.ClaimRef.Name)) {
+			return false, fmt.Errorf("%w: address %v is held by NetBox IP address %v for %v", ErrAddressInUse, address, ipAddress.ID, ipAddress.Description)
+		}
+	}
+	return len(existing) > 0, nil
+}
+
+// ipAddressFor returns the NetBox IP address to create for a claim.  It is
+// tagged with the managed tag and describes the claim and machine.
+func (a *NetBoxAllocator) ipAddressFor(ctx context.Context, loaded netboxPool, namespace, claimName, machineName string) (*netboxIPAddress, error) {
+	ipAddress := &netboxIPAddress{
+		Status:      "active",
+		Description: netboxClaimDescription(namespace, claimName),
+	}
+	if machineName != "" {
+		ipAddress.Description = fmt.Sprintf("Machine %v, %v", machineName, ipAddress.Description)
+	}
+	tag, err := a.ensureManagedTag(ctx, loaded.client)
+	if err != nil {
+		return nil, err
+	}
+	ipAddress.Tags = []netboxTag{tag}
+	return ipAddress, nil
+}
+
+// ensureManagedTag creates the managed tag unless it exists.
+func (a *NetBoxAllocator) ensureManagedTag(ctx context.Context, c *netboxClient) (netboxTag, error) {
+	tag := netboxTag{
+		Name: netboxManagedTag,
+		Slug: netboxManagedTag,
+	}
+
+	a.mu.RLock()
+	known := a.tags[c.url]
+	a.mu.RUnlock()
+	if known {
+		return netboxTag{Slug: tag.Slug}, nil
+	}
+
+	existing, err := c.list(ctx, "extras/tags/", url.Values{"slug": {tag.Slug}})
+	if err != nil {
+		return netboxTag{}, err
+	}
+	if len(existing) == 0 {
+		if err := c.do(ctx, http.MethodPost, "extras/tags/", nil, tag, nil); err != nil {
+			return netboxTag{}, fmt.Errorf("unable to create NetBox tag %v: %w", tag.Name, err)
+		}
+	}
+
+	a.mu.Lock()
+	a.tags[c.url] = true
+	a.mu.Unlock()
+	return netboxTag{Slug: tag.Slug}, nil
+}
+
+func netboxClaimDescription(namespace, claimName string) string {
+	return fmt.Sprintf("IPAddressClaim %v/%v", namespace, claimName)
+}
+
+// coveringPrefix returns the smallest prefix containing the range.
+func coveringPrefix(r netipx.IPRange) netip.Prefix {
+	for bits := r.From().BitLen(); bits > 0; bits-- {
+		prefix := netip.PrefixFrom(r.From(), bits).Masked()
+		if prefix.Contains(r.To()) {
+			return prefix
+		}
+	}
+	return netip.PrefixFrom(r.From(), 0).Masked()
+}
+
+// netboxIPAddress is a NetBox IP address.
+type netboxIPAddress struct {
+	ID          int         `json:"id,omitempty"`
+	Address     string      `json:"address,omitempty"`
+	Status      string      `json:"status,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Tags        []netboxTag `json:"tags,omitempty"`
+
+	VRF *netboxVRF `json:"vrf,omitempty"`
+}
+
+// netboxVRF is the VRF nested in NetBox prefixes, IP ranges and IP addresses.
+type netboxVRF struct {
+	ID int `json:"id"`
+}
+
+type netboxTag struct {
+	Name string `json:"name,omitempty"`
+	Slug string `json:"slug"`
+}
+
+// addr returns the address of the IP address without its mask.
+func (a netboxIPAddress) addr() (netip.Addr, error) {
+	prefix, err := netip.ParsePrefix(a.Address)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid NetBox address %v: %w", a.Address, err)
+	}
+	return prefix.Addr(), nil
+}
+
+func (a netboxIPAddress) owned() bool {
+	for _, tag := range a.Tags {
+		if tag.Slug == netboxManagedTag {
+			return true
+		}
+	}
+	return false
+}
+
+// netboxError is an error returned by NetBox.
+type netboxError struct {
+	StatusCode int
+	Detail     string
+}
+
+func (e *netboxError) Error() string {
+	return fmt.Sprintf("netbox returned %v: %v", e.StatusCode, e.Detail)
+}
+
+// netboxClient calls the REST API of NetBox.
+type netboxClient struct {
+	http  *http.Client
+	url   string
+	token string
+}
+
+func (c *netboxClient) ipAddresses(ctx context.Context, query url.Values) ([]netboxIPAddress, error) {
+	results, err := c.list(ctx, "ipam/ip-addresses/", query)
+	if err != nil {
+		return nil, err
+	}
+	ipAddresses := make([]netboxIPAddress, 0, len(results))
+	for _, raw := range results {
+		var ipAddress netboxIPAddress
+		if err := json.Unmarshal(raw, &ipAddress); err != nil {
+			return nil, err
+		}
+		ipAddresses = append(ipAddresses, ipAddress)
+	}
+	return ipAddresses, nil
+}
+
+func (c *netboxClient) delete(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("ipam/ip-addresses/%d/", id), nil, nil, nil)
+}
+
+// list returns every object matching query, following NetBox's paging.
+func (c *netboxClient) list(ctx context.Context, path string, query url.Values) ([]json.RawMessage, error) {
+	query.Set("limit", fmt.Sprint(netboxPageSize))
+	requestURL := c.url + path + "?" + query.Encode()
+
+	var results []json.RawMessage
+	for requestURL != "" {
+		var page struct {
+			Next    *string           `json:"next"`
+			Results []json.RawMessage `json:"results"`
+		}
+		if err := c.send(ctx, http.MethodGet, requestURL, nil, &page); err != nil {
+			return nil, err
+		}
+		results = append(results, page.Results...)
+		requestURL = ""
+		if page.Next != nil {
+			requestURL = *page.Next
+		}
+	}
+	return results, nil
+}
+
+// do sends a request for path, relative to the API's base URL, and decodes
+// the response into out.
+func (c *netboxClient) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	requestURL := c.url + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	return c.send(ctx, method, requestURL, body, out)
+}
+
+func (c *netboxClient) send(ctx context.Context, method, requestURL string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		netboxErr := &netboxError{StatusCode: resp.StatusCode, Detail: strings.TrimSpace(string(data))}
+		var detail struct {
+			Detail string `json:"detail"`
+		}
+		if err := json.Unmarshal(data, &detail); err == nil && detail.Detail != "" {
+			netboxErr.Detail = detail.Detail
+		}
+		return netboxErr
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
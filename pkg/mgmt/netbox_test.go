@@ -0,0 +1,462 @@
+package mgmt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+// fakeNetBoxPrefix is a prefix served by fakeNetBox.
+type fakeNetBoxPrefix struct {
+	ID     int        `json:"id"`
+	Prefix string     `json:"prefix"`
+	VRF    *netboxVRF `json:"vrf"`
+	cidr   netip.Prefix
+}
+
+// fakeNetBox serves the parts of the NetBox REST API used by the allocator.
+type fakeNetBox struct {
+	mu          sync.Mutex
+	nextID      int
+	vrfs        map[string]int
+	prefixes    []fakeNetBoxPrefix
+	ipAddresses map[int]netboxIPAddress
+	tags        map[string]bool
+	requests    map[string]int
+}
+
+func newFakeNetBox() *fakeNetBox {
+	return &fakeNetBox{
+		vrfs:        map[string]int{},
+		ipAddresses: map[int]netboxIPAddress{},
+		tags:        map[string]bool{},
+		requests:    map[string]int{},
+	}
+}
+
+func (f *fakeNetBox) addVRF(name string) *netboxVRF {
+	f.nextID++
+	f.vrfs[name] = f.nextID
+	return &netboxVRF{ID: f.nextID}
+}
+
+func (f *fakeNetBox) addPrefix(prefix string, vrf *netboxVRF) {
+	f.nextID++
+	f.prefixes = append(f.prefixes, fakeNetBoxPrefix{ID: f.nextID, Prefix: prefix, VRF: vrf, cidr: netip.MustParsePrefix(prefix)})
+}
+
+func (f *fakeNetBox) addIPAddress(ipAddress netboxIPAddress) {
+	f.nextID++
+	ipAddress.ID = f.nextID
+	f.ipAddresses[ipAddress.ID] = ipAddress
+}
+
+func sameVRF(a, b *netboxVRF) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && a.ID == b.ID)
+}
+
+// matchesVRF reports whether vrf matches the vrf_id filter of a query.
+func matchesVRF(vrf *netboxVRF, filter string) bool {
+	switch filter {
+	case "":
+		return true
+	case "null":
+		return vrf == nil
+	}
+	return vrf != nil && fmt.Sprint(vrf.ID) == filter
+}
+
+func (f *fakeNetBox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Token netbox-token" {
+		writeNetBox(w, http.StatusForbidden, map[string]string{"detail": "Invalid token"})
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+	parts := strings.Split(path, "/")
+	f.requests[r.Method+" "+strings.Join(parts[:2], "/")]++
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && path == "ipam/vrfs":
+		var vrfs []netboxVRF
+		if id, ok := f.vrfs[query.Get("name")]; ok {
+			vrfs = append(vrfs, netboxVRF{ID: id})
+		}
+		writeNetBoxList(w, vrfs)
+
+	case r.Method == http.MethodGet && path == "ipam/prefixes":
+		var prefixes []fakeNetBoxPrefix
+		for _, prefix := range f.prefixes {
+			if prefix.Prefix == query.Get("prefix") && matchesVRF(prefix.VRF, query.Get("vrf_id")) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		writeNetBoxList(w, prefixes)
+
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[1] == "prefixes" && parts[3] == "available-ips":
+		id, _ := strconv.Atoi(parts[2])
+		for _, prefix := range f.prefixes {
+			if prefix.ID != id {
+				continue
+			}
+			var request netboxIPAddress
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeNetBox(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+				return
+			}
+			// The network and broadcast addresses are never available.
+			for addr := prefix.cidr.Addr().Next(); prefix.cidr.Contains(addr.Next()); addr = addr.Next() {
+				if f.holds(addr, prefix.VRF) {
+					continue
+				}
+				request.Address = netip.PrefixFrom(addr, prefix.cidr.Bits()).String()
+				request.VRF = prefix.VRF
+				f.addIPAddress(request)
+				writeNetBox(w, http.StatusCreated, f.ipAddresses[f.nextID])
+				return
+			}
+			writeNetBox(w, http.StatusConflict, map[string]string{"detail": "Insufficient space is available to accommodate the requested number of IPs"})
+			return
+		}
+		writeNetBox(w, http.StatusNotFound, map[string]string{"detail": "Not found."})
+
+	case r.Method == http.MethodGet && path == "ipam/ip-addresses":
+		var parent netip.Prefix
+		if query.Get("parent") != "" {
+			parent = netip.MustParsePrefix(query.Get("parent"))
+		}
+		ipAddresses := []netboxIPAddress{}
+		for _, ipAddress := range f.ipAddresses {
+			addr, _ := ipAddress.addr()
+			switch {
+			case query.Get("address") != "" && addr.String() != query.Get("address"):
+			case parent.IsValid() && !parent.Contains(addr):
+			case query.Get("tag") != "" && !ipAddress.owned():
+			case !matchesVRF(ipAddress.VRF, query.Get("vrf_id")):
+			default:
+				ipAddresses = append(ipAddresses, ipAddress)
+			}
+		}
+		writeNetBoxList(w, ipAddresses)
+
+	case r.Method == http.MethodPost && path == "ipam/ip-addresses":
+		var request netboxIPAddress
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeNetBox(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+			return
+		}
+		f.addIPAddress(request)
+		writeNetBox(w, http.StatusCreated, f.ipAddresses[f.nextID])
+
+	case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "ip-addresses":
+		id, _ := strconv.Atoi(parts[2])
+		if _, ok := f.ipAddresses[id]; !ok {
+			writeNetBox(w, http.StatusNotFound, map[string]string{"detail": "Not found."})
+			return
+		}
+		delete(f.ipAddresses, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet && path == "extras/tags":
+		var tags []netboxTag
+		if f.tags[query.Get("slug")] {
+			tags = append(tags, netboxTag{Slug: query.Get("slug")})
+		}
+		writeNetBoxList(w, tags)
+
+	case r.Method == http.MethodPost && path == "extras/tags":
+		var tag netboxTag
+		if err := json.NewDecoder(r.Body).Decode(&tag); err != nil {
+			writeNetBox(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+			return
+		}
+		f.tags[tag.Slug] = true
+		writeNetBox(w, http.StatusCreated, tag)
+
+	default:
+		writeNetBox(w, http.StatusBadRequest, map[string]string{"detail": "unsupported request " + r.Method + " " + path})
+	}
+}
+
+// find returns the IP address holding addr in vrf.
+func (f *fakeNetBox) find(addr netip.Addr, vrf *netboxVRF) (netboxIPAddress, bool) {
+	for _, ipAddress := range f.ipAddresses {
+		if held, _ := ipAddress.addr(); held == addr && sameVRF(ipAddress.VRF, vrf) {
+			return ipAddress, true
+		}
+	}
+	return netboxIPAddress{}, false
+}
+
+func (f *fakeNetBox) holds(addr netip.Addr, vrf *netboxVRF) bool {
+	_, ok := f.find(addr, vrf)
+	return ok
+}
+
+func writeNetBox(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeNetBoxList(w http.ResponseWriter, results interface{}) {
+	writeNetBox(w, http.StatusOK, map[string]interface{}{"next": nil, "results": results})
+}
+
+// newNetBoxTest returns an allocator reading the credentials of a pool
+// served by netbox.
+func newNetBoxTest(t *testing.T, netbox *fakeNetBox, config v1.NetBoxConfig) (*NetBoxAllocator, *v1.IPPool) {
+	t.Helper()
+	server := httptest.NewServer(netbox)
+	t.Cleanup(server.Close)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "netbox-credentials"},
+		Data: map[string][]byte{
+			"token": []byte("netbox-token"),
+		},
+	}
+	config.URL = server.URL
+	config.CredentialsSecret = secret.Name
+	pool := &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec: v1.IPPoolSpec{
+			Prefix: 29,
+			NetBox: &config,
+		},
+	}
+	return NewNetBoxAllocator(fake.NewClientBuilder().WithObjects(secret).Build()), pool
+}
+
+func TestNetBoxPrefixLookup(t *testing.T) {
+	ctx := context.Background()
+	netbox := newFakeNetBox()
+	blue := netbox.addVRF("blue")
+	netbox.addPrefix("10.5.0.0/29", nil)
+	netbox.addPrefix("10.5.0.0/29", blue)
+	netbox.addPrefix("10.6.0.0/29", nil)
+
+	allocator, pool := newNetBoxTest(t, netbox, v1.NetBoxConfig{Prefix: "10.5.0.0/29"})
+	if _, err := allocator.InitializePool(ctx, pool); err == nil || !strings.Contains(err.Error(), "matches 2") {
+		t.Errorf("expected a prefix found in two VRFs to be rejected, got %v", err)
+	}
+
+	allocator, pool = newNetBoxTest(t, netbox, v1.NetBoxConfig{Prefix: "10.5.0.0/29", VRF: "blue"})
+	if rebuilt, err := allocator.InitializePool(ctx, pool); err != nil || !rebuilt {
+		t.Fatalf("unable to initialize pool: %v, %v", rebuilt, err)
+	}
+	loaded := allocator.pools["ns/pool"]
+	if loaded.vrf == nil || loaded.vrf.ID != blue.ID || loaded.availablePath != fmt.Sprintf("ipam/prefixes/%d/available-ips/", netbox.prefixes[1].ID) {
+		t.Errorf("got VRF %v and path %v, want the prefix of VRF blue", loaded.vrf, loaded.availablePath)
+	}
+	if rebuilt, err := allocator.InitializePool(ctx, pool.DeepCopy()); err != nil || rebuilt {
+		t.Errorf("expected the unchanged pool to be kept, got %v, %v", rebuilt, err)
+	}
+	if netbox.requests["GET ipam/prefixes"] != 2 {
+		t.Errorf("got %v prefix lookups, want 2", netbox.requests["GET ipam/prefixes"])
+	}
+
+	allocator, pool = newNetBoxTest(t, netbox, v1.NetBoxConfig{Prefix: "10.6.0.0/29"})
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Errorf("expected a unique prefix to be found without a VRF, got %v", err)
+	}
+	allocator, pool = newNetBoxTest(t, netbox, v1.NetBoxConfig{Prefix: "10.7.0.0/29"})
+	if _, err := allocator.InitializePool(ctx, pool); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a missing prefix to be reported, got %v", err)
+	}
+	allocator, pool = newNetBoxTest(t, netbox, v1.NetBoxConfig{Prefix: "10.5.0.0/29", VRF: "red"})
+	if _, err := allocator.InitializePool(ctx, pool); err == nil {
+		t.Errorf("expected a missing VRF to be reported")
+	}
+}
+
+func TestNetBoxAllocate(t *testing.T) {
+	ctx := context.Background()
+	netbox := newFakeNetBox()
+	blue := netbox.addVRF("blue")
+	netbox.addPrefix("10.5.0.0/29", blue)
+	// The same address in another VRF doesn't count.
+	netbox.addIPAddress(netboxIPAddress{Address: "10.5.0.1/29"})
+
+	allocator, pool := newNetBoxTest(t, netbox, v1.NetBoxConfig{Prefix: "10.5.0.0/29", VRF: "blue"})
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+
+	var addresses []*ipamv1.IPAddress
+	for i := 0; i < 6; i++ {
+		claim := testClaim(pool, fmt.Sprintf("claim-%d", i))
+		claim.OwnerReferences = []metav1.OwnerReference{{Kind: "Machine", Name: fmt.Sprintf("machine-%d", i)}}
+		ip, err := allocator.GetIPAddress(ctx, claim)
+		if err != nil {
+			t.Fatalf("unable to get address: %v", err)
+		}
+		if want := fmt.Sprintf("10.5.0.%d", i+1); ip.Spec.Address != want {
+			t.Errorf("got %v, want %v", ip.Spec.Address, want)
+		}
+		addresses = append(addresses, ip)
+	}
+	if _, err := allocator.GetIPAddress(ctx, testClaim(pool, "claim-6")); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("expected the pool to be exhausted, got %v", err)
+	}
+
+	// Claims and machines are described, only the managed tag is created.
+	if len(netbox.tags) != 1 || !netbox.tags[netboxManagedTag] || netbox.requests["POST extras/tags"] != 1 {
+		t.Errorf("got tags %v, want only %v created once", netbox.tags, netboxManagedTag)
+	}
+	for i, ip := range addresses {
+		ipAddress, _ := netbox.find(netip.MustParseAddr(ip.Spec.Address), blue)
+		want := fmt.Sprintf("Machine machine-%d, %v", i, netboxClaimDescription("ns", fmt.Sprintf("claim-%d", i)))
+		if ipAddress.Description != want || len(ipAddress.Tags) != 1 {
+			t.Errorf("got IP address %+v, want description %q and the managed tag", ipAddress, want)
+		}
+	}
+
+	usage, err := allocator.GetPoolUsage(ctx, pool)
+	if err != nil {
+		t.Fatalf("unable to get usage: %v", err)
+	}
+	if usage.Allocated != 6 || usage.Reserved != 2 || usage.Total != 8 {
+		t.Errorf("got usage %+v, want 6 of 8 addresses allocated and 2 reserved", usage)
+	}
+
+	if err := allocator.ReleaseIPConfiguration(ctx, addresses[0]); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	if !netbox.holds(netip.MustParseAddr("10.5.0.1"), nil) || netbox.holds(netip.MustParseAddr("10.5.0.1"), blue) {
+		t.Errorf("expected only the IP address of the pool's VRF to be deleted")
+	}
+
+	inUse := []string{}
+	for _, ip := range addresses[2:] {
+		inUse = append(inUse, ip.Spec.Address)
+	}
+	released, err := allocator.ReleaseUnclaimedAddresses(ctx, pool, inUse)
+	if err != nil {
+		t.Fatalf("unable to release unclaimed addresses: %v", err)
+	}
+	if len(released) != 1 || released[0] != addresses[1].Spec.Address {
+		t.Errorf("got %v released, want %v", released, addresses[1].Spec.Address)
+	}
+	if len(netbox.ipAddresses) != 5 {
+		t.Errorf("got %v IP addresses left, want 5", len(netbox.ipAddresses))
+	}
+}
+
+func TestNetBoxReleaseDuplicate(t *testing.T) {
+	ctx := context.Background()
+	netbox := newFakeNetBox()
+	netbox.addPrefix("10.5.0.0/29", nil)
+	allocator, pool := newNetBoxTest(t, netbox, v1.NetBoxConfig{Prefix: "10.5.0.0/29"})
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+	held, err := allocator.GetIPAddress(ctx, testClaim(pool, "held"))
+	if err != nil {
+		t.Fatalf("unable to get address: %v", err)
+	}
+
+	// An IPAddress of another claim duplicating the address is released.
+	duplicate := NewIPAddress(testClaim(pool, "duplicate"), pool, "duplicate", held.Spec.Address)
+	if err := allocator.ReleaseIPConfiguration(ctx, duplicate); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	ipAddress, ok := netbox.find(netip.MustParseAddr(held.Spec.Address), nil)
+	if !ok || ipAddress.Description != netboxClaimDescription("ns", "held") {
+		t.Errorf("expected the IP address of the holding claim to be kept, got %+v", ipAddress)
+	}
+	if !allocator.pools["ns/pool"].claimed.has(*held) {
+		t.Errorf("expected the holding IPAddress to stay claimed")
+	}
+
+	if err := allocator.ReleaseIPConfiguration(ctx, held); err != nil {
+		t.Fatalf("unable to release address: %v", err)
+	}
+	if len(netbox.ipAddresses) != 0 {
+		t.Errorf("got IP addresses %v left, want none", netbox.ipAddresses)
+	}
+}
+
+func TestNetBoxClaimConflicts(t *testing.T) {
+	ctx := context.Background()
+	netbox := newFakeNetBox()
+	blue := netbox.addVRF("blue")
+	netbox.addPrefix("10.5.0.0/29", blue)
+	managed := []netboxTag{{Slug: netboxManagedTag}}
+	netbox.addIPAddress(netboxIPAddress{Address: "10.5.0.1/29", VRF: blue, Tags: managed, Description: "Machine machine-0, " + netboxClaimDescription("ns", "held")})
+	netbox.addIPAddress(netboxIPAddress{Address: "10.5.0.2/29", VRF: blue, Tags: managed, Description: netboxClaimDescription("ns", "other")})
+	netbox.addIPAddress(netboxIPAddress{Address: "10.5.0.3/29", VRF: blue, Description: "printer"})
+	netbox.addIPAddress(netboxIPAddress{Address: "10.5.0.4/29", Description: "global"})
+
+	allocator, pool := newNetBoxTest(t, netbox, v1.NetBoxConfig{Prefix: "10.5.0.0/29", VRF: "blue"})
+	if _, err := allocator.InitializePool(ctx, pool); err != nil {
+		t.Fatalf("unable to initialize pool: %v", err)
+	}
+
+	ipAddress := func(claim, address string) ipamv1.IPAddress {
+		return *NewIPAddress(testClaim(pool, claim), pool, claim, address)
+	}
+	addresses := []ipamv1.IPAddress{
+		ipAddress("held", "10.5.0.1"),
+		ipAddress("stolen", "10.5.0.2"),
+		ipAddress("printed", "10.5.0.3"),
+		ipAddress("free", "10.5.0.4"),
+		ipAddress("outside", "10.6.0.1"),
+	}
+	netbox.requests = map[string]int{}
+	failures, err := allocator.ClaimIPAddresses(ctx, pool, addresses)
+	if err != nil {
+		t.Fatalf("unable to claim addresses: %v", err)
+	}
+	for name, want := range map[string]error{
+		"stolen":  ErrAddressInUse,
+		"printed": ErrAddressInUse,
+		"outside": ErrAddressOutOfRange,
+	} {
+		if !errors.Is(failures[name], want) {
+			t.Errorf("%v: got %v, want %v", name, failures[name], want)
+		}
+	}
+	if len(failures) != 3 {
+		t.Errorf("got failures %v, want 3", failures)
+	}
+	// The prefix is looked up once for all the addresses.
+	if netbox.requests["GET ipam/ip-addresses"] != 1 || netbox.requests["POST ipam/ip-addresses"] != 1 {
+		t.Errorf("got requests %v, want one lookup and the free address created", netbox.requests)
+	}
+	if !netbox.holds(netip.MustParseAddr("10.5.0.4"), blue) {
+		t.Errorf("expected the free address to be created in the pool's VRF")
+	}
+
+	if err := allocator.ClaimIPAddress(ctx, pool, addresses[1]); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("expected an address held for another claim to be rejected, got %v", err)
+	}
+
+	// Claimed addresses are not looked up again.
+	netbox.requests = map[string]int{}
+	failures, err = allocator.ClaimIPAddresses(ctx, pool, []ipamv1.IPAddress{addresses[0], addresses[3]})
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("unable to claim addresses: %v, %v", failures, err)
+	}
+	if len(netbox.requests) != 0 {
+		t.Errorf("got requests %v for claimed addresses, want none", netbox.requests)
+	}
+}
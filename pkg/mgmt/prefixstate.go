@@ -0,0 +1,74 @@
+package mgmt
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	goipam "github.com/metal-stack/go-ipam"
+)
+
+// prefixState mirrors the gob encoding of an allocator prefix.  The allocator
+// doesn't expose a prefix's acquired addresses or its version, so storage
+// implementations outside of the allocator's package have to read and write
+// them through the encoding.
+type prefixState struct {
+	AvailableChildPrefixes map[string]bool
+	ChildPrefixLength      int
+	IsParent               bool
+	IPs                    map[string]bool
+	Version                int64
+	Cidr                   string
+	ParentCidr             string
+}
+
+func (s *prefixState) fields() []interface{} {
+	return []interface{}{
+		&s.AvailableChildPrefixes,
+		&s.ChildPrefixLength,
+		&s.IsParent,
+		&s.IPs,
+		&s.Version,
+		&s.Cidr,
+		&s.ParentCidr,
+	}
+}
+
+func newPrefixState(prefix *goipam.Prefix) (*prefixState, error) {
+	encoded, err := prefix.GobEncode()
+	if err != nil {
+		return nil, err
+	}
+	return decodePrefixState(encoded)
+}
+
+func decodePrefixState(encoded []byte) (*prefixState, error) {
+	state := &prefixState{}
+	decoder := gob.NewDecoder(bytes.NewReader(encoded))
+	for _, field := range state.fields() {
+		if err := decoder.Decode(field); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+func (s *prefixState) encode() ([]byte, error) {
+	w := new(bytes.Buffer)
+	encoder := gob.NewEncoder(w)
+	for _, field := range s.fields() {
+		if err := encoder.Encode(field); err != nil {
+			return nil, err
+		}
+	}
+	return w.Bytes(), nil
+}
+
+func (s *prefixState) prefix() (goipam.Prefix, error) {
+	var prefix goipam.Prefix
+	encoded, err := s.encode()
+	if err != nil {
+		return prefix, err
+	}
+	err = prefix.GobDecode(encoded)
+	return prefix, err
+}
@@ -0,0 +1,63 @@
+package mgmt
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	goipam "github.com/metal-stack/go-ipam"
+)
+
+// TestPrefixStateLayout checks that prefixState still mirrors the gob
+// encoding of go-ipam's prefixes, which changes silently when go-ipam adds,
+// removes or reorders fields.
+func TestPrefixStateLayout(t *testing.T) {
+	ctx := context.Background()
+	ipam := goipam.New()
+	prefix, err := ipam.NewPrefix(ctx, "192.168.1.0/29")
+	if err != nil {
+		t.Fatalf("unable to create prefix: %v", err)
+	}
+	if _, err := ipam.AcquireSpecificIP(ctx, prefix.Cidr, "192.168.1.2"); err != nil {
+		t.Fatalf("unable to acquire address: %v", err)
+	}
+	prefix = ipam.PrefixFrom(ctx, prefix.Cidr)
+
+	state, err := newPrefixState(prefix)
+	if err != nil {
+		t.Fatalf("unable to decode prefix: %v", err)
+	}
+	want := &prefixState{
+		AvailableChildPrefixes: map[string]bool{},
+		IPs: map[string]bool{
+			"192.168.1.0": true,
+			"192.168.1.2": true,
+			"192.168.1.7": true,
+		},
+		Version: state.Version,
+		Cidr:    "192.168.1.0/29",
+	}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("got %+v, want %+v", state, want)
+	}
+	if state.Version == 0 {
+		t.Errorf("expected the acquisition to bump the prefix version")
+	}
+
+	// The state encodes back into an equal prefix.
+	state.IPs["192.168.1.3"] = true
+	decoded, err := state.prefix()
+	if err != nil {
+		t.Fatalf("unable to encode prefix: %v", err)
+	}
+	if decoded.Cidr != prefix.Cidr || decoded.Usage().AcquiredIPs != 4 {
+		t.Errorf("got prefix %v with %v acquired addresses, want %v with 4", decoded.Cidr, decoded.Usage().AcquiredIPs, prefix.Cidr)
+	}
+	roundTripped, err := newPrefixState(&decoded)
+	if err != nil {
+		t.Fatalf("unable to decode prefix: %v", err)
+	}
+	if !reflect.DeepEqual(roundTripped, state) {
+		t.Errorf("got %+v after a round trip, want %+v", roundTripped, state)
+	}
+}
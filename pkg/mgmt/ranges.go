@@ -0,0 +1,192 @@
+package mgmt
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+
+	"go4.org/netipx"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+// AddressRange is a single entry of an IPPool's address list.
+type AddressRange struct {
+	netipx.IPRange
+
+	// CIDR is true when the entry was given in CIDR notation.  The first and
+	// last addresses of a CIDR entry are never handed out, unless the CIDR is
+	// a point-to-point subnet.
+	CIDR bool
+}
+
+// ParseAddressRange parses a CIDR (192.168.1.0/28), a first-last range
+// (192.168.1.20-192.168.1.45) or a single address (192.168.1.7).
+func ParseAddressRange(entry string) (AddressRange, error) {
+	entry = strings.TrimSpace(entry)
+
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return AddressRange{}, fmt.Errorf("invalid cidr %q: %w", entry, err)
+		}
+		return AddressRange{IPRange: netipx.RangeOfPrefix(prefix.Masked()), CIDR: true}, nil
+	}
+
+	if first, last, ok := strings.Cut(entry, "-"); ok {
+		ipRange, err := netipx.ParseIPRange(strings.TrimSpace(first) + "-" + strings.TrimSpace(last))
+		if err != nil {
+			return AddressRange{}, fmt.Errorf("invalid range %q: %w", entry, err)
+		}
+		return AddressRange{IPRange: ipRange}, nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return AddressRange{}, fmt.Errorf("invalid address %q: %w", entry, err)
+	}
+	return AddressRange{IPRange: netipx.IPRangeFrom(addr, addr)}, nil
+}
+
+// ExternalNetwork returns the network of a pool served by an external
+// backend, or an empty string for pools served by the built-in allocator.
+func ExternalNetwork(spec v1.IPPoolSpec) string {
+	switch {
+	case spec.Infoblox != nil:
+		return spec.Infoblox.Network
+	case spec.NetBox != nil && spec.NetBox.Prefix != "":
+		return spec.NetBox.Prefix
+	case spec.NetBox != nil:
+		return spec.NetBox.IPRange
+	case spec.HTTP != nil:
+		return spec.HTTP.Network
+	}
+	return ""
+}
+
+// PoolAddressRanges returns every address range configured on the pool, the
+// legacy address-cidr first.
+func PoolAddressRanges(spec v1.IPPoolSpec) ([]AddressRange, error) {
+	var entries []string
+	if len(spec.AddressCidr) > 0 {
+		entries = append(entries, spec.AddressCidr)
+	}
+	entries = append(entries, spec.Addresses...)
+	if network := ExternalNetwork(spec); network != "" {
+		entries = append(entries, network)
+	}
+
+	var ranges []AddressRange
+	for _, entry := range entries {
+		addressRange, err := ParseAddressRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, existing := range ranges {
+			if existing.Overlaps(addressRange.IPRange) {
+				return nil, fmt.Errorf("address range %v overlaps %v", addressRange.IPRange, existing.IPRange)
+			}
+		}
+		ranges = append(ranges, addressRange)
+	}
+	return ranges, nil
+}
+
+// PoolIPv6 reports whether the pool hands out IPv6 addresses.  Every range
+// of a pool must be of the same IP family and the pool's prefix must be valid
+// for that family.  Dual-stack is configured by pairing two pools.
+func PoolIPv6(spec v1.IPPoolSpec) (bool, error) {
+	ranges, err := PoolAddressRanges(spec)
+	if err != nil {
+		return false, err
+	}
+	if len(ranges) == 0 {
+		return false, nil
+	}
+
+	ipv6 := ranges[0].From().Is6()
+	for _, addressRange := range ranges[1:] {
+		if addressRange.From().Is6() != ipv6 {
+			return false, fmt.Errorf("address range %v is not of the same IP family as %v, use paired-pool for dual-stack", addressRange.IPRange, ranges[0].IPRange)
+		}
+	}
+	if bits := ranges[0].From().BitLen(); spec.Prefix < 0 || spec.Prefix > bits {
+		return false, fmt.Errorf("prefix %v must be between 0 and %v", spec.Prefix, bits)
+	}
+	return ipv6, nil
+}
+
+// PoolExcludes returns the address ranges excluded from the pool.  The
+// gateway is always excluded.
+func PoolExcludes(spec v1.IPPoolSpec) ([]AddressRange, error) {
+	var excludes []AddressRange
+	if gateway, err := netip.ParseAddr(spec.Gateway); err == nil {
+		excludes = append(excludes, AddressRange{IPRange: netipx.IPRangeFrom(gateway, gateway)})
+	}
+	for _, entry := range spec.Excludes {
+		exclude, err := ParseAddressRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		excludes = append(excludes, exclude)
+	}
+	return excludes, nil
+}
+
+// pointToPoint reports whether subnets of prefixLength bits around addr have
+// no network or broadcast address: IPv4 /31 (RFC 3021) and IPv6 /127
+// (RFC 6164) point-to-point subnets, and single address subnets.
+func pointToPoint(addr netip.Addr, prefixLength int) bool {
+	return prefixLength >= addr.BitLen()-1
+}
+
+// subnetBoundaries returns the addresses of the subnet around addr which
+// must never be handed out: the network address and, for IPv4, the
+// broadcast address.  Point-to-point subnets have none.
+func subnetBoundaries(addr netip.Addr, prefixLength int) map[netip.Addr]bool {
+	if pointToPoint(addr, prefixLength) {
+		return map[netip.Addr]bool{}
+	}
+	subnet, err := addr.Prefix(prefixLength)
+	if err != nil {
+		return map[netip.Addr]bool{}
+	}
+	subnetRange := netipx.RangeOfPrefix(subnet)
+	boundaries := map[netip.Addr]bool{subnetRange.From(): true}
+	if addr.Is4() {
+		boundaries[subnetRange.To()] = true
+	}
+	return boundaries
+}
+
+// maxPrefixBits returns the longest prefix the allocator can manage for the
+// address family of addr.  go-ipam always holds back the first address of a
+// prefix, and the last one for IPv4, so a /31 or /32 prefix (/128 for IPv6)
+// hands out nothing.  Ranges smaller than a /30 (/126) are covered by a
+// prefix of that size instead, and the addresses outside the range are
+// blocked.  This doesn't limit the size of pools: a /31 pool is served from
+// the /30 around it.
+func maxPrefixBits(addr netip.Addr) int {
+	return addr.BitLen() - 2
+}
+
+// rangeSize returns the number of addresses in r, saturating at math.MaxInt64.
+func rangeSize(r netipx.IPRange) int64 {
+	var size int64
+	for _, prefix := range r.Prefixes() {
+		hostBits := prefix.Addr().BitLen() - prefix.Bits()
+		if hostBits >= 63 {
+			return math.MaxInt64
+		}
+		size = saturatingAdd(size, int64(1)<<hostBits)
+	}
+	return size
+}
+
+func saturatingAdd(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
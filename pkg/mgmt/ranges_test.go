@@ -0,0 +1,364 @@
+package mgmt
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+
+	goipam "github.com/metal-stack/go-ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+)
+
+func TestParseAddressRange(t *testing.T) {
+	tests := []struct {
+		entry    string
+		from, to string
+		cidr     bool
+		wantErr  string
+	}{
+		{entry: "192.168.1.0/28", from: "192.168.1.0", to: "192.168.1.15", cidr: true},
+		{entry: "192.168.1.7/28", from: "192.168.1.0", to: "192.168.1.15", cidr: true},
+		{entry: " 192.168.1.20-192.168.1.45 ", from: "192.168.1.20", to: "192.168.1.45"},
+		{entry: "192.168.1.20 - 192.168.1.45", from: "192.168.1.20", to: "192.168.1.45"},
+		{entry: "192.168.1.7", from: "192.168.1.7", to: "192.168.1.7"},
+		{entry: "10.0.0.0/31", from: "10.0.0.0", to: "10.0.0.1", cidr: true},
+		{entry: "10.0.0.5/32", from: "10.0.0.5", to: "10.0.0.5", cidr: true},
+		{entry: "fd00::/64", from: "fd00::", to: "fd00::ffff:ffff:ffff:ffff", cidr: true},
+		{entry: "fd00::10-fd00::20", from: "fd00::10", to: "fd00::20"},
+		{entry: "fd00::/127", from: "fd00::", to: "fd00::1", cidr: true},
+		{entry: "fd00::5/128", from: "fd00::5", to: "fd00::5", cidr: true},
+		{entry: "fd00::5", from: "fd00::5", to: "fd00::5"},
+		{entry: "192.168.1.45-192.168.1.20", wantErr: "invalid range"},
+		{entry: "192.168.1.20-fd00::1", wantErr: "invalid range"},
+		{entry: "192.168.1.0/33", wantErr: "invalid cidr"},
+		{entry: "192.168.1", wantErr: "invalid address"},
+		{entry: "", wantErr: "invalid address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			got, err := ParseAddressRange(tt.entry)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.From().String() != tt.from || got.To().String() != tt.to || got.CIDR != tt.cidr {
+				t.Errorf("got %v-%v cidr=%v, want %v-%v cidr=%v", got.From(), got.To(), got.CIDR, tt.from, tt.to, tt.cidr)
+			}
+		})
+	}
+}
+
+func TestPoolAddressRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    v1.IPPoolSpec
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "address-cidr first",
+			spec: v1.IPPoolSpec{AddressCidr: "192.168.1.0/28", Addresses: []string{"192.168.1.100-192.168.1.110", "192.168.1.200"}},
+			want: []string{"192.168.1.0-192.168.1.15", "192.168.1.100-192.168.1.110", "192.168.1.200-192.168.1.200"},
+		},
+		{
+			name: "ipv6",
+			spec: v1.IPPoolSpec{Addresses: []string{"fd00::/120", "fd00:1::10-fd00:1::20"}},
+			want: []string{"fd00::-fd00::ff", "fd00:1::10-fd00:1::20"},
+		},
+		{
+			name:    "overlapping ranges",
+			spec:    v1.IPPoolSpec{AddressCidr: "192.168.1.0/28", Addresses: []string{"192.168.1.10-192.168.1.20"}},
+			wantErr: "overlaps",
+		},
+		{
+			name:    "invalid entry",
+			spec:    v1.IPPoolSpec{Addresses: []string{"192.168.1.20-192.168.1.10"}},
+			wantErr: "invalid range",
+		},
+		{
+			name: "external network",
+			spec: v1.IPPoolSpec{HTTP: &v1.HTTPAllocatorConfig{Network: "10.0.0.0/24"}},
+			want: []string{"10.0.0.0-10.0.0.255"},
+		},
+		{
+			name: "empty",
+			spec: v1.IPPoolSpec{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := PoolAddressRanges(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, addressRange := range ranges {
+				got = append(got, addressRange.IPRange.String())
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolIPv6(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    v1.IPPoolSpec
+		want    bool
+		wantErr bool
+	}{
+		{name: "ipv4", spec: v1.IPPoolSpec{AddressCidr: "10.0.0.0/24", Prefix: 24}},
+		{name: "ipv4 /32", spec: v1.IPPoolSpec{AddressCidr: "10.0.0.1/32", Prefix: 32}},
+		{name: "ipv6", spec: v1.IPPoolSpec{AddressCidr: "fd00::/64", Prefix: 64}, want: true},
+		{name: "ipv6 /128", spec: v1.IPPoolSpec{AddressCidr: "fd00::1/128", Prefix: 128}, want: true},
+		{name: "mixed families", spec: v1.IPPoolSpec{Addresses: []string{"10.0.0.0/24", "fd00::/64"}, Prefix: 24}, wantErr: true},
+		{name: "ipv4 prefix too long", spec: v1.IPPoolSpec{AddressCidr: "10.0.0.0/24", Prefix: 33}, wantErr: true},
+		{name: "negative prefix", spec: v1.IPPoolSpec{AddressCidr: "10.0.0.0/24", Prefix: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PoolIPv6(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolExcludes(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    v1.IPPoolSpec
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "gateway is excluded",
+			spec: v1.IPPoolSpec{Gateway: "192.168.1.1", Excludes: []string{"192.168.1.10-192.168.1.12"}},
+			want: []string{"192.168.1.1-192.168.1.1", "192.168.1.10-192.168.1.12"},
+		},
+		{
+			name: "overlapping excludes are kept",
+			spec: v1.IPPoolSpec{Excludes: []string{"192.168.1.0/29", "192.168.1.4-192.168.1.10"}},
+			want: []string{"192.168.1.0-192.168.1.7", "192.168.1.4-192.168.1.10"},
+		},
+		{
+			name: "ipv6",
+			spec: v1.IPPoolSpec{Gateway: "fd00::1", Excludes: []string{"fd00::10"}},
+			want: []string{"fd00::1-fd00::1", "fd00::10-fd00::10"},
+		},
+		{
+			name: "no gateway",
+			spec: v1.IPPoolSpec{},
+		},
+		{
+			name:    "invalid exclude",
+			spec:    v1.IPPoolSpec{Excludes: []string{"192.168.1.10-192.168.1.1"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			excludes, err := PoolExcludes(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, exclude := range excludes {
+				got = append(got, exclude.IPRange.String())
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubnetBoundaries(t *testing.T) {
+	tests := []struct {
+		addr   string
+		prefix int
+		want   []string
+	}{
+		{addr: "192.168.1.20", prefix: 24, want: []string{"192.168.1.0", "192.168.1.255"}},
+		{addr: "192.168.1.20", prefix: 30, want: []string{"192.168.1.20", "192.168.1.23"}},
+		{addr: "192.168.1.20", prefix: 31},
+		{addr: "192.168.1.20", prefix: 32},
+		{addr: "fd00::20", prefix: 64, want: []string{"fd00::"}},
+		{addr: "fd00::20", prefix: 126, want: []string{"fd00::20"}},
+		{addr: "fd00::20", prefix: 127},
+		{addr: "fd00::20", prefix: 128},
+	}
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		var got []string
+		for boundary := range subnetBoundaries(addr, tt.prefix) {
+			got = append(got, boundary.String())
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%v/%v: got %v, want %v", tt.addr, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// TestMaxPrefixBits checks the prefix size the allocator prefixes are capped
+// at.  go-ipam holds back the first and last address of every IPv4 prefix, so
+// a /31 or /32 prefix of its own could not hand out any address.
+func TestMaxPrefixBits(t *testing.T) {
+	if got := maxPrefixBits(netip.MustParseAddr("10.0.0.1")); got != 30 {
+		t.Errorf("got %v for IPv4, want 30", got)
+	}
+	if got := maxPrefixBits(netip.MustParseAddr("fd00::1")); got != 126 {
+		t.Errorf("got %v for IPv6, want 126", got)
+	}
+
+	ctx := context.Background()
+	for _, cidr := range []string{"10.0.0.0/31", "10.0.0.4/32", "fd00::4/128"} {
+		ipam := goipam.New()
+		if _, err := ipam.NewPrefix(ctx, cidr); err != nil {
+			t.Fatalf("unable to create prefix %v: %v", cidr, err)
+		}
+		if ip, err := ipam.AcquireIP(ctx, cidr); !errors.Is(err, goipam.ErrNoIPAvailable) {
+			t.Errorf("go-ipam handed out %v from %v, maxPrefixBits can be raised", ip, cidr)
+		}
+	}
+}
+
+// TestPoolAddresses checks which addresses pools hand out, including the
+// point-to-point and single address pools whose ranges are smaller than the
+// allocator's prefixes.
+func TestPoolAddresses(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     v1.IPPoolSpec
+		want     []string
+		reserved int64
+	}{
+		{
+			name:     "ipv4 cidr",
+			spec:     v1.IPPoolSpec{AddressCidr: "192.168.1.0/29", Prefix: 24, Gateway: "192.168.1.1"},
+			want:     []string{"192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6"},
+			reserved: 3,
+		},
+		{
+			name:     "ipv4 range at subnet boundaries",
+			spec:     v1.IPPoolSpec{Addresses: []string{"192.168.1.254-192.168.2.1"}, Prefix: 24},
+			want:     []string{"192.168.1.254", "192.168.2.1"},
+			reserved: 2,
+		},
+		{
+			name: "ipv4 /31",
+			spec: v1.IPPoolSpec{AddressCidr: "10.0.0.0/31", Prefix: 31},
+			want: []string{"10.0.0.0", "10.0.0.1"},
+		},
+		{
+			name:     "ipv4 /31 with gateway",
+			spec:     v1.IPPoolSpec{AddressCidr: "10.0.0.0/31", Prefix: 31, Gateway: "10.0.0.0"},
+			want:     []string{"10.0.0.1"},
+			reserved: 1,
+		},
+		{
+			name: "ipv4 /32",
+			spec: v1.IPPoolSpec{AddressCidr: "10.0.0.5/32", Prefix: 32},
+			want: []string{"10.0.0.5"},
+		},
+		{
+			name: "ipv4 single address with /32 prefix",
+			spec: v1.IPPoolSpec{Addresses: []string{"10.0.0.5"}, Prefix: 32},
+			want: []string{"10.0.0.5"},
+		},
+		{
+			name:     "ipv4 overlapping excludes",
+			spec:     v1.IPPoolSpec{AddressCidr: "192.168.1.0/28", Prefix: 24, Excludes: []string{"192.168.1.0/29", "192.168.1.4-192.168.1.10"}},
+			want:     []string{"192.168.1.11", "192.168.1.12", "192.168.1.13", "192.168.1.14"},
+			reserved: 12,
+		},
+		{
+			name:     "ipv6 cidr",
+			spec:     v1.IPPoolSpec{AddressCidr: "fd00::/125", Prefix: 64, Gateway: "fd00::1"},
+			want:     []string{"fd00::2", "fd00::3", "fd00::4", "fd00::5", "fd00::6", "fd00::7"},
+			reserved: 2,
+		},
+		{
+			name: "ipv6 /127",
+			spec: v1.IPPoolSpec{AddressCidr: "fd00::/127", Prefix: 127},
+			want: []string{"fd00::", "fd00::1"},
+		},
+		{
+			name: "ipv6 /128",
+			spec: v1.IPPoolSpec{AddressCidr: "fd00::5/128", Prefix: 128},
+			want: []string{"fd00::5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			allocator := NewGoIPAMAllocator(goipam.NewMemory())
+			pool := &v1.IPPool{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"}, Spec: tt.spec}
+			if _, err := allocator.InitializePool(ctx, pool); err != nil {
+				t.Fatalf("unable to initialize pool: %v", err)
+			}
+
+			var got []string
+			for {
+				ip, err := allocator.GetIPAddress(ctx, testClaim(pool, "claim"))
+				if errors.Is(err, ErrPoolExhausted) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unable to get address: %v", err)
+				}
+				got = append(got, ip.Spec.Address)
+			}
+			sort.Slice(got, func(i, j int) bool {
+				return netip.MustParseAddr(got[i]).Less(netip.MustParseAddr(got[j]))
+			})
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+
+			usage, err := allocator.GetPoolUsage(ctx, pool)
+			if err != nil {
+				t.Fatalf("unable to get usage: %v", err)
+			}
+			if usage.Reserved != tt.reserved || usage.Allocated != int64(len(tt.want)) || usage.Free() != 0 {
+				t.Errorf("got usage %+v, want %v reserved and %v allocated", usage, tt.reserved, len(tt.want))
+			}
+		})
+	}
+}
+
+// testClaim returns a claim against pool.
+func testClaim(pool *v1.IPPool, name string) *ipamv1.IPAddressClaim {
+	claim := &ipamv1.IPAddressClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: pool.Namespace, Name: name},
+	}
+	claim.Spec.PoolRef.Name = pool.Name
+	claim.Spec.PoolRef.Kind = v1.IPPoolKind
+	apiGroup := v1.APIGroupName
+	claim.Spec.PoolRef.APIGroup = &apiGroup
+	return claim
+}
@@ -0,0 +1,395 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/ddns"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+)
+
+// ValidateIPPoolPath is the path the IPPool validating webhook is served on.
+const ValidateIPPoolPath = "/validate-ipamcontroller-openshift-io-v1-ippool"
+
+// IPPoolValidator rejects malformed IPPools at create and update time.
+type IPPoolValidator struct {
+	Client client.Reader
+}
+
+var _ admission.CustomValidator = &IPPoolValidator{}
+
+// ValidateCreate validates a new IPPool.
+func (v *IPPoolValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	pool, ok := obj.(*v1.IPPool)
+	if !ok {
+		return fmt.Errorf("expected an IPPool but got %T", obj)
+	}
+
+	allErrs := ValidateIPPoolSpec(pool)
+	if len(allErrs) == 0 {
+		overlapErrs, err := v.validateOverlap(ctx, pool)
+		if err != nil {
+			return apierrors.NewInternalError(err)
+		}
+		allErrs = append(allErrs, overlapErrs...)
+	}
+	return toInvalid(pool, allErrs)
+}
+
+// ValidateUpdate validates an updated IPPool.  Fields which determine the
+// addresses already handed out are immutable while the pool has allocations.
+// Updates which leave the spec alone, such as status and finalizer changes,
+// and updates of deleting pools are always allowed so that a pool can be
+// released even when it no longer validates.
+func (v *IPPoolValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	oldPool, ok := oldObj.(*v1.IPPool)
+	if !ok {
+		return fmt.Errorf("expected an IPPool but got %T", oldObj)
+	}
+	pool, ok := newObj.(*v1.IPPool)
+	if !ok {
+		return fmt.Errorf("expected an IPPool but got %T", newObj)
+	}
+	if !pool.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(oldPool.Spec, pool.Spec) {
+		return nil
+	}
+
+	allErrs := ValidateIPPoolSpec(pool)
+	if len(allErrs) == 0 {
+		overlapErrs, err := v.validateOverlap(ctx, pool)
+		if err != nil {
+			return apierrors.NewInternalError(err)
+		}
+		allErrs = append(allErrs, overlapErrs...)
+	}
+
+	allocated, err := v.hasAllocations(ctx, oldPool)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	if allocated {
+		allErrs = append(allErrs, validateImmutable(oldPool.Spec, pool.Spec)...)
+	}
+	return toInvalid(pool, allErrs)
+}
+
+// ValidateDelete allows every deletion.
+func (v *IPPoolValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+// ValidateIPPoolSpec checks the syntax and consistency of the pool's spec.
+func ValidateIPPoolSpec(pool *v1.IPPool) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if pool.Spec.AddressCidr != "" {
+		if _, err := mgmt.ParseAddressRange(pool.Spec.AddressCidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("address-cidr"), pool.Spec.AddressCidr, err.Error()))
+		}
+	}
+	for i, entry := range pool.Spec.Addresses {
+		if _, err := mgmt.ParseAddressRange(entry); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("addresses").Index(i), entry, err.Error()))
+		}
+	}
+	for i, entry := range pool.Spec.Excludes {
+		if _, err := mgmt.ParseAddressRange(entry); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("excludes").Index(i), entry, err.Error()))
+		}
+	}
+	for i, nameserver := range pool.Spec.Nameserver {
+		if _, err := netip.ParseAddr(nameserver); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("nameserver").Index(i), nameserver, "must be a valid IP address"))
+		}
+	}
+	if pool.Spec.RoutingDomain != "" {
+		for _, msg := range validation.IsDNS1123Label(pool.Spec.RoutingDomain) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("routing-domain"), pool.Spec.RoutingDomain, msg))
+		}
+	}
+	if pool.Spec.PairedPool == pool.Name {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("paired-pool"), pool.Spec.PairedPool, "a pool cannot be paired with itself"))
+	}
+	if backend := mgmt.PoolBackend(pool.Spec); backend != "" {
+		allErrs = append(allErrs, validateExternal(pool.Spec, specPath, backend)...)
+	}
+	if pool.Spec.Infoblox != nil {
+		allErrs = append(allErrs, validateInfoblox(pool.Spec.Infoblox, specPath.Child("infoblox"))...)
+	}
+	if pool.Spec.NetBox != nil {
+		allErrs = append(allErrs, validateNetBox(pool.Spec.NetBox, specPath.Child("netbox"))...)
+	}
+	if pool.Spec.HTTP != nil {
+		allErrs = append(allErrs, validateHTTP(pool.Spec.HTTP, specPath.Child("http"))...)
+	}
+	if pool.Spec.DNS != nil {
+		allErrs = append(allErrs, validateDNS(pool.Spec.DNS, specPath.Child("dns"))...)
+	}
+	if export := pool.Spec.DHCPExport; export != nil && export.ConfigMap != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(export.ConfigMap) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("dhcp-export", "config-map"), export.ConfigMap, msg))
+		}
+	}
+	if len(allErrs) > 0 {
+		return allErrs
+	}
+
+	ranges, err := mgmt.PoolAddressRanges(pool.Spec)
+	if err != nil {
+		return append(allErrs, field.Invalid(specPath.Child("addresses"), pool.Spec.Addresses, err.Error()))
+	}
+	if len(ranges) == 0 {
+		return append(allErrs, field.Required(specPath.Child("address-cidr"), "either address-cidr or addresses must be set"))
+	}
+	if _, err := mgmt.PoolIPv6(pool.Spec); err != nil {
+		return append(allErrs, field.Invalid(specPath.Child("prefix"), pool.Spec.Prefix, err.Error()))
+	}
+
+	// Every range must lie inside a subnet of the pool's prefix, otherwise
+	// the prefix handed out with an address would not contain the address's
+	// neighbours.
+	subnets := map[netip.Prefix]bool{}
+	for _, addressRange := range ranges {
+		subnet, err := addressRange.From().Prefix(pool.Spec.Prefix)
+		if err != nil || !subnet.Contains(addressRange.To()) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("prefix"), pool.Spec.Prefix,
+				fmt.Sprintf("address range %v does not fit in a /%v subnet", addressRange.IPRange, pool.Spec.Prefix)))
+			continue
+		}
+		subnets[subnet] = true
+	}
+
+	if pool.Spec.Gateway != "" {
+		gateway, err := netip.ParseAddr(pool.Spec.Gateway)
+		switch {
+		case err != nil:
+			allErrs = append(allErrs, field.Invalid(specPath.Child("gateway"), pool.Spec.Gateway, "must be a valid IP address"))
+		case gateway.Is6() != ranges[0].From().Is6():
+			allErrs = append(allErrs, field.Invalid(specPath.Child("gateway"), pool.Spec.Gateway, "must be of the same IP family as the pool"))
+		default:
+			for subnet := range subnets {
+				if !subnet.Contains(gateway) {
+					allErrs = append(allErrs, field.Invalid(specPath.Child("gateway"), pool.Spec.Gateway,
+						fmt.Sprintf("must be inside subnet %v", subnet)))
+				}
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateExternal rejects the fields of the built-in allocator on pools
+// served by an external backend, whose addresses are those of the backend's
+// network.
+func validateExternal(spec v1.IPPoolSpec, specPath *field.Path, backend string) field.ErrorList {
+	var allErrs field.ErrorList
+	msg := fmt.Sprintf("must not be set along with %v", backend)
+	var backends []string
+	for name, set := range map[string]bool{
+		mgmt.BackendInfoblox: spec.Infoblox != nil,
+		mgmt.BackendNetBox:   spec.NetBox != nil,
+		mgmt.BackendHTTP:     spec.HTTP != nil,
+	} {
+		if set {
+			backends = append(backends, name)
+		}
+	}
+	if len(backends) > 1 {
+		sort.Strings(backends)
+		allErrs = append(allErrs, field.Forbidden(specPath, fmt.Sprintf("only one backend may be set, got %v", strings.Join(backends, ", "))))
+	}
+	if spec.AddressCidr != "" {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("address-cidr"), msg))
+	}
+	if len(spec.Addresses) > 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("addresses"), msg))
+	}
+	if len(spec.Excludes) > 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("excludes"), msg))
+	}
+	return allErrs
+}
+
+func validateInfoblox(config *v1.InfobloxConfig, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if config.Host == "" {
+		allErrs = append(allErrs, field.Required(path.Child("host"), "the grid master must be set"))
+	}
+	if _, err := netip.ParsePrefix(config.Network); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("network"), config.Network, "must be a valid cidr"))
+	}
+	allErrs = append(allErrs, validateSecretName(config.CredentialsSecret, path.Child("credentials-secret"))...)
+	return allErrs
+}
+
+func validateNetBox(config *v1.NetBoxConfig, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if config.URL == "" {
+		allErrs = append(allErrs, field.Required(path.Child("url"), "the URL of NetBox must be set"))
+	}
+	switch {
+	case config.Prefix != "" && config.IPRange != "":
+		allErrs = append(allErrs, field.Forbidden(path.Child("ip-range"), "must not be set along with prefix"))
+	case config.Prefix != "":
+		if _, err := netip.ParsePrefix(config.Prefix); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("prefix"), config.Prefix, "must be a valid cidr"))
+		}
+	case config.IPRange != "":
+		if _, err := mgmt.ParseAddressRange(config.IPRange); err != nil || !strings.Contains(config.IPRange, "-") {
+			allErrs = append(allErrs, field.Invalid(path.Child("ip-range"), config.IPRange, "must be a first-last range"))
+		}
+	default:
+		allErrs = append(allErrs, field.Required(path.Child("prefix"), "either prefix or ip-range must be set"))
+	}
+	allErrs = append(allErrs, validateSecretName(config.CredentialsSecret, path.Child("credentials-secret"))...)
+	return allErrs
+}
+
+func validateDNS(config *v1.DNSConfig, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if _, ok := dns.IsDomainName(config.Zone); config.Zone == "" || !ok {
+		allErrs = append(allErrs, field.Invalid(path.Child("zone"), config.Zone, "must be a domain name"))
+	}
+	if config.ReverseZone != "" {
+		zone := dns.Fqdn(strings.ToLower(config.ReverseZone))
+		if _, ok := dns.IsDomainName(zone); !ok || (!dns.IsSubDomain("in-addr.arpa.", zone) && !dns.IsSubDomain("ip6.arpa.", zone)) {
+			allErrs = append(allErrs, field.Invalid(path.Child("reverse-zone"), config.ReverseZone, "must be a domain under in-addr.arpa or ip6.arpa"))
+		}
+	}
+	if config.Server == "" {
+		allErrs = append(allErrs, field.Required(path.Child("server"), "the DNS server is required"))
+	}
+	if _, err := ddns.ParseHostnameTemplate(config); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("hostname-template"), config.HostnameTemplate, err.Error()))
+	}
+	if config.TSIGSecret != "" {
+		allErrs = append(allErrs, validateSecretName(config.TSIGSecret, path.Child("tsig-secret"))...)
+	}
+	return allErrs
+}
+
+func validateHTTP(config *v1.HTTPAllocatorConfig, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if parsed, err := url.Parse(config.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		allErrs = append(allErrs, field.Invalid(path.Child("url"), config.URL, "must be an http or https URL"))
+	}
+	if _, err := mgmt.ParseAddressRange(config.Network); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("network"), config.Network, "must be a cidr or a first-last range"))
+	}
+	if config.CredentialsSecret != "" {
+		allErrs = append(allErrs, validateSecretName(config.CredentialsSecret, path.Child("credentials-secret"))...)
+	}
+	return allErrs
+}
+
+func validateSecretName(name string, path *field.Path) field.ErrorList {
+	if name == "" {
+		return field.ErrorList{field.Required(path, "a secret holding the credentials must be set")}
+	}
+	var allErrs field.ErrorList
+	for _, msg := range validation.IsDNS1123Subdomain(name) {
+		allErrs = append(allErrs, field.Invalid(path, name, msg))
+	}
+	return allErrs
+}
+
+// validateOverlap checks that the pool doesn't overlap any other pool in the
+// same routing domain.  Pools of the built-in allocator share a single
+// address space, so they must not overlap each other in any routing domain.
+func (v *IPPoolValidator) validateOverlap(ctx context.Context, pool *v1.IPPool) (field.ErrorList, error) {
+	var allErrs field.ErrorList
+
+	ranges, err := mgmt.PoolAddressRanges(pool.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	pools := &v1.IPPoolList{}
+	if err := v.Client.List(ctx, pools); err != nil {
+		return nil, fmt.Errorf("unable to list IPPools: %w", err)
+	}
+	for _, other := range pools.Items {
+		if other.Namespace == pool.Namespace && other.Name == pool.Name {
+			continue
+		}
+		builtIn := mgmt.PoolBackend(pool.Spec) == "" && mgmt.PoolBackend(other.Spec) == ""
+		if other.Spec.RoutingDomain != pool.Spec.RoutingDomain && !builtIn {
+			continue
+		}
+		otherRanges, err := mgmt.PoolAddressRanges(other.Spec)
+		if err != nil {
+			continue
+		}
+		for _, addressRange := range ranges {
+			for _, otherRange := range otherRanges {
+				if addressRange.Overlaps(otherRange.IPRange) {
+					allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "addresses"), addressRange.IPRange.String(),
+						fmt.Sprintf("overlaps %v of IPPool %v/%v", otherRange.IPRange, other.Namespace, other.Name)))
+				}
+			}
+		}
+	}
+	return allErrs, nil
+}
+
+// hasAllocations reports whether any address has been handed out from the pool.
+func (v *IPPoolValidator) hasAllocations(ctx context.Context, pool *v1.IPPool) (bool, error) {
+	if pool.Status.Allocated > 0 {
+		return true, nil
+	}
+
+	addresses := &ipamv1.IPAddressList{}
+	if err := v.Client.List(ctx, addresses, client.InNamespace(pool.Namespace)); err != nil {
+		return false, fmt.Errorf("unable to list IPAddresses: %w", err)
+	}
+	for _, address := range addresses.Items {
+		poolRef := address.Spec.PoolRef
+		if poolRef.Kind == v1.IPPoolKind && poolRef.APIGroup != nil && *poolRef.APIGroup == v1.APIGroupName && poolRef.Name == pool.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validateImmutable rejects changes to the fields which can't be applied to
+// addresses already handed out.  Ranges, gateway and prefix changes are
+// handled by the controller.
+func validateImmutable(oldSpec, newSpec v1.IPPoolSpec) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	const msg = "field is immutable while addresses are allocated from the pool"
+
+	if oldSpec.RoutingDomain != newSpec.RoutingDomain {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("routing-domain"), msg))
+	}
+	if oldSpec.PairedPool != newSpec.PairedPool {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("paired-pool"), msg))
+	}
+	if mgmt.PoolBackend(oldSpec) != mgmt.PoolBackend(newSpec) {
+		allErrs = append(allErrs, field.Forbidden(specPath, "the backend of the pool is immutable while addresses are allocated from the pool"))
+	}
+	return allErrs
+}
+
+func toInvalid(pool *v1.IPPool, allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(v1.GroupVersion.WithKind(v1.IPPoolKind).GroupKind(), pool.Name, allErrs)
+}
@@ -0,0 +1,287 @@
+package webhook
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ipamv1 "sigs.k8s.io/cluster-api/exp/ipam/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1 "github.com/rvanderp3/machine-ipam-controller/pkg/apis/ipamcontroller.openshift.io/v1"
+	"github.com/rvanderp3/machine-ipam-controller/pkg/mgmt"
+)
+
+func testPool(name string, mutate func(*v1.IPPoolSpec)) *v1.IPPool {
+	pool := &v1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+		Spec: v1.IPPoolSpec{
+			AddressCidr: "192.168.1.0/25",
+			Prefix:      24,
+			Gateway:     "192.168.1.1",
+			Nameserver:  []string{"192.168.1.53"},
+		},
+	}
+	if mutate != nil {
+		mutate(&pool.Spec)
+	}
+	return pool
+}
+
+func testHTTP(network string) *v1.HTTPAllocatorConfig {
+	return &v1.HTTPAllocatorConfig{URL: "https://ipam.example.com/v1", Network: network}
+}
+
+// newTestValidator returns a validator reading objects from a fake client.
+func newTestValidator(t *testing.T, objects ...client.Object) *IPPoolValidator {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{v1.AddToScheme, ipamv1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &IPPoolValidator{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()}
+}
+
+// checkInvalid checks that err rejects field, or that err is nil when field
+// is empty.
+func checkInvalid(t *testing.T, name string, err error, field string) {
+	t.Helper()
+	switch {
+	case field == "" && err != nil:
+		t.Errorf("%v: expected the pool to be accepted, got %v", name, err)
+	case field != "" && err == nil:
+		t.Errorf("%v: expected %v to be rejected", name, field)
+	case field != "" && (!apierrors.IsInvalid(err) || !strings.Contains(err.Error(), field)):
+		t.Errorf("%v: expected %v to be rejected, got %v", name, field, err)
+	}
+}
+
+func TestValidateCreate(t *testing.T) {
+	existing := []client.Object{
+		testPool("existing", func(spec *v1.IPPoolSpec) {
+			spec.AddressCidr = "10.0.0.0/24"
+			spec.Gateway = ""
+		}),
+		testPool("lab-a", func(spec *v1.IPPoolSpec) {
+			spec.AddressCidr = ""
+			spec.Gateway = ""
+			spec.HTTP = testHTTP("10.1.0.0/24")
+			spec.RoutingDomain = "lab-a"
+		}),
+	}
+	for _, tc := range []struct {
+		name   string
+		mutate func(*v1.IPPoolSpec)
+		// field is the field the pool is rejected for, none if it is valid.
+		field string
+	}{
+		{name: "valid"},
+		{name: "invalid cidr", mutate: func(spec *v1.IPPoolSpec) { spec.AddressCidr = "192.168.1.0/33" }, field: "spec.address-cidr"},
+		{name: "invalid range", mutate: func(spec *v1.IPPoolSpec) { spec.Addresses = []string{"192.168.1.200-192.168.1.100"} }, field: "spec.addresses[0]"},
+		{name: "invalid exclude", mutate: func(spec *v1.IPPoolSpec) { spec.Excludes = []string{"not-an-address"} }, field: "spec.excludes[0]"},
+		{name: "no addresses", mutate: func(spec *v1.IPPoolSpec) { spec.AddressCidr = "" }, field: "spec.address-cidr"},
+		{name: "range outside prefix", mutate: func(spec *v1.IPPoolSpec) { spec.Prefix = 26 }, field: "spec.prefix"},
+		{name: "gateway outside subnet", mutate: func(spec *v1.IPPoolSpec) { spec.Gateway = "192.168.2.1" }, field: "spec.gateway"},
+		{name: "gateway of another family", mutate: func(spec *v1.IPPoolSpec) { spec.Gateway = "fd00::1" }, field: "spec.gateway"},
+		{name: "invalid nameserver", mutate: func(spec *v1.IPPoolSpec) { spec.Nameserver = []string{"dns.example.com"} }, field: "spec.nameserver[0]"},
+		{name: "paired with itself", mutate: func(spec *v1.IPPoolSpec) { spec.PairedPool = "pool" }, field: "spec.paired-pool"},
+		{name: "invalid routing domain", mutate: func(spec *v1.IPPoolSpec) { spec.RoutingDomain = "Lab_A" }, field: "spec.routing-domain"},
+		{
+			name: "two backends",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = ""
+				spec.HTTP = testHTTP("10.2.0.0/24")
+				spec.NetBox = &v1.NetBoxConfig{URL: "https://netbox.example.com", Prefix: "10.2.0.0/24", CredentialsSecret: "netbox"}
+			},
+			field: "only one backend",
+		},
+		{name: "external with address-cidr", mutate: func(spec *v1.IPPoolSpec) { spec.HTTP = testHTTP("192.168.1.0/25") }, field: "spec.address-cidr"},
+		{
+			name: "infoblox without secret",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = ""
+				spec.Infoblox = &v1.InfobloxConfig{Host: "infoblox.example.com", Network: "192.168.1.0/25"}
+			},
+			field: "spec.infoblox.credentials-secret",
+		},
+		{
+			name: "netbox with prefix and range",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = ""
+				spec.NetBox = &v1.NetBoxConfig{URL: "https://netbox.example.com", Prefix: "192.168.1.0/25", IPRange: "192.168.1.1-192.168.1.9", CredentialsSecret: "netbox"}
+			},
+			field: "spec.netbox.ip-range",
+		},
+		{
+			name: "http without scheme",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = ""
+				spec.HTTP = &v1.HTTPAllocatorConfig{URL: "ipam.example.com", Network: "192.168.1.0/25"}
+			},
+			field: "spec.http.url",
+		},
+		{name: "dns without zone", mutate: func(spec *v1.IPPoolSpec) { spec.DNS = &v1.DNSConfig{Server: "192.168.1.53"} }, field: "spec.dns.zone"},
+		{
+			name: "dns with forward reverse zone",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.DNS = &v1.DNSConfig{Zone: "example.com", ReverseZone: "example.org", Server: "192.168.1.53"}
+			},
+			field: "spec.dns.reverse-zone",
+		},
+		{
+			name:   "dhcp-export with invalid config map",
+			mutate: func(spec *v1.IPPoolSpec) { spec.DHCPExport = &v1.DHCPExportConfig{ConfigMap: "Not_Valid"} },
+			field:  "spec.dhcp-export.config-map",
+		},
+		{name: "overlapping pool", mutate: func(spec *v1.IPPoolSpec) { spec.AddressCidr = "10.0.0.128/25"; spec.Gateway = "" }, field: "overlaps"},
+		{
+			name: "built-in pools in other routing domains",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = "10.0.0.128/25"
+				spec.Gateway = ""
+				spec.RoutingDomain = "lab-b"
+			},
+			field: "overlaps",
+		},
+		{
+			name: "external pool in another routing domain",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = ""
+				spec.Gateway = ""
+				spec.HTTP = testHTTP("10.1.0.0/24")
+				spec.RoutingDomain = "lab-b"
+			},
+		},
+		{
+			name: "external pool in the same routing domain",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = ""
+				spec.Gateway = ""
+				spec.HTTP = testHTTP("10.1.0.0/25")
+				spec.RoutingDomain = "lab-a"
+			},
+			field: "overlaps",
+		},
+		{
+			name: "external pool in the default routing domain",
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = ""
+				spec.Gateway = ""
+				spec.HTTP = testHTTP("10.0.0.0/24")
+			},
+			field: "overlaps",
+		},
+	} {
+		v := newTestValidator(t, existing...)
+		err := v.ValidateCreate(context.Background(), testPool("pool", tc.mutate))
+		checkInvalid(t, tc.name, err, tc.field)
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	apiGroup := v1.APIGroupName
+	ipAddress := func(pool string) *ipamv1.IPAddress {
+		return &ipamv1.IPAddress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: pool + "-address"},
+			Spec: ipamv1.IPAddressSpec{
+				Address: "192.168.1.5",
+				PoolRef: corev1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: v1.IPPoolKind, Name: pool},
+			},
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		// objects are the objects besides the pool.
+		objects []client.Object
+		// allocated is the number of allocations in the pool's status.
+		allocated int64
+		deleting  bool
+		// base changes the pool before the update, mutate is the update.
+		base   func(*v1.IPPoolSpec)
+		mutate func(*v1.IPPoolSpec)
+		field  string
+	}{
+		{name: "unchanged"},
+		{name: "unchanged invalid pool", base: func(spec *v1.IPPoolSpec) { spec.Gateway = "192.168.2.1" }},
+		{name: "invalid change", mutate: func(spec *v1.IPPoolSpec) { spec.Prefix = 26 }, field: "spec.prefix"},
+		{name: "invalid change of a deleting pool", deleting: true, mutate: func(spec *v1.IPPoolSpec) { spec.Prefix = 26 }},
+		{name: "paired pool without allocations", mutate: func(spec *v1.IPPoolSpec) { spec.PairedPool = "v6" }},
+		{
+			name:    "paired pool with an IPAddress",
+			objects: []client.Object{ipAddress("pool")},
+			mutate:  func(spec *v1.IPPoolSpec) { spec.PairedPool = "v6" },
+			field:   "spec.paired-pool",
+		},
+		{
+			name:    "paired pool with an IPAddress of another pool",
+			objects: []client.Object{ipAddress("other")},
+			mutate:  func(spec *v1.IPPoolSpec) { spec.PairedPool = "v6" },
+		},
+		{
+			name:      "routing domain with allocations",
+			allocated: 1,
+			mutate:    func(spec *v1.IPPoolSpec) { spec.RoutingDomain = "lab-a" },
+			field:     "spec.routing-domain",
+		},
+		{
+			name:      "backend with allocations",
+			allocated: 1,
+			mutate: func(spec *v1.IPPoolSpec) {
+				spec.AddressCidr = ""
+				spec.HTTP = testHTTP("192.168.1.0/25")
+			},
+			field: "backend of the pool is immutable",
+		},
+		{
+			name:      "ranges with allocations",
+			allocated: 1,
+			mutate:    func(spec *v1.IPPoolSpec) { spec.AddressCidr = "192.168.1.0/26" },
+		},
+		{
+			name:    "overlapping change",
+			objects: []client.Object{testPool("other", func(spec *v1.IPPoolSpec) { spec.AddressCidr = "192.168.1.128/25" })},
+			mutate:  func(spec *v1.IPPoolSpec) { spec.AddressCidr = "192.168.1.0/24" },
+			field:   "overlaps",
+		},
+	} {
+		oldPool := testPool("pool", tc.base)
+		oldPool.Status.Allocated = tc.allocated
+		pool := oldPool.DeepCopy()
+		if tc.mutate != nil {
+			tc.mutate(&pool.Spec)
+		}
+		if tc.deleting {
+			now := metav1.Now()
+			pool.DeletionTimestamp = &now
+		}
+		v := newTestValidator(t, append(tc.objects, oldPool)...)
+		err := v.ValidateUpdate(context.Background(), oldPool, pool)
+		checkInvalid(t, tc.name, err, tc.field)
+	}
+}
+
+func TestValidateIPPoolSpecBackends(t *testing.T) {
+	// Every backend is covered by the checks on external pools.
+	for _, backend := range []string{mgmt.BackendInfoblox, mgmt.BackendNetBox, mgmt.BackendHTTP} {
+		spec := v1.IPPoolSpec{Prefix: 24, Excludes: []string{"10.0.0.1"}}
+		switch backend {
+		case mgmt.BackendInfoblox:
+			spec.Infoblox = &v1.InfobloxConfig{Host: "infoblox.example.com", Network: "10.0.0.0/24", CredentialsSecret: "infoblox"}
+		case mgmt.BackendNetBox:
+			spec.NetBox = &v1.NetBoxConfig{URL: "https://netbox.example.com", Prefix: "10.0.0.0/24", CredentialsSecret: "netbox"}
+		case mgmt.BackendHTTP:
+			spec.HTTP = testHTTP("10.0.0.0/24")
+		}
+		allErrs := ValidateIPPoolSpec(&v1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool"}, Spec: spec})
+		if len(allErrs) != 1 || allErrs[0].Field != "spec.excludes" {
+			t.Errorf("%v: got %v, want excludes to be rejected", backend, allErrs)
+		}
+	}
+}